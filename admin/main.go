@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"contourguessr-ingest/admin/routes"
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/imagestore"
+	"contourguessr-ingest/ratelimit"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
@@ -47,6 +50,15 @@ func main() {
 
 	routes.MaptilerAPIKey = maptilerApiKey
 
+	if value := os.Getenv("FLICKR_STATIC_ENDPOINT"); value != "" {
+		flickr.StaticEndpoint = value
+	}
+
+	routes.ImageStore, err = imagestore.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	db, err = pgxpool.Connect(context.Background(), databaseURL)
 	if err != nil {
 		log.Fatal(err)
@@ -59,6 +71,11 @@ func main() {
 	})
 	routes.Rdb = rdb
 
+	routes.StaticLimiter, err = ratelimit.FlickrStatic(rdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Serve
 
 	mux := routes.Mux()
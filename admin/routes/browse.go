@@ -106,13 +106,15 @@ type browseEntry struct {
 	DebugChallengeURL string
 	OriginalURL       string
 	HasGPS            bool
+	IsRetired         bool
 }
 
 const perPage = 50
 
 func loadBrowsePage(ctx context.Context, regionId int, pageNum int) (bool, []browseEntry, error) {
 	rows, err := Db.Query(ctx, `
-		SELECT c.id, p.flickr_id, p.summary->>'server', p.summary->>'secret', p.summary->>'owner', p.exif->'GPSLatitude' is not null
+		SELECT c.id, p.flickr_id, p.summary->>'server', p.summary->>'secret', p.summary->>'owner', p.exif->'GPSLatitude' is not null,
+		       c.retired_at is not null
 		FROM challenges as c
 		JOIN flickr_challenge_sources as fcs ON c.id = fcs.challenge_id
 		JOIN flickr_photos as p ON fcs.flickr_id = p.flickr_id
@@ -132,12 +134,12 @@ func loadBrowsePage(ctx context.Context, regionId int, pageNum int) (bool, []bro
 		var owner string
 		var server string
 		var secret string
-		err := rows.Scan(&internalChallengeId, &entry.FlickrId, &server, &secret, &owner, &entry.HasGPS)
+		err := rows.Scan(&internalChallengeId, &entry.FlickrId, &server, &secret, &owner, &entry.HasGPS, &entry.IsRetired)
 		if err != nil {
 			return false, nil, err
 		}
 
-		entry.PreviewURL = "https://live.staticflickr.com/" + server + "/" + entry.FlickrId + "_" + secret + "_m.jpg"
+		entry.PreviewURL = imageURL(entry.FlickrId, server, secret, "m")
 		entry.OriginalURL = "https://www.flickr.com/photos/" + owner + "/" + entry.FlickrId
 
 		entry.ChallengeId = encodeChallengeID(internalChallengeId)
@@ -6,7 +6,7 @@ import (
 )
 
 func elevationsHandler(w http.ResponseWriter, r *http.Request) {
-	total, err := countTotalWithAlti(r.Context())
+	total, uncorrected, err := countTotalWithAlti(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -36,19 +36,23 @@ func elevationsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templateResponse(w, r, "elevations.tmpl.html", M{
-		"Total":     total,
-		"Histogram": histogram,
+		"Total":       total,
+		"Uncorrected": uncorrected,
+		"Histogram":   histogram,
 	})
 }
 
-func countTotalWithAlti(ctx context.Context) (int, error) {
-	var count int
+// countTotalWithAlti counts photos with a GPS altitude, and how many of those
+// were scored before we corrected for the datum and so are left out
+func countTotalWithAlti(ctx context.Context) (int, int, error) {
+	var total, uncorrected int
 	err := Db.QueryRow(ctx, `
-		SELECT count(*)
-		FROM photo_scores
+		SELECT count(*) FILTER (WHERE altitude_above_terrain IS NOT NULL),
+			   count(*) FILTER (WHERE altitude_above_terrain IS NULL)
+		FROM current_photo_scores
 		WHERE gps_altitude_available
-	`).Scan(&count)
-	return count, err
+	`).Scan(&total, &uncorrected)
+	return total, uncorrected, err
 }
 
 type histogramEntry struct {
@@ -59,22 +63,26 @@ type histogramEntry struct {
 }
 
 type histogramPoint struct {
-	FlickrID        string
-	PreviewURL      string
-	WebURL          string
-	GPSAltitude     float64
-	TerrainAltitude float64
+	FlickrID             string
+	PreviewURL           string
+	WebURL               string
+	GPSAltitude          float64
+	GPSAltitudeDatum     string
+	TerrainAltitude      float64
+	TerrainAltitudeDatum string
+	AltitudeAboveTerrain float64
 }
 
 func loadHistogramEntry(ctx context.Context, minAlt int, maxAlt int) (histogramEntry, error) {
 	rows, err := Db.Query(ctx, `
 		SELECT p.flickr_id, p.summary->>'owner', p.summary->>'server', p.summary->>'secret',
-			   s.gps_altitude, s.terrain_altitude
+			   s.gps_altitude, s.gps_altitude_datum, s.terrain_altitude, s.terrain_altitude_datum,
+			   s.altitude_above_terrain
 		FROM flickr_photos as p
-		JOIN photo_scores as s ON s.flickr_photo_id = p.flickr_id
+		JOIN current_photo_scores as s ON s.flickr_photo_id = p.flickr_id
 		WHERE s.gps_altitude_available AND
-		    (s.gps_altitude - s.terrain_altitude) >= $1 AND
-			(s.gps_altitude - s.terrain_altitude) < $2
+		    s.altitude_above_terrain >= $1 AND
+			s.altitude_above_terrain < $2
 		ORDER BY random()
 	`, minAlt, maxAlt)
 	if err != nil {
@@ -88,20 +96,18 @@ func loadHistogramEntry(ctx context.Context, minAlt int, maxAlt int) (histogramE
 		var owner string
 		var server string
 		var secret string
-		var gpsAltitude float64
-		var terrainAltitude float64
-		err = rows.Scan(&flickrID, &owner, &server, &secret, &gpsAltitude, &terrainAltitude)
+		var point histogramPoint
+		err = rows.Scan(&flickrID, &owner, &server, &secret,
+			&point.GPSAltitude, &point.GPSAltitudeDatum, &point.TerrainAltitude, &point.TerrainAltitudeDatum,
+			&point.AltitudeAboveTerrain)
 		if err != nil {
 			return histogramEntry{}, err
 		}
 
-		points = append(points, histogramPoint{
-			FlickrID:        flickrID,
-			PreviewURL:      "https://live.staticflickr.com/" + server + "/" + flickrID + "_" + secret + "_n.jpg",
-			WebURL:          "https://www.flickr.com/photos/" + owner + "/" + flickrID,
-			GPSAltitude:     gpsAltitude,
-			TerrainAltitude: terrainAltitude,
-		})
+		point.FlickrID = flickrID
+		point.PreviewURL = imageURL(flickrID, server, secret, "n")
+		point.WebURL = "https://www.flickr.com/photos/" + owner + "/" + flickrID
+		points = append(points, point)
 	}
 
 	return histogramEntry{
@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"context"
+	"contourguessr-ingest/notify"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type failureClass struct {
+	Kind  string
+	Count int
+	// Retrying is how many the scorer will retry, it has given up on the rest
+	Retrying int
+}
+
+type failureEntry struct {
+	FlickrID    string
+	Kind        string
+	Err         string
+	Attempts    int
+	FirstFailed time.Time
+	LastFailed  time.Time
+	NextRetryAt *time.Time
+	PreviewURL  string
+	WebURL      string
+}
+
+const maxFailures = 200
+
+// failuresHandler lists photos the scorer failed to fetch or classify,
+// optionally only those of one kind.
+func failuresHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+
+	classes, err := loadFailureClasses(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	failures, err := loadFailures(r.Context(), kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templateResponse(w, r, "failures.tmpl.html", M{
+		"Classes":     classes,
+		"Kind":        kind,
+		"Failures":    failures,
+		"MaxFailures": maxFailures,
+	})
+}
+
+// retryFailuresHandler makes failures due for retry now. It takes either a
+// flickr_id, or a kind to retry all failures of that kind.
+func retryFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flickrID := r.PostForm.Get("flickr_id")
+	kind := r.PostForm.Get("kind")
+	if flickrID == "" && kind == "" {
+		http.Error(w, "flickr_id or kind required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := Db.Exec(r.Context(), `
+		UPDATE flickr_photo_fetch_failures
+		SET next_retry_at = CURRENT_TIMESTAMP
+		WHERE ($1::text = '' OR flickr_id = $1)
+		  AND ($2::text = '' OR kind = $2)
+	`, flickrID, kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := notify.Notify(r.Context(), Db, notify.FetchRetried); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/failures?"+url.Values{"kind": {r.PostForm.Get("return_kind")}}.Encode(), http.StatusSeeOther)
+}
+
+func loadFailureClasses(ctx context.Context) ([]failureClass, error) {
+	rows, err := Db.Query(ctx, `
+		SELECT kind, count(*), count(*) filter ( where next_retry_at IS NOT NULL )
+		FROM flickr_photo_fetch_failures
+		GROUP BY kind
+		ORDER BY kind
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var classes []failureClass
+	for rows.Next() {
+		var class failureClass
+		if err := rows.Scan(&class.Kind, &class.Count, &class.Retrying); err != nil {
+			return nil, err
+		}
+		classes = append(classes, class)
+	}
+	return classes, rows.Err()
+}
+
+func loadFailures(ctx context.Context, kind string) ([]failureEntry, error) {
+	rows, err := Db.Query(ctx, `
+		SELECT f.flickr_id, f.kind, f.err, f.attempts, f.inserted_at, f.updated_at, f.next_retry_at,
+			   p.summary->>'owner', p.summary->>'server', p.summary->>'secret'
+		FROM flickr_photo_fetch_failures as f
+		JOIN flickr_photos as p ON p.flickr_id = f.flickr_id
+		WHERE $1::text = '' OR f.kind = $1
+		ORDER BY f.updated_at DESC
+		LIMIT $2
+	`, kind, maxFailures)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []failureEntry
+	for rows.Next() {
+		var f failureEntry
+		var owner, server, secret string
+		err := rows.Scan(&f.FlickrID, &f.Kind, &f.Err, &f.Attempts, &f.FirstFailed, &f.LastFailed, &f.NextRetryAt,
+			&owner, &server, &secret)
+		if err != nil {
+			return nil, err
+		}
+		f.PreviewURL = imageURL(f.FlickrID, server, secret, "n")
+		f.WebURL = "https://www.flickr.com/photos/" + owner + "/" + f.FlickrID
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"context"
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/imagestore"
+	"contourguessr-ingest/ratelimit"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ImageStore is shared with the scorer, which fills it. It may be nil.
+var ImageStore *imagestore.Store
+
+// StaticLimiter is the budget for the Flickr static server, shared with the
+// scorer and training export.
+var StaticLimiter *ratelimit.Limiter
+
+var staticClient = &http.Client{Timeout: 10 * time.Second}
+
+// imageURL is where pages load a photo from. If we have an image store that
+// is imgHandler, so photos the scorer already fetched aren't hotlinked.
+func imageURL(flickrID, server, secret, size string) string {
+	if ImageStore == nil {
+		return flickrStaticURL(flickrID, server, secret, size)
+	}
+	return "/img/" + flickrID + "/" + server + "/" + secret + "/" + size
+}
+
+func flickrStaticURL(flickrID, server, secret, size string) string {
+	return flickr.SourceURL(flickr.Photo{ID: flickrID, Server: server, Secret: secret}, size)
+}
+
+// imgHandler serves photos from the image store. Anything not stored is
+// fetched and stored if the shared budget has a request to spare right now,
+// and otherwise redirected to Flickr, so browsing admin never waits on or
+// starves the scorer.
+func imgHandler(w http.ResponseWriter, r *http.Request) {
+	flickrID := r.PathValue("id")
+	server := r.PathValue("server")
+	secret := r.PathValue("secret")
+	size := r.PathValue("size")
+
+	key := imagestore.Key{FlickrID: flickrID, Secret: secret, Size: size}
+	data, err := ImageStore.Read(key)
+	if errors.Is(err, imagestore.ErrNotFound) {
+		data, err = fetchStatic(r.Context(), key, server)
+		if err != nil {
+			if !errors.Is(err, errNoBudget) {
+				log.Printf("Error fetching image %s: %s", key, err)
+			}
+			http.Redirect(w, r, flickrStaticURL(flickrID, server, secret, size), http.StatusFound)
+			return
+		}
+	} else if err != nil {
+		log.Printf("Error reading image %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(data)
+}
+
+var errNoBudget = errors.New("no static request budget to spare")
+
+// fetchStatic downloads an image from Flickr within StaticLimiter and stores
+// it.
+func fetchStatic(ctx context.Context, key imagestore.Key, server string) ([]byte, error) {
+	if ok, err := StaticLimiter.Allow(ctx); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errNoBudget
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, flickrStaticURL(key.FlickrID, server, key.Secret, key.Size), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "contourguessr.org (contact github.com/dzfranklin/contourguessr-ingest or daniel@danielzfranklin.org)")
+	resp, err := staticClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ImageStore.Write(key, data); err != nil {
+		log.Printf("Error storing image %s: %s", key, err)
+	}
+	return data, nil
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"context"
+	"contourguessr-ingest/queue"
 	"net/http"
 )
 
@@ -12,15 +13,15 @@ func overviewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wantExifQueueLen, err := Rdb.LLen(r.Context(), "cg-flickr-indexer:want-exif").Result()
+	queues, err := queue.LoadStats(r.Context(), Db)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	templateResponse(w, r, "overview.tmpl.html", M{
-		"Counts":           counts,
-		"WantExifQueueLen": wantExifQueueLen,
+		"Counts": counts,
+		"Queues": queues,
 	})
 }
 
@@ -40,8 +41,7 @@ func loadCounts(ctx context.Context) ([]regionCountsEntry, error) {
 			   count(p.flickr_id) filter ( where s.is_complete ) as count_scored,
 			   count(p.flickr_id) filter ( where s.is_accepted)  as count_accepted
 		FROM flickr_photos as p
-				 LEFT JOIN photo_scores as s ON s.flickr_photo_id = p.flickr_id AND s.vsn = (SELECT max(vsn)
-																							 FROM photo_scores)
+				 LEFT JOIN current_photo_scores as s ON s.flickr_photo_id = p.flickr_id
 				 RIGHT JOIN regions as r ON p.region_id = r.id
 		GROUP BY r.id, r.name
 		ORDER BY r.name
@@ -18,6 +18,35 @@ type plotPoint struct {
 	ScoreUpdatedAt time.Time `json:"score_updated_at"`
 	ValidityScore  float64   `json:"validity_score"`
 	ValidityModel  string    `json:"validity_model"`
+	RoadDistance   *float64  `json:"road_distance"`
+	RoadHighway    *string   `json:"road_highway"`
+	RoadSurface    *string   `json:"road_surface"`
+	TrackDistance  *float64  `json:"track_distance"`
+	PathDistance   *float64  `json:"path_distance"`
+	Cell           string    `json:"cell"`
+	HasChallenge   bool      `json:"has_challenge"`
+}
+
+// plotCell is a geohash cell with live challenges
+type plotCell struct {
+	Cell       string          `json:"cell"`
+	Geometry   json.RawMessage `json:"geometry"`
+	Challenges int             `json:"challenges"`
+}
+
+// densityPolicy is how the challenge assembler spreads out a region's
+// challenges. A nil MaxPerCell means no cap.
+type densityPolicy struct {
+	CellPrecision int
+	MaxPerCell    *int
+}
+
+// densityEffect summarizes the policy in a region. Held back photos are
+// accepted but not used because their cell is full.
+type densityEffect struct {
+	Cells     int
+	FullCells int
+	HeldBack  int
 }
 
 func plotHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,6 +63,10 @@ func plotHandler(w http.ResponseWriter, r *http.Request) {
 	var regionGeoJSON string
 	var regionBBoxJSON string
 	pointsJSON := []byte("null")
+	cellsJSON := []byte("null")
+	var minRoadDistance float64
+	var density densityPolicy
+	var effect densityEffect
 	var validCount int
 	var totalCount int
 	if selectedRegionS != "" {
@@ -49,6 +82,16 @@ func plotHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		err = Db.QueryRow(r.Context(), `
+			SELECT min_road_distance, challenge_cell_precision, max_challenges_per_cell
+			FROM regions
+			WHERE id = $1
+		`, selectedRegion).Scan(&minRoadDistance, &density.CellPrecision, &density.MaxPerCell)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		points, err := loadPoints(r.Context(), selectedRegion)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -61,6 +104,20 @@ func plotHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		cells, err := loadCells(r.Context(), selectedRegion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		cellsJSON, err = json.Marshal(cells)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		effect = summarizeDensity(density, cells, points)
+
 		for _, point := range points {
 			if point.ValidityScore >= 0.5 {
 				validCount++
@@ -70,15 +127,19 @@ func plotHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templateResponse(w, r, "plot.tmpl.html", M{
-		"MaptilerAPIKey": MaptilerAPIKey,
-		"Regions":        regions,
-		"SelectedRegion": selectedRegionS,
-		"RegionBBoxJSON": regionBBoxJSON,
-		"RegionGeoJSON":  regionGeoJSON,
-		"PointsJSON":     string(pointsJSON),
-		"ValidCount":     validCount,
-		"TotalCount":     totalCount,
-		"ValidPercent":   fmt.Sprintf("%.2f%%", float64(validCount)/float64(totalCount)*100),
+		"MaptilerAPIKey":  MaptilerAPIKey,
+		"Regions":         regions,
+		"SelectedRegion":  selectedRegionS,
+		"RegionBBoxJSON":  regionBBoxJSON,
+		"RegionGeoJSON":   regionGeoJSON,
+		"PointsJSON":      string(pointsJSON),
+		"CellsJSON":       string(cellsJSON),
+		"MinRoadDistance": minRoadDistance,
+		"Density":         density,
+		"DensityEffect":   effect,
+		"ValidCount":      validCount,
+		"TotalCount":      totalCount,
+		"ValidPercent":    fmt.Sprintf("%.2f%%", float64(validCount)/float64(totalCount)*100),
 	})
 }
 
@@ -101,12 +162,19 @@ func loadPoints(ctx context.Context, region int) ([]plotPoint, error) {
 	rows, err := Db.Query(ctx, `
 		SELECT p.flickr_id, p.summary->>'owner', p.summary->>'server', p.summary->>'secret',
 		       ST_X(p.geo::geometry), ST_Y(p.geo::geometry),
-		       s.is_accepted, s.updated_at, s.validity_score, s.validity_model
+		       coalesce(s.is_accepted, false), s.updated_at, s.validity_score, s.validity_model,
+		       s.road_distance, s.road_highway, s.road_surface, s.track_distance, s.path_distance,
+		       ST_GeoHash(p.geo::geometry, r.challenge_cell_precision),
+		       exists (SELECT 1
+		               FROM flickr_challenge_sources as src
+		               JOIN challenges as c ON c.id = src.challenge_id
+		               WHERE src.flickr_id = p.flickr_id AND c.retired_at IS NULL)
 		FROM flickr_photos as p
-				 JOIN (SELECT DISTINCT ON (flickr_photo_id) *
-					   FROM photo_scores
-					   ORDER BY flickr_photo_id, updated_at DESC) AS s ON p.flickr_id = s.flickr_photo_id
-		WHERE not road_within_1000m and region_id = $1
+				 JOIN current_photo_scores AS s ON p.flickr_id = s.flickr_photo_id
+				 JOIN regions AS r ON r.id = p.region_id
+		-- Scores from before we measured distances only have road_within_1000m
+		WHERE coalesce(s.road_distance >= r.min_road_distance, not s.road_within_1000m)
+		  AND p.region_id = $1
 	`, region)
 	if err != nil {
 		return nil, err
@@ -120,14 +188,64 @@ func loadPoints(ctx context.Context, region int) ([]plotPoint, error) {
 		var lng, lat float64
 		err = rows.Scan(&p.FlickrID, &owner, &server, &secret,
 			&lng, &lat,
-			&p.IsAccepted, &p.ScoreUpdatedAt, &p.ValidityScore, &p.ValidityModel)
+			&p.IsAccepted, &p.ScoreUpdatedAt, &p.ValidityScore, &p.ValidityModel,
+			&p.RoadDistance, &p.RoadHighway, &p.RoadSurface, &p.TrackDistance, &p.PathDistance,
+			&p.Cell, &p.HasChallenge)
 		if err != nil {
 			return nil, err
 		}
-		p.PreviewURL = "https://live.staticflickr.com/" + server + "/" + p.FlickrID + "_" + secret + "_n.jpg"
+		p.PreviewURL = imageURL(p.FlickrID, server, secret, "n")
 		p.WebURL = "https://www.flickr.com/photos/" + owner + "/" + p.FlickrID
 		p.Geo = []float64{lng, lat}
 		points = append(points, p)
 	}
 	return points, nil
 }
+
+// loadCells uses the same cells as the challenge assembler
+func loadCells(ctx context.Context, region int) ([]plotCell, error) {
+	cells := make([]plotCell, 0)
+	rows, err := Db.Query(ctx, `
+		SELECT cell, ST_AsGeoJSON(ST_GeomFromGeoHash(cell)), challenges
+		FROM (SELECT ST_GeoHash(c.geo::geometry, r.challenge_cell_precision) as cell, count(*) as challenges
+			  FROM challenges as c
+					   JOIN regions as r ON r.id = c.region_id
+			  WHERE c.region_id = $1
+				AND c.retired_at IS NULL
+			  GROUP BY 1) as counts
+	`, region)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c plotCell
+		var geometry string
+		if err := rows.Scan(&c.Cell, &geometry, &c.Challenges); err != nil {
+			return nil, err
+		}
+		c.Geometry = json.RawMessage(geometry)
+		cells = append(cells, c)
+	}
+	return cells, rows.Err()
+}
+
+func summarizeDensity(policy densityPolicy, cells []plotCell, points []plotPoint) densityEffect {
+	effect := densityEffect{Cells: len(cells)}
+	if policy.MaxPerCell == nil {
+		return effect
+	}
+	full := make(map[string]bool)
+	for _, c := range cells {
+		if c.Challenges >= *policy.MaxPerCell {
+			full[c.Cell] = true
+			effect.FullCells++
+		}
+	}
+	for _, p := range points {
+		if p.IsAccepted && !p.HasChallenge && full[p.Cell] {
+			effect.HeldBack++
+		}
+	}
+	return effect
+}
@@ -71,6 +71,8 @@ func Mux() http.Handler {
 		{Path: "/browse", Title: "Browse"},
 		{Path: "/plot", Title: "Plot"},
 		{Path: "/elevations", Title: "Elevations"},
+		{Path: "/versions", Title: "Versions"},
+		{Path: "/failures", Title: "Failures"},
 	}
 
 	mux := http.NewServeMux()
@@ -80,6 +82,10 @@ func Mux() http.Handler {
 	mux.HandleFunc("/plot", plotHandler)
 	mux.HandleFunc("/elevations", elevationsHandler)
 	mux.HandleFunc("/browse", browseHandler)
+	mux.HandleFunc("/versions", versionsHandler)
+	mux.HandleFunc("GET /failures", failuresHandler)
+	mux.HandleFunc("POST /failures/retry", retryFailuresHandler)
+	mux.HandleFunc("GET /img/{id}/{server}/{secret}/{size}", imgHandler)
 
 	return timingMiddleware(mux)
 }
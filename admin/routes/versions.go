@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+type versionFlip struct {
+	FlickrID      string
+	PreviewURL    string
+	WebURL        string
+	NowAccepted   bool
+	ValidityScore *float64
+}
+
+type versionSummary struct {
+	Compared int
+	Accepted int
+	Rejected int
+}
+
+const maxVersionFlips = 200
+
+// versionsHandler compares the scores of photos scored at two versions,
+// listing those that flipped between accepted and rejected.
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fromParam := q.Get("from")
+	toParam := q.Get("to")
+
+	versions, err := listScoreVersions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var summary versionSummary
+	var flips []versionFlip
+	if fromParam != "" && toParam != "" {
+		from, err := strconv.Atoi(fromParam)
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+		to, err := strconv.Atoi(toParam)
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+
+		summary, flips, err = loadVersionDiff(r.Context(), from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	templateResponse(w, r, "versions.tmpl.html", M{
+		"Versions": versions,
+		"From":     fromParam,
+		"To":       toParam,
+		"Summary":  summary,
+		"Flips":    flips,
+		"MaxFlips": maxVersionFlips,
+	})
+}
+
+type scoreVersion struct {
+	Vsn      int
+	Count    int
+	Complete int
+}
+
+func listScoreVersions(ctx context.Context) ([]scoreVersion, error) {
+	rows, err := Db.Query(ctx, `
+		SELECT vsn, count(*), count(*) filter ( where is_complete )
+		FROM photo_scores
+		GROUP BY vsn
+		ORDER BY vsn
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []scoreVersion
+	for rows.Next() {
+		var v scoreVersion
+		if err := rows.Scan(&v.Vsn, &v.Count, &v.Complete); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// loadVersionDiff only compares photos that are completely scored at both
+// versions.
+func loadVersionDiff(ctx context.Context, from int, to int) (versionSummary, []versionFlip, error) {
+	var summary versionSummary
+	err := Db.QueryRow(ctx, `
+		SELECT count(*),
+			   count(*) filter ( where b.is_accepted AND NOT a.is_accepted ),
+			   count(*) filter ( where a.is_accepted AND NOT b.is_accepted )
+		FROM photo_scores as a
+		JOIN photo_scores as b ON a.flickr_photo_id = b.flickr_photo_id
+		WHERE a.vsn = $1 AND b.vsn = $2 AND a.is_complete AND b.is_complete
+	`, from, to).Scan(&summary.Compared, &summary.Accepted, &summary.Rejected)
+	if err != nil {
+		return summary, nil, err
+	}
+
+	rows, err := Db.Query(ctx, `
+		SELECT p.flickr_id, p.summary->>'owner', p.summary->>'server', p.summary->>'secret',
+			   b.is_accepted, b.validity_score
+		FROM photo_scores as a
+		JOIN photo_scores as b ON a.flickr_photo_id = b.flickr_photo_id
+		JOIN flickr_photos as p ON p.flickr_id = a.flickr_photo_id
+		WHERE a.vsn = $1 AND b.vsn = $2 AND a.is_complete AND b.is_complete
+			AND a.is_accepted IS DISTINCT FROM b.is_accepted
+		ORDER BY p.flickr_id
+		LIMIT $3
+	`, from, to, maxVersionFlips)
+	if err != nil {
+		return summary, nil, err
+	}
+	defer rows.Close()
+
+	var flips []versionFlip
+	for rows.Next() {
+		var flip versionFlip
+		var owner, server, secret string
+		err := rows.Scan(&flip.FlickrID, &owner, &server, &secret, &flip.NowAccepted, &flip.ValidityScore)
+		if err != nil {
+			return summary, nil, err
+		}
+		flip.PreviewURL = imageURL(flip.FlickrID, server, secret, "n")
+		flip.WebURL = "https://www.flickr.com/photos/" + owner + "/" + flip.FlickrID
+		flips = append(flips, flip)
+	}
+	return summary, flips, rows.Err()
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"contourguessr-ingest/imagestore"
+	"contourguessr-ingest/ratelimit"
+	"errors"
+	"fmt"
 	"github.com/jackc/pgx/v4"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 	flag "github.com/spf13/pflag"
 	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"sync"
@@ -16,6 +20,8 @@ import (
 
 var dbURL string
 var outDir string
+var store *imagestore.Store
+var staticLimiter *ratelimit.Limiter
 
 func init() {
 	// Environment variables
@@ -30,6 +36,22 @@ func init() {
 		log.Fatal("INGEST_DB not set")
 	}
 
+	store, err = imagestore.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Downloads share the scorer's budget for the static server. Without
+	// REDIS_ADDR they are only limited locally.
+	var rdb *redis.Client
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		rdb = redis.NewClient(&redis.Options{Addr: addr})
+	}
+	staticLimiter, err = ratelimit.FlickrStatic(rdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Flags
 
 	flag.Parse()
@@ -96,21 +118,18 @@ func doDownload(c *http.Client, entry Entry) {
 		return
 	}
 
-	time.Sleep(time.Duration(100+rand.Intn(400)) * time.Millisecond)
-
-	req, err := http.NewRequest(http.MethodGet, entry.Src, nil)
-	if err != nil {
-		log.Fatal(err)
+	fetch := func(ctx context.Context) ([]byte, error) {
+		return download(ctx, c, entry)
 	}
-	req.Header.Set("User-Agent", "contourguessr.org (contact daniel@danielzfranklin.org)")
-	resp, err := c.Do(req)
-	if err != nil {
-		log.Fatal(err)
+	var data []byte
+	var err error
+	if key, ok := imagestore.KeyFromSourceURL(entry.Src); ok {
+		data, err = store.Get(context.Background(), key, fetch)
+	} else {
+		data, err = fetch(context.Background())
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Println("Download failed: status ", resp.StatusCode)
+	if errors.Is(err, errDownloadFailed) {
+		log.Println(err)
 		downloadFailuresMu.Lock()
 		consecutiveDownloadFailures++
 		if consecutiveDownloadFailures > 10 {
@@ -118,17 +137,38 @@ func doDownload(c *http.Client, entry Entry) {
 		}
 		downloadFailuresMu.Unlock()
 		return
+	} else if err != nil {
+		log.Fatal(err)
 	}
 
-	file, err := os.Create(path)
+	err = os.WriteFile(path, data, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	_, err = io.Copy(file, resp.Body)
+var errDownloadFailed = errors.New("download failed")
+
+func download(ctx context.Context, c *http.Client, entry Entry) ([]byte, error) {
+	if err := staticLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, entry.Src, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "contourguessr.org (contact daniel@danielzfranklin.org)")
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", errDownloadFailed, resp.StatusCode)
 	}
+	return io.ReadAll(resp.Body)
 }
 
 func loadLabels(db *pgx.Conn) []Entry {
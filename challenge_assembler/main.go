@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/notify"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v4"
 	"github.com/joho/godotenv"
@@ -15,6 +17,17 @@ import (
 
 var db *pgx.Conn
 
+// pollInterval is how long we wait for a notification before checking for
+// work anyway
+var pollInterval = 5 * time.Minute
+var allowedLicenses flickr.LicenseSet
+
+// A photo is a near duplicate of an existing challenge if their preview
+// hashes differ by at most duplicateMaxHashDistance bits, and either they
+// have the same owner or they are within duplicateRadius meters
+const duplicateMaxHashDistance = 10
+const duplicateRadius = 250
+
 func main() {
 	// Environment variables
 
@@ -28,18 +41,31 @@ func main() {
 		log.Fatal("DATABASE_URL not set")
 	}
 
+	allowedLicenses, err = flickr.AllowedLicensesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	db, err = pgx.Connect(context.Background(), databaseURL)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	listener, err := notify.Listen(context.Background(), databaseURL, notify.PhotosReady)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close(context.Background())
+
 	// End setup
 	for {
 		startTime := time.Now()
 		batch := loadBatch()
 
 		if len(batch) == 0 {
-			time.Sleep(5 * time.Second)
+			if channel := listener.Wait(context.Background(), pollInterval); channel != "" {
+				log.Printf("Woken by %s", channel)
+			}
 			continue
 		}
 
@@ -58,51 +84,55 @@ type batchEntry struct {
 	RegionID int
 	Lng      float64
 	Lat      float64
-	Sizes    struct {
-		Size []json.RawMessage
-	}
-	Info infoData
-}
-
-type sizeData struct {
-	Label  string
-	Width  int
-	Height int
-	Source string
-}
-
-type infoData struct {
-	Owner struct {
-		Iconfarm   int
-		Iconserver string
-		NSID       string
-		Username   string
-		PathAlias  string `json:"path_alias"`
-	}
-	Title       stringContent
-	Description stringContent
-	Dates       struct {
-		Taken string
-	}
-}
-
-type stringContent struct {
-	Content string `json:"_content"`
+	Sizes    flickr.Sizes
+	Info     flickr.PhotoInfo
+	// PreviewDHash is nil for photos scored before we hashed previews
+	PreviewDHash *int64
 }
 
+// loadBatch picks photos for the emptiest geohash cells first, interleaving
+// cells so that one batch doesn't fill a popular viewpoint, and leaves out
+// photos in cells that have reached the region's max_challenges_per_cell.
 func loadBatch() []batchEntry {
 	rows, err := db.Query(context.Background(), `
-		SELECT p.flickr_id, p.region_id, ST_X(p.geo::geometry), ST_Y(p.geo::geometry), p.sizes, p.info
-		FROM flickr_photos as p
-		JOIN photo_scores as s ON p.flickr_id = s.flickr_photo_id
-		LEFT JOIN flickr_challenge_sources as src ON p.flickr_id = src.flickr_id
-		WHERE
-		    s.is_accepted AND
-	  		src.flickr_id IS NULL -- no existing challenge based on
-			AND p.sizes IS NOT NULL AND p.info IS NOT NULL -- fully indexed
-		ORDER BY random()
+		WITH candidates AS (SELECT p.flickr_id, p.region_id, p.geo, p.sizes, p.info, s.preview_dhash,
+								   ST_GeoHash(p.geo::geometry, r.challenge_cell_precision) as cell,
+								   r.max_challenges_per_cell
+							FROM flickr_photos as p
+							JOIN regions as r ON r.id = p.region_id
+							JOIN current_photo_scores as s ON p.flickr_id = s.flickr_photo_id
+							LEFT JOIN flickr_challenge_sources as src ON p.flickr_id = src.flickr_id
+							LEFT JOIN flickr_challenge_skips as skip ON p.flickr_id = skip.flickr_id
+							WHERE
+								s.is_accepted AND
+								src.flickr_id IS NULL -- no existing challenge based on
+								AND skip.flickr_id IS NULL
+								AND p.sizes IS NOT NULL AND p.info IS NOT NULL -- fully indexed
+								AND p.gone_at IS NULL
+								AND ($1::int[] IS NULL OR p.license = ANY ($1))),
+			 cell_counts AS (SELECT c.region_id,
+									ST_GeoHash(c.geo::geometry, r.challenge_cell_precision) as cell,
+									count(*)                                                as challenges
+							 FROM challenges as c
+							 JOIN regions as r ON r.id = c.region_id
+							 WHERE c.retired_at IS NULL
+							 GROUP BY 1, 2),
+			 ranked AS (SELECT candidates.*,
+							   coalesce(cc.challenges, 0) as challenges,
+							   row_number() over (
+								   PARTITION BY candidates.region_id, candidates.cell ORDER BY random()
+								   )                       as cell_rank
+						FROM candidates
+						LEFT JOIN cell_counts as cc
+								  ON cc.region_id = candidates.region_id AND cc.cell = candidates.cell)
+		SELECT flickr_id, region_id, ST_X(geo::geometry), ST_Y(geo::geometry), sizes, info, preview_dhash
+		FROM ranked
+		-- How many challenges the cell would have if we used this photo and
+		-- every photo ahead of it
+		WHERE max_challenges_per_cell IS NULL OR challenges + cell_rank <= max_challenges_per_cell
+		ORDER BY challenges + cell_rank, random()
 		LIMIT 1000
-	`)
+	`, allowedLicenses.IDs())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -111,7 +141,8 @@ func loadBatch() []batchEntry {
 	var entries []batchEntry
 	for rows.Next() {
 		var entry batchEntry
-		err := rows.Scan(&entry.FlickrId, &entry.RegionID, &entry.Lng, &entry.Lat, &entry.Sizes, &entry.Info)
+		err := rows.Scan(&entry.FlickrId, &entry.RegionID, &entry.Lng, &entry.Lat, &entry.Sizes, &entry.Info,
+			&entry.PreviewDHash)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -124,33 +155,17 @@ func processEntry(entry batchEntry) error {
 	var previewSrc, regularSrc, largeSrc string
 	var previewWidth, regularWidth, largeWidth int
 	var previewHeight, regularHeight, largeHeight int
-	for _, sizeJSON := range entry.Sizes.Size {
-		// Certain images have obsolete video media entries with a different schema
-		var mediaData struct {
-			Media string
-		}
-		if err := json.Unmarshal(sizeJSON, &mediaData); err == nil {
-			if mediaData.Media == "video" {
-				continue
-			}
-		}
-
-		var size sizeData
-		if err := json.Unmarshal(sizeJSON, &size); err != nil {
-			log.Printf("Failed to unmarshal size: %v: got %s", err, sizeJSON)
-			continue
-		}
-
+	for _, size := range entry.Sizes.Photos() {
 		switch size.Label {
 		case "Thumbnail":
 			previewSrc = size.Source
-			previewWidth = size.Width
-			previewHeight = size.Height
+			previewWidth = int(size.Width)
+			previewHeight = int(size.Height)
 			continue
 		case "Medium":
 			regularSrc = size.Source
-			regularWidth = size.Width
-			regularHeight = size.Height
+			regularWidth = int(size.Width)
+			regularHeight = int(size.Height)
 			continue
 		case "Original":
 			// The original images has nuances like exif rotation that we don't want
@@ -158,10 +173,10 @@ func processEntry(entry batchEntry) error {
 			continue
 		}
 
-		if size.Width > largeWidth || size.Height > largeHeight {
+		if int(size.Width) > largeWidth || int(size.Height) > largeHeight {
 			largeSrc = size.Source
-			largeWidth = size.Width
-			largeHeight = size.Height
+			largeWidth = int(size.Width)
+			largeHeight = int(size.Height)
 		}
 	}
 
@@ -169,7 +184,7 @@ func processEntry(entry batchEntry) error {
 
 	var photographerIcon string
 	if owner.Iconfarm > 0 {
-		photographerIcon = "https://farm" + strconv.Itoa(owner.Iconfarm) + ".staticflickr.com/" + owner.Iconserver + "/buddyicons/" + owner.NSID + ".jpg"
+		photographerIcon = "https://farm" + strconv.Itoa(int(owner.Iconfarm)) + ".staticflickr.com/" + owner.Iconserver + "/buddyicons/" + owner.NSID + ".jpg"
 	} else {
 		photographerIcon = "https://combo.staticflickr.com/pw/images/buddyicon03.png"
 	}
@@ -185,15 +200,24 @@ func processEntry(entry batchEntry) error {
 		link = "https://www.flickr.com/photos/" + owner.NSID + "/" + entry.FlickrId
 	}
 
+	licenseID, ok := flickr.ParseLicenseID(string(entry.Info.License))
+	if !ok {
+		return fmt.Errorf("invalid license: %q", entry.Info.License)
+	}
+	if !allowedLicenses.Allows(licenseID) {
+		// The license changed since the photo was indexed
+		return fmt.Errorf("license %d not allowed", licenseID)
+	}
+	license, ok := flickr.LicenseByID(licenseID)
+	if !ok {
+		return fmt.Errorf("unknown license: %d", licenseID)
+	}
+
 	title := entry.Info.Title.Content
 	descriptionHtml := entry.Info.Description.Content
 
-	var dateTaken *time.Time
-	if entry.Info.Dates.Taken == "" {
-		dateTaken = nil
-	} else if value, err := time.Parse("2006-01-02 15:04:05", entry.Info.Dates.Taken); err == nil {
-		dateTaken = &value
-	} else {
+	dateTaken, err := entry.Info.DateTaken()
+	if err != nil {
 		return fmt.Errorf("failed to parse date: %v", err)
 	}
 
@@ -206,6 +230,22 @@ func processEntry(entry batchEntry) error {
 	}
 	defer tx.Rollback(context.Background())
 
+	duplicateOf, err := findDuplicate(tx, entry)
+	if err != nil {
+		return err
+	}
+	if duplicateOf != "" {
+		log.Printf("Skipping %s, a near duplicate of %s", entry.FlickrId, duplicateOf)
+		_, err = tx.Exec(context.Background(), `
+			INSERT INTO flickr_challenge_skips (flickr_id, reason, duplicate_of)
+			VALUES ($1, 'duplicate', $2)
+		`, entry.FlickrId, duplicateOf)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(context.Background())
+	}
+
 	var challengeID int64
 	err = tx.QueryRow(context.Background(), `
 		INSERT INTO challenges
@@ -216,6 +256,7 @@ func processEntry(entry batchEntry) error {
 			 large_src, large_width, large_height,
 			 photographer_icon, photographer_text, photographer_link,
 			 title, description_html, date_taken, link,
+			 license_id, license_name, license_url,
 			 rx, ry)
 		VALUES
 			(
@@ -226,7 +267,8 @@ func processEntry(entry batchEntry) error {
 			 $10, $11, $12,
 			 $13, $14, $15,
 			 $16, $17, $18, $19,
-			 $20, $21
+			 $20, $21, $22,
+			 $23, $24
 			 )
 		RETURNING id
 	`,
@@ -237,6 +279,7 @@ func processEntry(entry batchEntry) error {
 		largeSrc, largeWidth, largeHeight,
 		photographerIcon, photographerText, photographerLink,
 		title, descriptionHtml, dateTaken, link,
+		license.ID, license.Name, license.URL,
 		rx, ry,
 	).Scan(&challengeID)
 	if err != nil {
@@ -253,3 +296,32 @@ func processEntry(entry batchEntry) error {
 
 	return tx.Commit(context.Background())
 }
+
+// findDuplicate returns the source photo of a live challenge that entry is a
+// near duplicate of, or "" if there is none.
+func findDuplicate(tx pgx.Tx, entry batchEntry) (string, error) {
+	if entry.PreviewDHash == nil {
+		return "", nil
+	}
+	var flickrID string
+	err := tx.QueryRow(context.Background(), `
+		SELECT src.flickr_id
+		FROM flickr_challenge_sources as src
+		JOIN challenges as c ON c.id = src.challenge_id
+		JOIN flickr_photos as p ON p.flickr_id = src.flickr_id
+		JOIN current_photo_scores as s ON s.flickr_photo_id = src.flickr_id
+		WHERE c.retired_at IS NULL
+			AND hamming_distance(s.preview_dhash, $1) <= $2
+			AND (p.info -> 'owner' ->> 'nsid' = $3
+				OR ST_DWithin(c.geo, ST_SetSRID(ST_MakePoint($4, $5), 4326)::geography, $6))
+		ORDER BY hamming_distance(s.preview_dhash, $1)
+		LIMIT 1
+	`, *entry.PreviewDHash, duplicateMaxHashDistance, entry.Info.Owner.NSID,
+		entry.Lng, entry.Lat, duplicateRadius).Scan(&flickrID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return flickrID, nil
+}
@@ -0,0 +1,115 @@
+package classifier
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SendFunc classifies a batch of images, returning a result per image
+type SendFunc func(ctx context.Context, images [][]byte) ([]Result, error)
+
+// SendOneFunc classifies a single image
+type SendOneFunc func(ctx context.Context, image []byte) (*Result, error)
+
+// Batcher coalesces concurrent Classify calls into batches. A batch is sent
+// once it has maxBatch images or maxWait after its first image, whichever is
+// sooner. If a batch is rejected its images are retried one at a time, so a
+// bad image only fails its own call.
+type Batcher struct {
+	send     SendFunc
+	sendOne  SendOneFunc
+	maxBatch int
+	maxWait  time.Duration
+
+	mu      sync.Mutex
+	pending *batch
+}
+
+type batch struct {
+	images  [][]byte
+	waiters []chan batchResult
+	timer   *time.Timer
+}
+
+type batchResult struct {
+	result *Result
+	err    error
+}
+
+// NewBatcher wraps send and sendOne, which are typically
+// Client.ClassifyBatch and Client.Classify with retries. sendOne is used to
+// retry the images of a rejected batch. Both are called with a context that
+// is never cancelled, so they should bound themselves.
+func NewBatcher(send SendFunc, sendOne SendOneFunc, maxBatch int, maxWait time.Duration) *Batcher {
+	return &Batcher{send: send, sendOne: sendOne, maxBatch: maxBatch, maxWait: maxWait}
+}
+
+// Classify adds image to the next batch and waits for its result. If ctx is
+// done first the image is still classified, but the result is discarded.
+func (b *Batcher) Classify(ctx context.Context, image []byte) (*Result, error) {
+	done := make(chan batchResult, 1)
+
+	b.mu.Lock()
+	if b.pending == nil {
+		pending := &batch{}
+		pending.timer = time.AfterFunc(b.maxWait, func() { b.flush(pending) })
+		b.pending = pending
+	}
+	pending := b.pending
+	pending.images = append(pending.images, image)
+	pending.waiters = append(pending.waiters, done)
+	full := len(pending.images) >= b.maxBatch
+	b.mu.Unlock()
+
+	if full {
+		pending.timer.Stop()
+		b.flush(pending)
+	}
+
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush sends a batch if it is still pending
+func (b *Batcher) flush(pending *batch) {
+	b.mu.Lock()
+	if b.pending != pending {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+
+	go func() {
+		results, err := b.sendChecked(pending.images)
+		if IsRejected(err) && len(pending.images) > 1 {
+			// One bad image fails the whole request, so find out which
+			for i, done := range pending.waiters {
+				result, err := b.sendOne(context.Background(), pending.images[i])
+				done <- batchResult{result: result, err: err}
+			}
+			return
+		}
+		for i, done := range pending.waiters {
+			if err != nil {
+				done <- batchResult{err: err}
+			} else {
+				done <- batchResult{result: &results[i]}
+			}
+		}
+	}()
+}
+
+func (b *Batcher) sendChecked(images [][]byte) ([]Result, error) {
+	results, err := b.send(context.Background(), images)
+	if err == nil && len(results) != len(images) {
+		err = fmt.Errorf("classifier: sent %d images, got %d results", len(images), len(results))
+	}
+	return results, err
+}
@@ -0,0 +1,199 @@
+// Package classifier calls the model that scores whether a photo looks like
+// a landscape we can use as a challenge.
+package classifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Client calls the classifier's HTTP API. Each method makes a single
+// attempt, use IsTransient to decide whether to retry.
+type Client struct {
+	Endpoint *url.URL
+	HTTP     *http.Client
+}
+
+func NewClient(endpoint string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("classifier: parse endpoint: %w", err)
+	}
+	return &Client{
+		Endpoint: u,
+		HTTP:     &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+type Result struct {
+	Score float64 `json:"validity_score"`
+	Model string  `json:"model"`
+}
+
+// Model describes a model the classifier can serve
+type Model struct {
+	Name string
+	// Metadata is everything the classifier told us about the model,
+	// including the name
+	Metadata json.RawMessage
+}
+
+// StatusError is returned when the classifier responds with a status other
+// than 200.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("classifier: HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+// IsTransient reports whether a request that failed with err might succeed if
+// retried. Rejections of the request itself (4xx other than 429) are not.
+func IsTransient(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The caller gave up, don't retry
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// IsRejected reports whether the classifier refused the request itself, for
+// example because an image couldn't be decoded or a batch was too large.
+// Other client errors, such as a 404 from a server without the endpoint,
+// point at our configuration rather than the images.
+func IsRejected(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// Classify scores a single JPEG or PNG image.
+func (c *Client) Classify(ctx context.Context, image []byte) (*Result, error) {
+	var result Result
+	err := c.do(ctx, http.MethodPost, "/api/v0/classify", struct {
+		ImageBase64 string `json:"image_base64"`
+	}{base64.StdEncoding.EncodeToString(image)}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ClassifyBatch scores several images in one request. Results are in the
+// same order as images.
+func (c *Client) ClassifyBatch(ctx context.Context, images [][]byte) ([]Result, error) {
+	reqData := struct {
+		ImagesBase64 []string `json:"images_base64"`
+	}{make([]string, len(images))}
+	for i, image := range images {
+		reqData.ImagesBase64[i] = base64.StdEncoding.EncodeToString(image)
+	}
+
+	var resp struct {
+		Results []Result `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v0/classify_batch", reqData, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Results) != len(images) {
+		return nil, fmt.Errorf("classifier: sent %d images, got %d results", len(images), len(resp.Results))
+	}
+	return resp.Results, nil
+}
+
+// Models lists the models the classifier can serve.
+func (c *Client) Models(ctx context.Context) ([]Model, error) {
+	var resp struct {
+		Models []json.RawMessage `json:"models"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v0/models", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	out := make([]Model, 0, len(resp.Models))
+	for _, raw := range resp.Models {
+		var fields struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, fmt.Errorf("classifier: decode model: %w", err)
+		}
+		if fields.Name == "" {
+			return nil, fmt.Errorf("classifier: model without a name: %s", raw)
+		}
+		out = append(out, Model{Name: fields.Name, Metadata: raw})
+	}
+	return out, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, reqData any, resp any) error {
+	var body io.Reader
+	if reqData != nil {
+		reqBody, err := json.Marshal(reqData)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(reqBody)
+	}
+
+	u := *c.Endpoint
+	u.Path = path
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if reqData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: httpResp.StatusCode, Body: truncate(string(respBody), 200)}
+	}
+	if err := json.Unmarshal(respBody, resp); err != nil {
+		return fmt.Errorf("classifier: decode response: %w (got %s)", err, truncate(string(respBody), 200))
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,228 @@
+package classifier_test
+
+import (
+	"bytes"
+	"context"
+	"contourguessr-ingest/classifier"
+	"contourguessr-ingest/classifier/classifierfake"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testImage(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	img.Set(0, 0, color.Gray{Y: 255 - shade})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *classifier.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := classifier.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestClassifyBatchMatchesClassify(t *testing.T) {
+	client := newTestClient(t, &classifierfake.Server{})
+	ctx := context.Background()
+	images := [][]byte{testImage(t, 10), testImage(t, 20), testImage(t, 30)}
+
+	batch, err := client.ClassifyBatch(ctx, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, image := range images {
+		single, err := client.Classify(ctx, image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch[i] != *single {
+			t.Errorf("image %d: batch got %+v, single got %+v", i, batch[i], *single)
+		}
+		if single.Model != classifierfake.DefaultModel {
+			t.Errorf("image %d: got model %q", i, single.Model)
+		}
+	}
+}
+
+func TestRejectedImage(t *testing.T) {
+	client := newTestClient(t, &classifierfake.Server{})
+
+	_, err := client.Classify(context.Background(), []byte("not an image"))
+	if !classifier.IsRejected(err) || classifier.IsTransient(err) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+}
+
+func TestModels(t *testing.T) {
+	client := newTestClient(t, &classifierfake.Server{Model: "test-model"})
+
+	models, err := client.Models(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 1 || models[0].Name != "test-model" || len(models[0].Metadata) == 0 {
+		t.Fatalf("got %+v", models)
+	}
+}
+
+// countRequests counts the requests to each path before passing them on
+func countRequests(handler http.Handler) (http.Handler, func(path string) int) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	})
+	return counted, func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return counts[path]
+	}
+}
+
+func classifyConcurrently(batcher *classifier.Batcher, images [][]byte) ([]*classifier.Result, []error) {
+	results := make([]*classifier.Result, len(images))
+	errs := make([]error, len(images))
+	var wg sync.WaitGroup
+	for i := range images {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = batcher.Classify(context.Background(), images[i])
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+func TestBatcher(t *testing.T) {
+	handler, requests := countRequests(&classifierfake.Server{})
+	client := newTestClient(t, handler)
+	batcher := classifier.NewBatcher(client.ClassifyBatch, client.Classify, 4, time.Minute)
+
+	images := [][]byte{testImage(t, 10), testImage(t, 20), []byte("not an image"), testImage(t, 30)}
+	results, errs := classifyConcurrently(batcher, images)
+
+	// The full batch is sent without waiting, rejected, then retried one
+	// image at a time
+	if got := requests("/api/v0/classify_batch"); got != 1 {
+		t.Errorf("expected 1 batch request, got %d", got)
+	}
+	if got := requests("/api/v0/classify"); got != 4 {
+		t.Errorf("expected 4 single image requests, got %d", got)
+	}
+	for i := range images {
+		if i == 2 {
+			if !classifier.IsRejected(errs[i]) {
+				t.Errorf("image %d: expected a rejection, got %v", i, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("image %d: %v", i, errs[i])
+			continue
+		}
+		want, err := client.Classify(context.Background(), images[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *results[i] != *want {
+			t.Errorf("image %d: got %+v, want %+v", i, *results[i], *want)
+		}
+	}
+}
+
+func TestBatcherOversizedBatch(t *testing.T) {
+	handler, requests := countRequests(&classifierfake.Server{MaxBatch: 2})
+	client := newTestClient(t, handler)
+	batcher := classifier.NewBatcher(client.ClassifyBatch, client.Classify, 3, time.Minute)
+
+	images := [][]byte{testImage(t, 10), testImage(t, 20), testImage(t, 30)}
+	_, errs := classifyConcurrently(batcher, images)
+
+	// A 413 is a rejection of the batch, so each image is retried alone
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("image %d: %v", i, err)
+		}
+	}
+	if got := requests("/api/v0/classify"); got != 3 {
+		t.Errorf("expected 3 single image requests, got %d", got)
+	}
+}
+
+func TestBatcherWithoutBatchRoute(t *testing.T) {
+	fake := &classifierfake.Server{}
+	handler, requests := countRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v0/classify_batch" {
+			http.NotFound(w, r)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	client := newTestClient(t, handler)
+	batcher := classifier.NewBatcher(client.ClassifyBatch, client.Classify, 2, time.Minute)
+
+	_, errs := classifyConcurrently(batcher, [][]byte{testImage(t, 10), testImage(t, 20)})
+
+	// A missing endpoint is a configuration problem, not a bad image, so
+	// it fails every caller without blaming the images
+	for i, err := range errs {
+		var statusErr *classifier.StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			t.Errorf("image %d: expected a 404, got %v", i, err)
+		}
+		if classifier.IsRejected(err) {
+			t.Errorf("image %d: a 404 should not be a rejection", i)
+		}
+	}
+	if got := requests("/api/v0/classify"); got != 0 {
+		t.Errorf("expected no single image requests, got %d", got)
+	}
+}
+
+func TestIsRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&classifier.StatusError{StatusCode: http.StatusBadRequest}, true},
+		{&classifier.StatusError{StatusCode: http.StatusRequestEntityTooLarge}, true},
+		{&classifier.StatusError{StatusCode: http.StatusUnprocessableEntity}, true},
+		{fmt.Errorf("classify: %w", &classifier.StatusError{StatusCode: http.StatusBadRequest}), true},
+		{&classifier.StatusError{StatusCode: http.StatusNotFound}, false},
+		{&classifier.StatusError{StatusCode: http.StatusMethodNotAllowed}, false},
+		{&classifier.StatusError{StatusCode: http.StatusTooManyRequests}, false},
+		{&classifier.StatusError{StatusCode: http.StatusInternalServerError}, false},
+		{context.DeadlineExceeded, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := classifier.IsRejected(tt.err); got != tt.want {
+			t.Errorf("IsRejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package classifierfake serves a stand-in for the classifier API. Scores are
+// derived from a hash of the image, so the same image always gets the same
+// score without running a model.
+//
+// Point CLASSIFIER_ENDPOINT at the server.
+package classifierfake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+)
+
+// DefaultModel is the model name reported unless Server.Model is set
+const DefaultModel = "fake-v1"
+
+type Server struct {
+	// Model is reported in results and by the models endpoint
+	Model string
+	// MaxBatch, if positive, rejects larger batches like the real server
+	MaxBatch int
+}
+
+type result struct {
+	Score float64 `json:"validity_score"`
+	Model string  `json:"model"`
+}
+
+func (s *Server) model() string {
+	if s.Model == "" {
+		return DefaultModel
+	}
+	return s.Model
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v0/classify":
+		s.classify(w, r)
+	case "/api/v0/classify_batch":
+		s.classifyBatch(w, r)
+	case "/api/v0/models":
+		writeJSON(w, map[string]any{
+			"models": []map[string]any{{
+				"name":        s.model(),
+				"description": "Deterministic stand-in, scores are a hash of the image",
+			}},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) classify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ImageBase64 string `json:"image_base64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.score(req.ImageBase64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) classifyBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ImagesBase64 []string `json:"images_base64"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.MaxBatch > 0 && len(req.ImagesBase64) > s.MaxBatch {
+		http.Error(w, fmt.Sprintf("at most %d images per batch", s.MaxBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]result, len(req.ImagesBase64))
+	for i, encoded := range req.ImagesBase64 {
+		res, err := s.score(encoded)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("image %d: %s", i, err), http.StatusBadRequest)
+			return
+		}
+		results[i] = res
+	}
+	writeJSON(w, map[string]any{"results": results})
+}
+
+// score rejects anything that isn't a JPEG or PNG, as the real model would
+// fail to decode it
+func (s *Server) score(encoded string) (result, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return result{}, fmt.Errorf("invalid base64: %w", err)
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return result{}, fmt.Errorf("invalid image: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	score := float64(binary.BigEndian.Uint64(sum[:])>>11) / (1 << 53)
+	return result{Score: score, Model: s.model()}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("classifierfake: write response:", err)
+	}
+}
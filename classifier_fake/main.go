@@ -0,0 +1,24 @@
+package main
+
+import (
+	"contourguessr-ingest/classifier/classifierfake"
+	flag "github.com/spf13/pflag"
+	"log"
+	"net/http"
+)
+
+var addr = flag.String("addr", "localhost:5061", "Address to listen on")
+var model = flag.String("model", classifierfake.DefaultModel, "Model name to report")
+var maxBatch = flag.Int("max-batch", 32, "Reject batches with more images than this (0 to disable)")
+
+func main() {
+	flag.Parse()
+
+	server := &classifierfake.Server{
+		Model:    *model,
+		MaxBatch: *maxBatch,
+	}
+
+	log.Println("Listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
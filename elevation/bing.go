@@ -0,0 +1,119 @@
+package elevation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cenkalti/backoff/v4"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Bing looks up heights with the Bing Maps elevation API. Each lookup is a
+// request, so prefer DEM where we have tiles. Its sea level heights are
+// relative to EGM2008, and its ellipsoid heights are converted by Bing, so it
+// needs no geoid grid.
+type Bing struct {
+	Key  string
+	HTTP *http.Client
+	// URL is the elevation list endpoint
+	URL string
+
+	// MaxElapsedTime bounds how long a single lookup will be retried for
+	MaxElapsedTime time.Duration
+}
+
+func NewBing(key string) *Bing {
+	return &Bing{
+		Key:            key,
+		HTTP:           &http.Client{Timeout: 30 * time.Second},
+		URL:            "http://dev.virtualearth.net/REST/v1/Elevation/List",
+		MaxElapsedTime: 2 * time.Minute,
+	}
+}
+
+type bingStatusError struct {
+	statusCode int
+}
+
+func (e *bingStatusError) Error() string {
+	return fmt.Sprintf("elevation: bing: unexpected http status %d", e.statusCode)
+}
+
+func (b *Bing) Elevation(ctx context.Context, lng, lat float64, datum Datum) (float64, error) {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return 0, err
+	}
+
+	q := u.Query()
+	switch datum {
+	case MeanSeaLevel:
+		q.Add("heights", "sealevel")
+	case Ellipsoid:
+		q.Add("heights", "ellipsoid")
+	default:
+		return 0, fmt.Errorf("elevation: bing: unsupported datum %s", datum)
+	}
+	q.Add("points", fmt.Sprintf("%f,%f", lat, lng))
+	q.Add("key", b.Key)
+	u.RawQuery = q.Encode()
+
+	policy := backoff.NewExponentialBackOff()
+	policy.MaxElapsedTime = b.MaxElapsedTime
+
+	var value float64
+	err = backoff.RetryNotify(func() error {
+		var err error
+		value, err = b.elevationOnce(ctx, u.String())
+		var statusErr *bingStatusError
+		if errors.As(err, &statusErr) && statusErr.statusCode < 500 && statusErr.statusCode != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(policy, ctx), func(err error, wait time.Duration) {
+		log.Printf("elevation: bing failed, retrying in %s: %s", wait, err)
+	})
+	return value, err
+}
+
+func (b *Bing) elevationOnce(ctx context.Context, reqURL string) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return 0, backoff.Permanent(err)
+	}
+
+	resp, err := b.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &bingStatusError{statusCode: resp.StatusCode}
+	}
+
+	var respData struct {
+		ResourceSets []struct {
+			Resources []struct {
+				Elevations []float64
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
+		return 0, err
+	}
+
+	if len(respData.ResourceSets) != 1 {
+		return 0, backoff.Permanent(fmt.Errorf("unexpected number of ResourceSets: %d", len(respData.ResourceSets)))
+	}
+	if len(respData.ResourceSets[0].Resources) != 1 {
+		return 0, backoff.Permanent(fmt.Errorf("unexpected number of Resources: %d", len(respData.ResourceSets[0].Resources)))
+	}
+	if len(respData.ResourceSets[0].Resources[0].Elevations) != 1 {
+		return 0, backoff.Permanent(fmt.Errorf("unexpected number of Elevations: %d", len(respData.ResourceSets[0].Resources[0].Elevations)))
+	}
+	return respData.ResourceSets[0].Resources[0].Elevations[0], nil
+}
@@ -0,0 +1,87 @@
+package elevation
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const bingResponse = `{"resourceSets":[{"resources":[{"elevations":[1234.5]}]}]}`
+
+func testBing(t *testing.T, handler http.HandlerFunc) *Bing {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	b := NewBing("key")
+	b.URL = srv.URL
+	b.MaxElapsedTime = 5 * time.Second
+	return b
+}
+
+func TestBingRequest(t *testing.T) {
+	for _, tc := range []struct {
+		datum   Datum
+		heights string
+	}{
+		{MeanSeaLevel, "sealevel"},
+		{Ellipsoid, "ellipsoid"},
+	} {
+		b := testBing(t, func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if q.Get("heights") != tc.heights || q.Get("points") != "57.069421,-3.123456" || q.Get("key") != "key" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			_, _ = io.WriteString(w, bingResponse)
+		})
+		v, err := b.Elevation(context.Background(), -3.123456, 57.069421, tc.datum)
+		if err != nil || v != 1234.5 {
+			t.Errorf("%s: Elevation = %g, %v, want 1234.5", tc.datum, v, err)
+		}
+	}
+}
+
+func TestBingRetries(t *testing.T) {
+	var requests atomic.Int32
+	b := testBing(t, func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, bingResponse)
+	})
+	if v, err := b.Elevation(context.Background(), 0, 0, MeanSeaLevel); err != nil || v != 1234.5 {
+		t.Errorf("Elevation = %g, %v, want 1234.5 after retrying", v, err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("made %d requests, want 2", requests.Load())
+	}
+}
+
+func TestBingPermanentErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"bad key", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}},
+		{"no elevations", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, `{"resourceSets":[{"resources":[{"elevations":[]}]}]}`)
+		}},
+	} {
+		var requests atomic.Int32
+		b := testBing(t, func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			tc.handler(w, r)
+		})
+		if _, err := b.Elevation(context.Background(), 0, 0, MeanSeaLevel); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("%s: made %d requests, want 1", tc.name, requests.Load())
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package elevation
+
+import (
+	"container/list"
+	"sync"
+)
+
+// tileCache keeps recently used tiles in memory, evicting the least recently
+// used once they total more than maxBytes. Concurrent requests for the same
+// tile share one load.
+type tileCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	key   string
+	ready chan struct{}
+	grid  *grid
+	err   error
+	elem  *list.Element
+}
+
+func newTileCache(maxBytes int64) *tileCache {
+	return &tileCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*cacheEntry),
+	}
+}
+
+func (c *tileCache) get(key string, load func() (*grid, error)) (*grid, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if e.elem != nil {
+			c.lru.MoveToFront(e.elem)
+		}
+		c.mu.Unlock()
+		<-e.ready
+		return e.grid, e.err
+	}
+	e := &cacheEntry{key: key, ready: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.grid, e.err = load()
+	close(e.ready)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.err != nil {
+		// Don't cache failures, the next request will try again
+		delete(c.entries, key)
+		return nil, e.err
+	}
+	e.elem = c.lru.PushFront(e)
+	c.bytes += e.grid.sizeBytes()
+	// Always keep the tile we just loaded, even if it alone is over the limit
+	for c.bytes > c.maxBytes && c.lru.Len() > 1 {
+		oldest := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, oldest.key)
+		c.bytes -= oldest.grid.sizeBytes()
+	}
+	return e.grid, nil
+}
@@ -0,0 +1,122 @@
+package elevation
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingLoader loads four sample (16 byte) grids, counting loads per key
+type countingLoader struct {
+	mu    sync.Mutex
+	loads map[string]int
+}
+
+func (l *countingLoader) load(key string) func() (*grid, error) {
+	return func() (*grid, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.loads == nil {
+			l.loads = make(map[string]int)
+		}
+		l.loads[key]++
+		return &grid{width: 2, height: 2, data: make([]float32, 4)}, nil
+	}
+}
+
+func TestTileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for three tiles
+	c := newTileCache(48)
+	l := &countingLoader{}
+	get := func(key string) {
+		t.Helper()
+		if _, err := c.get(key, l.load(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("a")
+	get("b")
+	get("c")
+	// a is now the most recently used, so d evicts b
+	get("a")
+	get("d")
+	if c.bytes != 48 || c.lru.Len() != 3 {
+		t.Errorf("cache holds %d tiles in %d bytes, want 3 in 48", c.lru.Len(), c.bytes)
+	}
+	get("a")
+	get("c")
+	get("d")
+	get("b")
+
+	want := map[string]int{"a": 1, "b": 2, "c": 1, "d": 1}
+	if fmt.Sprint(l.loads) != fmt.Sprint(want) {
+		t.Errorf("loads %v, want %v", l.loads, want)
+	}
+}
+
+func TestTileCacheKeepsOversizedTile(t *testing.T) {
+	c := newTileCache(8)
+	l := &countingLoader{}
+	for _, key := range []string{"a", "a", "b", "b"} {
+		if _, err := c.get(key, l.load(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.loads["a"] != 1 || l.loads["b"] != 1 {
+		t.Errorf("loads %v, want the last tile kept even though it's over the limit", l.loads)
+	}
+	if _, ok := c.entries["a"]; ok {
+		t.Error("a should have been evicted")
+	}
+}
+
+func TestTileCacheDoesNotCacheFailures(t *testing.T) {
+	c := newTileCache(1 << 20)
+	failure := errors.New("read failed")
+	if _, err := c.get("a", func() (*grid, error) { return nil, failure }); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the load error", err)
+	}
+	l := &countingLoader{}
+	if _, err := c.get("a", l.load("a")); err != nil || l.loads["a"] != 1 {
+		t.Errorf("retry = %v with %d loads, want a fresh load", err, l.loads["a"])
+	}
+}
+
+func TestTileCacheSharesConcurrentLoads(t *testing.T) {
+	c := newTileCache(1 << 20)
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var loads atomic.Int32
+	load := func() (*grid, error) {
+		loads.Add(1)
+		started <- struct{}{}
+		<-release
+		return &grid{width: 1, height: 1, data: []float32{42}}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*grid, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.get("a", load)
+		}(i)
+	}
+	// Hold the first load until it has started
+	<-started
+	close(release)
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Errorf("loaded %d times, want once", loads.Load())
+	}
+	for i, g := range results {
+		if g == nil || g.data[0] != 42 {
+			t.Errorf("request %d got %v", i, g)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package elevation
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DEM looks up heights in a directory of SRTM HGT and GeoTIFF tiles. The
+// tiles are expected to be relative to mean sea level, as SRTM and Copernicus
+// DEMs are.
+type DEM struct {
+	// Geoid converts to ellipsoid heights. Without it only MeanSeaLevel heights
+	// are available.
+	Geoid *Geoid
+
+	// cells maps each one degree cell to the tiles overlapping it, finest
+	// first
+	cells map[[2]int][]*demTile
+	cache *tileCache
+}
+
+type demTile struct {
+	path   string
+	extent *grid // without data
+	load   func(path string) (*grid, error)
+}
+
+// OpenDEM indexes the tiles under dir. Tiles are loaded as they are needed
+// and kept in memory up to cacheBytes.
+func OpenDEM(dir string, cacheBytes int64) (*DEM, error) {
+	d := &DEM{
+		cells: make(map[[2]int][]*demTile),
+		cache: newTileCache(cacheBytes),
+	}
+
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		tile := &demTile{path: path}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".hgt":
+			tile.extent, err = openHGT(path)
+			tile.load = loadHGT
+		case ".tif", ".tiff":
+			tile.extent, _, err = openGeoTIFF(path)
+			tile.load = loadGeoTIFF
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		minLng, minLat, maxLng, maxLat := tile.extent.bounds()
+		for x := int(math.Floor(minLng)); float64(x) < maxLng; x++ {
+			for y := int(math.Floor(minLat)); float64(y) < maxLat; y++ {
+				d.cells[[2]int{x, y}] = append(d.cells[[2]int{x, y}], tile)
+			}
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("elevation: no .hgt or .tif tiles in %s", dir)
+	}
+
+	for _, tiles := range d.cells {
+		sort.SliceStable(tiles, func(i, j int) bool {
+			return tiles[i].extent.dx < tiles[j].extent.dx
+		})
+	}
+	log.Printf("elevation: indexed %d tiles in %s", count, dir)
+	return d, nil
+}
+
+func (d *DEM) Elevation(ctx context.Context, lng, lat float64, datum Datum) (float64, error) {
+	if datum == Ellipsoid && d.Geoid == nil {
+		return 0, fmt.Errorf("elevation: a geoid grid is needed for ellipsoid heights")
+	}
+
+	cell := [2]int{int(math.Floor(lng)), int(math.Floor(lat))}
+	for _, tile := range d.cells[cell] {
+		if !tile.extent.covers(lng, lat) {
+			continue
+		}
+		g, err := d.cache.get(tile.path, func() (*grid, error) {
+			return tile.load(tile.path)
+		})
+		if err != nil {
+			return 0, err
+		}
+		value, ok := g.at(lng, lat)
+		if !ok {
+			// A void, a coarser tile may have a value
+			continue
+		}
+		if datum == Ellipsoid {
+			return d.Geoid.Convert(lng, lat, value, MeanSeaLevel, Ellipsoid)
+		}
+		return value, nil
+	}
+	return 0, ErrNoData
+}
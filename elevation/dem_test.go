@@ -0,0 +1,173 @@
+package elevation
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHGTCorner(t *testing.T) {
+	cases := []struct {
+		path     string
+		lng, lat int
+		ok       bool
+	}{
+		{"N45E006.hgt", 6, 45, true},
+		{"tiles/S01W001.hgt", -1, -1, true},
+		{"s33e151.HGT", 151, -33, true},
+		{"N00W180.hgt", -180, 0, true},
+		{"N45E06.hgt", 0, 0, false},
+		{"X45E006.hgt", 0, 0, false},
+		{"N4xE006.hgt", 0, 0, false},
+	}
+	for _, tc := range cases {
+		lng, lat, err := hgtCorner(tc.path)
+		if (err == nil) != tc.ok || lng != tc.lng || lat != tc.lat {
+			t.Errorf("hgtCorner(%q) = %d, %d, %v, want %d, %d", tc.path, lng, lat, err, tc.lng, tc.lat)
+		}
+	}
+}
+
+// writeHGT writes a square tile of samples, north to south
+func writeHGT(t *testing.T, path string, samples []int16) {
+	t.Helper()
+	raw := make([]byte, len(samples)*2)
+	for i, v := range samples {
+		binary.BigEndian.PutUint16(raw[i*2:], uint16(v))
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadHGT(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "N45E006.hgt")
+	writeHGT(t, path, []int16{
+		100, 200, 300,
+		400, 500, 600,
+		700, 800, hgtVoid,
+	})
+
+	g, err := loadHGT(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.west != 6 || g.north != 46 || g.dx != 0.5 || g.width != 3 || g.height != 3 {
+		t.Errorf("grid at %g, %g step %g size %dx%d, want edge samples on the degree lines",
+			g.west, g.north, g.dx, g.width, g.height)
+	}
+	for _, p := range []struct {
+		lng, lat float64
+		want     float64
+	}{
+		{6, 46, 100},
+		{7, 46, 300},
+		{6, 45, 700},
+		{6.5, 45.5, 500},
+	} {
+		if v, ok := g.at(p.lng, p.lat); !ok || v != p.want {
+			t.Errorf("at(%g, %g) = %g, %v, want %g", p.lng, p.lat, v, ok, p.want)
+		}
+	}
+	if v, ok := g.at(7, 45); ok {
+		t.Errorf("at the void = %g, want no data", v)
+	}
+
+	notSquare := filepath.Join(t.TempDir(), "N45E006.hgt")
+	writeHGT(t, notSquare, make([]int16, 6))
+	if _, err := openHGT(notSquare); err == nil {
+		t.Error("expected error for a tile that isn't square")
+	}
+}
+
+// testDEM has an HGT tile at N45E006 with samples half a degree apart, a
+// finer GeoTIFF over its north west quarter, and another HGT tile at
+// S01W001.
+func testDEM(t *testing.T) *DEM {
+	dir := t.TempDir()
+	writeHGT(t, filepath.Join(dir, "N45E006.hgt"), []int16{
+		100, 200, 300,
+		400, 500, 600,
+		700, 800, hgtVoid,
+	})
+	writeHGT(t, filepath.Join(dir, "S01W001.hgt"), []int16{7, 7, 7, 7, 7, 7, 7, 7, 7})
+
+	if err := os.Mkdir(filepath.Join(dir, "fine"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fine := &grid{
+		west: 6.125, north: 45.875, dx: 0.25, dy: 0.25, width: 2, height: 2,
+		data: []float32{1000, 1001, 1002, -9999},
+	}
+	writeGeoTIFF(t, filepath.Join(dir, "fine", "fine.tif"), fine, tiffOptions{float: true, noData: "-9999"})
+	// Ignored
+	if err := os.WriteFile(filepath.Join(dir, "README.txt"), []byte("tiles"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dem, err := OpenDEM(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dem
+}
+
+func TestDEMElevation(t *testing.T) {
+	dem := testDEM(t)
+	cases := []struct {
+		name     string
+		lng, lat float64
+		want     float64
+		err      error
+	}{
+		{"fine sample", 6.125, 45.875, 1000, nil},
+		{"fine next to its void", 6.25, 45.75, 1001, nil},
+		{"fine void falls back to coarse", 6.375, 45.625, 400, nil},
+		{"coarse only", 6.75, 45.25, (500 + 600 + 800) / 3.0, nil},
+		{"coarse void", 7, 45, 0, ErrNoData},
+		{"half a sample over the degree line", 6.2, 46.1, 140, nil},
+		{"southern western hemisphere", -0.5, -0.5, 7, nil},
+		{"no tile", 10, 10, 0, ErrNoData},
+	}
+	for _, tc := range cases {
+		got, err := dem.Elevation(context.Background(), tc.lng, tc.lat, MeanSeaLevel)
+		if !errors.Is(err, tc.err) || (err == nil && !near(got, tc.want)) {
+			t.Errorf("%s: Elevation(%g, %g) = %g, %v, want %g, %v", tc.name, tc.lng, tc.lat, got, err, tc.want, tc.err)
+		}
+	}
+
+	if _, err := dem.Elevation(context.Background(), 6.5, 45.5, Ellipsoid); err == nil || errors.Is(err, ErrNoData) {
+		t.Errorf("ellipsoid height without a geoid = %v, want an error", err)
+	}
+}
+
+type constSource float64
+
+func (s constSource) Elevation(ctx context.Context, lng, lat float64, datum Datum) (float64, error) {
+	return float64(s), nil
+}
+
+func TestWithFallback(t *testing.T) {
+	source := WithFallback(testDEM(t), constSource(42))
+	if v, err := source.Elevation(context.Background(), 6.5, 45.5, MeanSeaLevel); err != nil || v != 500 {
+		t.Errorf("covered point = %g, %v, want 500 from the DEM", v, err)
+	}
+	if v, err := source.Elevation(context.Background(), 10, 10, MeanSeaLevel); err != nil || v != 42 {
+		t.Errorf("uncovered point = %g, %v, want 42 from the fallback", v, err)
+	}
+}
+
+func TestOpenDEMErrors(t *testing.T) {
+	if _, err := OpenDEM(t.TempDir(), 1<<20); err == nil {
+		t.Error("expected error for a directory without tiles")
+	}
+
+	dir := t.TempDir()
+	writeHGT(t, filepath.Join(dir, "tile.hgt"), make([]int16, 9))
+	if _, err := OpenDEM(dir, 1<<20); err == nil {
+		t.Error("expected error for a badly named HGT tile")
+	}
+}
@@ -0,0 +1,75 @@
+// Package elevation looks up terrain heights, either from DEM tiles on disk or
+// from the Bing Maps elevation API.
+package elevation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Datum is the surface a height is measured from
+type Datum int
+
+const (
+	// MeanSeaLevel heights are relative to the geoid, which is what DEMs and
+	// maps use. Sources differ in the geoid model: GPS receivers and SRTM use
+	// EGM96, Bing and Copernicus use EGM2008. The two mostly agree to within a
+	// metre, and by several meters at worst where EGM96 had sparse gravity
+	// data, so we treat them as the same datum.
+	MeanSeaLevel Datum = iota
+	// Ellipsoid heights are relative to the WGS84 ellipsoid, which is what
+	// GPS receivers compute internally
+	Ellipsoid
+)
+
+func (d Datum) String() string {
+	switch d {
+	case MeanSeaLevel:
+		return "msl"
+	case Ellipsoid:
+		return "ellipsoid"
+	default:
+		return fmt.Sprintf("Datum(%d)", int(d))
+	}
+}
+
+// ParseDatum parses the value of Datum.String
+func ParseDatum(s string) (Datum, error) {
+	switch s {
+	case "msl":
+		return MeanSeaLevel, nil
+	case "ellipsoid":
+		return Ellipsoid, nil
+	default:
+		return 0, fmt.Errorf("elevation: unknown datum %q", s)
+	}
+}
+
+// ErrNoData is returned for points a source has no height for, such as
+// outside the tiles we have or in a void in the data.
+var ErrNoData = errors.New("elevation: no data")
+
+// Source looks up the terrain height in meters at a point.
+type Source interface {
+	Elevation(ctx context.Context, lng, lat float64, datum Datum) (float64, error)
+}
+
+// WithFallback returns a source that asks primary, and asks fallback for
+// points primary returns ErrNoData for.
+func WithFallback(primary, fallback Source) Source {
+	return fallbackSource{primary: primary, fallback: fallback}
+}
+
+type fallbackSource struct {
+	primary  Source
+	fallback Source
+}
+
+func (s fallbackSource) Elevation(ctx context.Context, lng, lat float64, datum Datum) (float64, error) {
+	value, err := s.primary.Elevation(ctx, lng, lat, datum)
+	if errors.Is(err, ErrNoData) {
+		return s.fallback.Elevation(ctx, lng, lat, datum)
+	}
+	return value, err
+}
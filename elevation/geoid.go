@@ -0,0 +1,120 @@
+package elevation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Geoid converts between heights above the geoid and above the ellipsoid
+// using a grid of geoid undulations, such as EGM96 or EGM2008.
+type Geoid struct {
+	grid *grid
+}
+
+// LoadGeoid reads a geoid grid in GeoTIFF (as distributed by PROJ, for
+// example us_nga_egm96_15.tif) or GTX format.
+func LoadGeoid(path string) (*Geoid, error) {
+	var g *grid
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gtx":
+		g, err = loadGTX(path)
+	case ".tif", ".tiff":
+		g, err = loadGeoTIFF(path)
+	default:
+		err = fmt.Errorf("elevation: %s: expected a .gtx or .tif geoid grid", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Geoid{grid: g}, nil
+}
+
+// Undulation returns the height of the geoid above the ellipsoid in meters.
+func (g *Geoid) Undulation(lng, lat float64) (float64, error) {
+	minLng, minLat, maxLng, maxLat := g.grid.bounds()
+	// Global grids differ in whether they run from -180 or 0, and the last
+	// column may stop short of wrapping around. A clamped point is at most
+	// half a sample out, which is centimeters of undulation.
+	for lng < minLng && lng+360 <= maxLng {
+		lng += 360
+	}
+	for lng > maxLng && lng-360 >= minLng {
+		lng -= 360
+	}
+	lng = clamp(lng, minLng, maxLng)
+	lat = clamp(lat, minLat, maxLat)
+
+	value, ok := g.grid.at(lng, lat)
+	if !ok {
+		return 0, ErrNoData
+	}
+	return value, nil
+}
+
+// Convert returns a height relative to the datum to.
+func (g *Geoid) Convert(lng, lat, height float64, from, to Datum) (float64, error) {
+	if from == to {
+		return height, nil
+	}
+	n, err := g.Undulation(lng, lat)
+	if err != nil {
+		return 0, err
+	}
+	if to == Ellipsoid {
+		return height + n, nil
+	}
+	return height - n, nil
+}
+
+// GTX grids are a big-endian header of the south west sample's latitude and
+// longitude, the spacing in each, and the number of rows and columns,
+// followed by float32 samples in rows from south to north.
+
+const gtxVoid = -88.8888
+
+func loadGTX(path string) (*grid, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 40 {
+		return nil, fmt.Errorf("elevation: %s: truncated header", path)
+	}
+	south := math.Float64frombits(binary.BigEndian.Uint64(raw[0:]))
+	west := math.Float64frombits(binary.BigEndian.Uint64(raw[8:]))
+	dy := math.Float64frombits(binary.BigEndian.Uint64(raw[16:]))
+	dx := math.Float64frombits(binary.BigEndian.Uint64(raw[24:]))
+	rows := int(int32(binary.BigEndian.Uint32(raw[32:])))
+	cols := int(int32(binary.BigEndian.Uint32(raw[36:])))
+	if rows < 1 || cols < 1 || len(raw) != 40+rows*cols*4 {
+		return nil, fmt.Errorf("elevation: %s: size doesn't match header", path)
+	}
+
+	if west >= 180 {
+		west -= 360
+	}
+	g := &grid{
+		west:      west,
+		north:     south + float64(rows-1)*dy,
+		dx:        dx,
+		dy:        dy,
+		width:     cols,
+		height:    rows,
+		noData:    gtxVoid,
+		hasNoData: true,
+		data:      make([]float32, rows*cols),
+	}
+	for row := 0; row < rows; row++ {
+		src := raw[40+row*cols*4:]
+		dst := g.data[(rows-1-row)*cols:]
+		for col := 0; col < cols; col++ {
+			dst[col] = math.Float32frombits(binary.BigEndian.Uint32(src[col*4:]))
+		}
+	}
+	return g, nil
+}
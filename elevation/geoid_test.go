@@ -0,0 +1,146 @@
+package elevation
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGTX writes a GTX grid of rows from south to north
+func writeGTX(t *testing.T, path string, south, west, dy, dx float64, rows [][]float32) {
+	t.Helper()
+	raw := make([]byte, 40)
+	binary.BigEndian.PutUint64(raw[0:], math.Float64bits(south))
+	binary.BigEndian.PutUint64(raw[8:], math.Float64bits(west))
+	binary.BigEndian.PutUint64(raw[16:], math.Float64bits(dy))
+	binary.BigEndian.PutUint64(raw[24:], math.Float64bits(dx))
+	binary.BigEndian.PutUint32(raw[32:], uint32(len(rows)))
+	binary.BigEndian.PutUint32(raw[36:], uint32(len(rows[0])))
+	for _, row := range rows {
+		for _, v := range row {
+			raw = binary.BigEndian.AppendUint32(raw, math.Float32bits(v))
+		}
+	}
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testGeoid is a coarse global grid 90 degrees apart, running from 0 to 270
+// degrees east like EGM96 GTX grids do
+func testGeoid(t *testing.T) *Geoid {
+	path := filepath.Join(t.TempDir(), "geoid.gtx")
+	writeGTX(t, path, -90, 0, 90, 90, [][]float32{
+		{-10, -10, -10, -10},
+		{0, 10, 20, 30},
+		{15, 15, 15, gtxVoid},
+	})
+	g, err := LoadGeoid(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGeoidUndulation(t *testing.T) {
+	g := testGeoid(t)
+	cases := []struct {
+		name     string
+		lng, lat float64
+		want     float64
+		err      error
+	}{
+		{"sample", 90, 0, 10, nil},
+		{"south pole", 0, -90, -10, nil},
+		{"between samples", 45, 0, 5, nil},
+		{"cell midpoint", 45, 45, 10, nil},
+		{"western hemisphere", -90, 0, 30, nil},
+		{"antimeridian", -180, 0, 20, nil},
+		{"void", 270, 90, 0, ErrNoData},
+	}
+	for _, tc := range cases {
+		got, err := g.Undulation(tc.lng, tc.lat)
+		if !errors.Is(err, tc.err) || (err == nil && !near(got, tc.want)) {
+			t.Errorf("%s: Undulation(%g, %g) = %g, %v, want %g, %v", tc.name, tc.lng, tc.lat, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestGeoidConvert(t *testing.T) {
+	g := testGeoid(t)
+	cases := []struct {
+		name     string
+		lng, lat float64
+		height   float64
+		from, to Datum
+		want     float64
+		err      error
+	}{
+		{"to ellipsoid", 90, 0, 100, MeanSeaLevel, Ellipsoid, 110, nil},
+		{"to sea level", 90, 0, 110, Ellipsoid, MeanSeaLevel, 100, nil},
+		{"negative undulation", 0, -90, 100, MeanSeaLevel, Ellipsoid, 90, nil},
+		{"same datum", 90, 0, 100, Ellipsoid, Ellipsoid, 100, nil},
+		{"same datum at a void", 270, 90, 100, MeanSeaLevel, MeanSeaLevel, 100, nil},
+		{"void", 270, 90, 100, MeanSeaLevel, Ellipsoid, 0, ErrNoData},
+	}
+	for _, tc := range cases {
+		got, err := g.Convert(tc.lng, tc.lat, tc.height, tc.from, tc.to)
+		if !errors.Is(err, tc.err) || (err == nil && !near(got, tc.want)) {
+			t.Errorf("%s: Convert = %g, %v, want %g, %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestLoadGeoidGeoTIFF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoid.tif")
+	writeGeoTIFF(t, path, &grid{
+		west: -180, north: 90, dx: 90, dy: 90, width: 5, height: 3,
+		data: []float32{
+			15, 15, 15, 15, 15,
+			20, 30, 0, 10, 20,
+			-10, -10, -10, -10, -10,
+		},
+	}, tiffOptions{float: true, pixelIsPoint: true})
+
+	g, err := LoadGeoid(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := g.Undulation(90, 0); err != nil || v != 10 {
+		t.Errorf("Undulation(90, 0) = %g, %v, want 10", v, err)
+	}
+	if v, err := g.Undulation(270, 0); err != nil || v != 30 {
+		t.Errorf("Undulation(270, 0) = %g, %v, want 30 from -90", v, err)
+	}
+}
+
+func TestLoadGeoidErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadGeoid(filepath.Join(dir, "geoid.pgm")); err == nil {
+		t.Error("expected error for an unsupported format")
+	}
+
+	truncated := filepath.Join(dir, "truncated.gtx")
+	if err := os.WriteFile(truncated, make([]byte, 20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadGeoid(truncated); err == nil {
+		t.Error("expected error for a truncated header")
+	}
+
+	short := filepath.Join(dir, "short.gtx")
+	writeGTX(t, short, -90, 0, 90, 90, [][]float32{{1, 2}, {3, 4}})
+	raw, err := os.ReadFile(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(short, raw[:len(raw)-4], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadGeoid(short); err == nil {
+		t.Error("expected error for samples that don't match the header")
+	}
+}
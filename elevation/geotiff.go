@@ -0,0 +1,582 @@
+package elevation
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This reads the subset of GeoTIFF used by DEM and geoid grids: a single
+// band of integer or float samples in strips or tiles, uncompressed or
+// deflated, georeferenced to WGS84 longitude/latitude by a tie point and
+// pixel scale. LZW, BigTIFF and projected rasters are not supported.
+
+const (
+	tagImageWidth       = 256
+	tagImageLength      = 257
+	tagBitsPerSample    = 258
+	tagCompression      = 259
+	tagStripOffsets     = 273
+	tagSamplesPerPixel  = 277
+	tagRowsPerStrip     = 278
+	tagStripByteCounts  = 279
+	tagPredictor        = 317
+	tagTileWidth        = 322
+	tagTileLength       = 323
+	tagTileOffsets      = 324
+	tagTileByteCounts   = 325
+	tagSampleFormat     = 339
+	tagModelPixelScale  = 33550
+	tagModelTiepoint    = 33922
+	tagGeoKeyDirectory  = 34735
+	tagGDALNoData       = 42113
+	geoKeyModelType     = 1024
+	geoKeyRasterType    = 1025
+	geoKeyGeographic    = 2048
+	modelTypeGeographic = 2
+	rasterPixelIsPoint  = 2
+)
+
+const (
+	compressionNone       = 1
+	compressionDeflate    = 8
+	compressionOldDeflate = 32946
+)
+
+const (
+	predictorNone       = 1
+	predictorHorizontal = 2
+	predictorFloat      = 3
+)
+
+const (
+	sampleUint  = 1
+	sampleInt   = 2
+	sampleFloat = 3
+)
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	// value is the entry's data if it fits in four bytes, otherwise its offset
+	value []byte
+}
+
+// tiffRaster describes where a GeoTIFF's samples are and how to decode them
+type tiffRaster struct {
+	order binary.ByteOrder
+
+	bitsPerSample int
+	sampleFormat  int
+	compression   int
+	predictor     int
+
+	// Strips are stored as tiles the width of the image
+	chunkWidth  int
+	chunkHeight int
+	offsets     []uint64
+	byteCounts  []uint64
+}
+
+// openGeoTIFF reads a GeoTIFF's extent without loading its samples
+func openGeoTIFF(path string) (*grid, *tiffRaster, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	g, raster, err := readGeoTIFFHeader(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("elevation: %s: %w", path, err)
+	}
+	return g, raster, nil
+}
+
+func loadGeoTIFF(path string) (*grid, error) {
+	g, raster, err := openGeoTIFF(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := raster.load(f, g); err != nil {
+		return nil, fmt.Errorf("elevation: %s: %w", path, err)
+	}
+	return g, nil
+}
+
+func readGeoTIFFHeader(r io.ReaderAt) (*grid, *tiffRaster, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, errors.New("not a TIFF")
+	}
+	switch order.Uint16(header[2:]) {
+	case 42:
+	case 43:
+		return nil, nil, errors.New("BigTIFF is not supported")
+	default:
+		return nil, nil, errors.New("not a TIFF")
+	}
+
+	// We only read the first image, overviews follow it
+	ifdOffset := int64(order.Uint32(header[4:]))
+	countBytes := make([]byte, 2)
+	if _, err := r.ReadAt(countBytes, ifdOffset); err != nil {
+		return nil, nil, err
+	}
+	entryCount := int(order.Uint16(countBytes))
+	entriesBytes := make([]byte, entryCount*12)
+	if _, err := r.ReadAt(entriesBytes, ifdOffset+2); err != nil {
+		return nil, nil, err
+	}
+	entries := make(map[uint16]tiffEntry, entryCount)
+	for i := 0; i < entryCount; i++ {
+		b := entriesBytes[i*12 : (i+1)*12]
+		entries[order.Uint16(b)] = tiffEntry{
+			typ:   order.Uint16(b[2:]),
+			count: order.Uint32(b[4:]),
+			value: b[8:12],
+		}
+	}
+
+	t := tiffReader{r: r, order: order, entries: entries}
+
+	width, err := t.uint(tagImageWidth, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	height, err := t.uint(tagImageLength, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if width < 1 || height < 1 {
+		return nil, nil, errors.New("image is empty")
+	}
+
+	samplesPerPixel, err := t.uint(tagSamplesPerPixel, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if samplesPerPixel != 1 {
+		return nil, nil, fmt.Errorf("expected a single band, got %d", samplesPerPixel)
+	}
+
+	raster := &tiffRaster{order: order}
+	if raster.bitsPerSample, err = t.uint(tagBitsPerSample, 1); err != nil {
+		return nil, nil, err
+	}
+	if raster.sampleFormat, err = t.uint(tagSampleFormat, sampleUint); err != nil {
+		return nil, nil, err
+	}
+	if raster.compression, err = t.uint(tagCompression, compressionNone); err != nil {
+		return nil, nil, err
+	}
+	if raster.predictor, err = t.uint(tagPredictor, predictorNone); err != nil {
+		return nil, nil, err
+	}
+	if err := raster.checkFormat(); err != nil {
+		return nil, nil, err
+	}
+
+	if _, tiled := entries[tagTileWidth]; tiled {
+		if raster.chunkWidth, err = t.uint(tagTileWidth, 0); err != nil {
+			return nil, nil, err
+		}
+		if raster.chunkHeight, err = t.uint(tagTileLength, 0); err != nil {
+			return nil, nil, err
+		}
+		if raster.offsets, err = t.uints(tagTileOffsets); err != nil {
+			return nil, nil, err
+		}
+		if raster.byteCounts, err = t.uints(tagTileByteCounts); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		raster.chunkWidth = width
+		if raster.chunkHeight, err = t.uint(tagRowsPerStrip, height); err != nil {
+			return nil, nil, err
+		}
+		raster.chunkHeight = min(raster.chunkHeight, height)
+		if raster.offsets, err = t.uints(tagStripOffsets); err != nil {
+			return nil, nil, err
+		}
+		if raster.byteCounts, err = t.uints(tagStripByteCounts); err != nil {
+			return nil, nil, err
+		}
+	}
+	if raster.chunkWidth < 1 || raster.chunkHeight < 1 {
+		return nil, nil, errors.New("invalid tile or strip size")
+	}
+	chunks := ceilDiv(width, raster.chunkWidth) * ceilDiv(height, raster.chunkHeight)
+	if len(raster.offsets) != chunks || len(raster.byteCounts) != chunks {
+		return nil, nil, fmt.Errorf("expected %d tiles or strips, got %d", chunks, len(raster.offsets))
+	}
+
+	g := &grid{width: width, height: height}
+	if err := t.georeference(g); err != nil {
+		return nil, nil, err
+	}
+
+	if _, ok := entries[tagGDALNoData]; ok {
+		s, err := t.ascii(tagGDALNoData)
+		if err != nil {
+			return nil, nil, err
+		}
+		noData, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse nodata: %w", err)
+		}
+		g.noData = float32(noData)
+		g.hasNoData = true
+	}
+
+	return g, raster, nil
+}
+
+func (raster *tiffRaster) checkFormat() error {
+	switch raster.compression {
+	case compressionNone, compressionDeflate, compressionOldDeflate:
+	default:
+		return fmt.Errorf("compression %d is not supported", raster.compression)
+	}
+
+	switch {
+	case raster.sampleFormat == sampleUint && (raster.bitsPerSample == 8 || raster.bitsPerSample == 16 || raster.bitsPerSample == 32):
+	case raster.sampleFormat == sampleInt && (raster.bitsPerSample == 8 || raster.bitsPerSample == 16 || raster.bitsPerSample == 32):
+	case raster.sampleFormat == sampleFloat && (raster.bitsPerSample == 32 || raster.bitsPerSample == 64):
+	default:
+		return fmt.Errorf("%d bit samples in format %d are not supported", raster.bitsPerSample, raster.sampleFormat)
+	}
+
+	switch raster.predictor {
+	case predictorNone:
+	case predictorHorizontal:
+		if raster.sampleFormat == sampleFloat {
+			return errors.New("horizontal predictor on float samples is not supported")
+		}
+	case predictorFloat:
+		if raster.sampleFormat != sampleFloat {
+			return errors.New("floating point predictor on integer samples")
+		}
+	default:
+		return fmt.Errorf("predictor %d is not supported", raster.predictor)
+	}
+	return nil
+}
+
+// load reads every sample into g.data
+func (raster *tiffRaster) load(r io.ReaderAt, g *grid) error {
+	bytesPerSample := raster.bitsPerSample / 8
+	rowBytes := raster.chunkWidth * bytesPerSample
+	chunkBytes := rowBytes * raster.chunkHeight
+	chunksAcross := ceilDiv(g.width, raster.chunkWidth)
+
+	g.data = make([]float32, g.width*g.height)
+	for i := range raster.offsets {
+		compressed := make([]byte, raster.byteCounts[i])
+		if _, err := r.ReadAt(compressed, int64(raster.offsets[i])); err != nil {
+			return err
+		}
+
+		chunk, err := raster.decompress(compressed, chunkBytes)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+
+		x0 := (i % chunksAcross) * raster.chunkWidth
+		y0 := (i / chunksAcross) * raster.chunkHeight
+		// The last strip can be short. Tiles are always padded to full size.
+		rows := min(len(chunk)/rowBytes, raster.chunkHeight, g.height-y0)
+		cols := min(raster.chunkWidth, g.width-x0)
+		for y := 0; y < rows; y++ {
+			row := chunk[y*rowBytes : (y+1)*rowBytes]
+			raster.unpredict(row)
+			order := raster.order
+			if raster.predictor == predictorFloat {
+				order = binary.BigEndian
+			}
+			out := g.data[(y0+y)*g.width+x0:]
+			for x := 0; x < cols; x++ {
+				out[x] = raster.sample(row[x*bytesPerSample:], order)
+			}
+		}
+	}
+	return nil
+}
+
+func (raster *tiffRaster) decompress(data []byte, size int) ([]byte, error) {
+	if raster.compression == compressionNone {
+		return data, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out := make([]byte, 0, size)
+	buf := bytes.NewBuffer(out)
+	if _, err := io.Copy(buf, io.LimitReader(zr, int64(size))); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unpredict reverses the predictor on a row, in place
+func (raster *tiffRaster) unpredict(row []byte) {
+	bytesPerSample := raster.bitsPerSample / 8
+	switch raster.predictor {
+	case predictorHorizontal:
+		// Each sample is stored as the difference from the one before
+		n := len(row) / bytesPerSample
+		for i := 1; i < n; i++ {
+			prev := raster.order.Uint32(pad4(row[(i-1)*bytesPerSample:i*bytesPerSample], raster.order))
+			cur := raster.order.Uint32(pad4(row[i*bytesPerSample:(i+1)*bytesPerSample], raster.order))
+			putUint(row[i*bytesPerSample:(i+1)*bytesPerSample], prev+cur, raster.order)
+		}
+	case predictorFloat:
+		// Bytes are differenced, then grouped by significance with the most
+		// significant bytes of every sample first
+		for i := 1; i < len(row); i++ {
+			row[i] += row[i-1]
+		}
+		n := len(row) / bytesPerSample
+		planes := append([]byte(nil), row...)
+		for i := 0; i < n; i++ {
+			for b := 0; b < bytesPerSample; b++ {
+				row[i*bytesPerSample+b] = planes[b*n+i]
+			}
+		}
+	}
+}
+
+// pad4 widens a sample of up to four bytes so it can be read as a uint32
+func pad4(b []byte, order binary.ByteOrder) []byte {
+	if len(b) == 4 {
+		return b
+	}
+	out := make([]byte, 4)
+	if order == binary.BigEndian {
+		copy(out[4-len(b):], b)
+	} else {
+		copy(out, b)
+	}
+	return out
+}
+
+func putUint(b []byte, v uint32, order binary.ByteOrder) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		order.PutUint16(b, uint16(v))
+	case 4:
+		order.PutUint32(b, v)
+	}
+}
+
+func (raster *tiffRaster) sample(b []byte, order binary.ByteOrder) float32 {
+	switch raster.sampleFormat {
+	case sampleUint:
+		switch raster.bitsPerSample {
+		case 8:
+			return float32(b[0])
+		case 16:
+			return float32(order.Uint16(b))
+		default:
+			return float32(order.Uint32(b))
+		}
+	case sampleInt:
+		switch raster.bitsPerSample {
+		case 8:
+			return float32(int8(b[0]))
+		case 16:
+			return float32(int16(order.Uint16(b)))
+		default:
+			return float32(int32(order.Uint32(b)))
+		}
+	default:
+		if raster.bitsPerSample == 32 {
+			return math.Float32frombits(order.Uint32(b))
+		}
+		return float32(math.Float64frombits(order.Uint64(b)))
+	}
+}
+
+type tiffReader struct {
+	r       io.ReaderAt
+	order   binary.ByteOrder
+	entries map[uint16]tiffEntry
+}
+
+var tiffTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	12: 8, // DOUBLE
+	16: 8, // LONG8
+}
+
+func (t tiffReader) data(tag uint16) (tiffEntry, []byte, error) {
+	e, ok := t.entries[tag]
+	if !ok {
+		return e, nil, fmt.Errorf("missing tag %d", tag)
+	}
+	size, ok := tiffTypeSizes[e.typ]
+	if !ok {
+		return e, nil, fmt.Errorf("tag %d has unsupported type %d", tag, e.typ)
+	}
+	n := size * int(e.count)
+	if n <= 4 {
+		return e, e.value[:n], nil
+	}
+	out := make([]byte, n)
+	if _, err := t.r.ReadAt(out, int64(t.order.Uint32(e.value))); err != nil {
+		return e, nil, fmt.Errorf("read tag %d: %w", tag, err)
+	}
+	return e, out, nil
+}
+
+func (t tiffReader) uints(tag uint16) ([]uint64, error) {
+	e, b, err := t.data(tag)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint64, e.count)
+	for i := range out {
+		switch e.typ {
+		case 1:
+			out[i] = uint64(b[i])
+		case 3:
+			out[i] = uint64(t.order.Uint16(b[i*2:]))
+		case 4:
+			out[i] = uint64(t.order.Uint32(b[i*4:]))
+		case 16:
+			out[i] = t.order.Uint64(b[i*8:])
+		default:
+			return nil, fmt.Errorf("tag %d: expected an integer, got type %d", tag, e.typ)
+		}
+	}
+	return out, nil
+}
+
+// uint reads a tag with a single integer value, or returns def if it is
+// missing. A def of zero means the tag is required.
+func (t tiffReader) uint(tag uint16, def int) (int, error) {
+	if _, ok := t.entries[tag]; !ok {
+		if def == 0 {
+			return 0, fmt.Errorf("missing tag %d", tag)
+		}
+		return def, nil
+	}
+	values, err := t.uints(tag)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, fmt.Errorf("tag %d is empty", tag)
+	}
+	// BitsPerSample has a value per band, but we require a single band
+	return int(values[0]), nil
+}
+
+func (t tiffReader) doubles(tag uint16) ([]float64, error) {
+	e, b, err := t.data(tag)
+	if err != nil {
+		return nil, err
+	}
+	if e.typ != 12 {
+		return nil, fmt.Errorf("tag %d: expected doubles, got type %d", tag, e.typ)
+	}
+	out := make([]float64, e.count)
+	for i := range out {
+		out[i] = math.Float64frombits(t.order.Uint64(b[i*8:]))
+	}
+	return out, nil
+}
+
+func (t tiffReader) ascii(tag uint16) (string, error) {
+	e, b, err := t.data(tag)
+	if err != nil {
+		return "", err
+	}
+	if e.typ != 2 {
+		return "", fmt.Errorf("tag %d: expected ASCII, got type %d", tag, e.typ)
+	}
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+// georeference sets the grid's position from the tie point and pixel scale
+func (t tiffReader) georeference(g *grid) error {
+	if _, ok := t.entries[tagGeoKeyDirectory]; !ok {
+		return errors.New("not a GeoTIFF")
+	}
+	dir, err := t.uints(tagGeoKeyDirectory)
+	if err != nil {
+		return err
+	}
+	if len(dir) < 4 {
+		return errors.New("invalid GeoKeyDirectory")
+	}
+	keys := make(map[uint64]uint64)
+	for i := 0; i < int(dir[3]) && 4+i*4+3 < len(dir); i++ {
+		k := dir[4+i*4:]
+		// Only keys stored inline (location 0) are short values
+		if k[1] == 0 {
+			keys[k[0]] = k[3]
+		}
+	}
+	if modelType, ok := keys[geoKeyModelType]; ok && modelType != modelTypeGeographic {
+		return errors.New("only longitude/latitude rasters are supported")
+	}
+	if crs, ok := keys[geoKeyGeographic]; ok && crs != 4326 && crs != 4979 {
+		return fmt.Errorf("expected WGS84, got EPSG:%d", crs)
+	}
+
+	scale, err := t.doubles(tagModelPixelScale)
+	if err != nil {
+		return err
+	}
+	tiepoint, err := t.doubles(tagModelTiepoint)
+	if err != nil {
+		return err
+	}
+	if len(scale) < 2 || len(tiepoint) < 6 {
+		return errors.New("invalid georeferencing")
+	}
+
+	g.dx, g.dy = scale[0], scale[1]
+	g.west = tiepoint[3] - tiepoint[0]*g.dx
+	g.north = tiepoint[4] + tiepoint[1]*g.dy
+	if keys[geoKeyRasterType] != rasterPixelIsPoint {
+		// The tie point is the corner of the pixel rather than its center
+		g.west += g.dx / 2
+		g.north -= g.dy / 2
+	}
+	return nil
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
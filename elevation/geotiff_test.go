@@ -0,0 +1,352 @@
+package elevation
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// tiffOptions chooses how writeGeoTIFF lays out and encodes a raster
+type tiffOptions struct {
+	float        bool
+	tileSize     int // 0 for strips
+	rowsPerStrip int
+	deflate      bool
+	predictor    int
+	pixelIsPoint bool
+	noData       string
+}
+
+type tiffField struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func shorts(values ...uint16) []byte {
+	b := make([]byte, len(values)*2)
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(b[i*2:], v)
+	}
+	return b
+}
+
+func longs(values ...uint32) []byte {
+	b := make([]byte, len(values)*4)
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(b[i*4:], v)
+	}
+	return b
+}
+
+func doubles(values ...float64) []byte {
+	b := make([]byte, len(values)*8)
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[i*8:], math.Float64bits(v))
+	}
+	return b
+}
+
+// encodeRow encodes samples as int16 or float32 and applies the predictor
+func encodeRow(samples []float32, opts tiffOptions) []byte {
+	n := len(samples)
+	if !opts.float {
+		row := make([]byte, n*2)
+		for i, v := range samples {
+			binary.LittleEndian.PutUint16(row[i*2:], uint16(int16(v)))
+		}
+		if opts.predictor == predictorHorizontal {
+			for i := n - 1; i > 0; i-- {
+				diff := binary.LittleEndian.Uint16(row[i*2:]) - binary.LittleEndian.Uint16(row[(i-1)*2:])
+				binary.LittleEndian.PutUint16(row[i*2:], diff)
+			}
+		}
+		return row
+	}
+
+	row := make([]byte, n*4)
+	if opts.predictor != predictorFloat {
+		for i, v := range samples {
+			binary.LittleEndian.PutUint32(row[i*4:], math.Float32bits(v))
+		}
+		return row
+	}
+	// Big-endian bytes grouped into planes by significance, then differenced
+	for i, v := range samples {
+		var be [4]byte
+		binary.BigEndian.PutUint32(be[:], math.Float32bits(v))
+		for b := 0; b < 4; b++ {
+			row[b*n+i] = be[b]
+		}
+	}
+	for i := len(row) - 1; i > 0; i-- {
+		row[i] -= row[i-1]
+	}
+	return row
+}
+
+// writeGeoTIFF writes a little-endian GeoTIFF of g's samples
+func writeGeoTIFF(t *testing.T, path string, g *grid, opts tiffOptions) {
+	t.Helper()
+
+	chunkWidth, chunkHeight := g.width, opts.rowsPerStrip
+	if opts.tileSize > 0 {
+		chunkWidth, chunkHeight = opts.tileSize, opts.tileSize
+	} else if chunkHeight == 0 {
+		chunkHeight = g.height
+	}
+
+	var chunks [][]byte
+	for y0 := 0; y0 < g.height; y0 += chunkHeight {
+		for x0 := 0; x0 < g.width; x0 += chunkWidth {
+			var chunk []byte
+			for y := y0; y < y0+chunkHeight; y++ {
+				if opts.tileSize == 0 && y >= g.height {
+					// The last strip is short
+					break
+				}
+				// Tiles are padded with zeros
+				samples := make([]float32, chunkWidth)
+				for x := x0; x < x0+chunkWidth && x < g.width && y < g.height; x++ {
+					samples[x-x0] = g.data[y*g.width+x]
+				}
+				chunk = append(chunk, encodeRow(samples, opts)...)
+			}
+			if opts.deflate {
+				var buf bytes.Buffer
+				zw := zlib.NewWriter(&buf)
+				_, _ = zw.Write(chunk)
+				_ = zw.Close()
+				chunk = buf.Bytes()
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	bits, format := uint16(16), uint16(sampleInt)
+	if opts.float {
+		bits, format = 32, sampleFloat
+	}
+	compression := uint16(compressionNone)
+	if opts.deflate {
+		compression = compressionDeflate
+	}
+	rasterType := uint16(1)
+	tiepoint := doubles(0, 0, 0, g.west-g.dx/2, g.north+g.dy/2, 0)
+	if opts.pixelIsPoint {
+		rasterType = rasterPixelIsPoint
+		tiepoint = doubles(0, 0, 0, g.west, g.north, 0)
+	}
+
+	offsets := make([]byte, 4*len(chunks))
+	byteCounts := make([]uint32, len(chunks))
+	for i, chunk := range chunks {
+		byteCounts[i] = uint32(len(chunk))
+	}
+	fields := []tiffField{
+		{tagImageWidth, 4, 1, longs(uint32(g.width))},
+		{tagImageLength, 4, 1, longs(uint32(g.height))},
+		{tagBitsPerSample, 3, 1, shorts(bits)},
+		{tagCompression, 3, 1, shorts(compression)},
+		{tagSamplesPerPixel, 3, 1, shorts(1)},
+		{tagSampleFormat, 3, 1, shorts(format)},
+		{tagModelPixelScale, 12, 3, doubles(g.dx, g.dy, 0)},
+		{tagModelTiepoint, 12, 6, tiepoint},
+		{tagGeoKeyDirectory, 3, 16, shorts(
+			1, 1, 0, 3,
+			geoKeyModelType, 0, 1, modelTypeGeographic,
+			geoKeyRasterType, 0, 1, rasterType,
+			geoKeyGeographic, 0, 1, 4326,
+		)},
+	}
+	if opts.predictor != 0 {
+		fields = append(fields, tiffField{tagPredictor, 3, 1, shorts(uint16(opts.predictor))})
+	}
+	if opts.noData != "" {
+		ascii := append([]byte(opts.noData), 0)
+		fields = append(fields, tiffField{tagGDALNoData, 2, uint32(len(ascii)), ascii})
+	}
+	if opts.tileSize > 0 {
+		fields = append(fields,
+			tiffField{tagTileWidth, 3, 1, shorts(uint16(chunkWidth))},
+			tiffField{tagTileLength, 3, 1, shorts(uint16(chunkHeight))},
+			tiffField{tagTileOffsets, 4, uint32(len(chunks)), offsets},
+			tiffField{tagTileByteCounts, 4, uint32(len(chunks)), longs(byteCounts...)},
+		)
+	} else {
+		fields = append(fields,
+			tiffField{tagRowsPerStrip, 3, 1, shorts(uint16(chunkHeight))},
+			tiffField{tagStripOffsets, 4, uint32(len(chunks)), offsets},
+			tiffField{tagStripByteCounts, 4, uint32(len(chunks)), longs(byteCounts...)},
+		)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	// The IFD follows the header, then the values too big to be inline, then
+	// the chunks
+	pos := uint32(8 + 2 + 12*len(fields) + 4)
+	valueOffsets := make([]uint32, len(fields))
+	for i, f := range fields {
+		if len(f.data) > 4 {
+			valueOffsets[i] = pos
+			pos += uint32(len(f.data))
+		}
+	}
+	for i, chunk := range chunks {
+		binary.LittleEndian.PutUint32(offsets[i*4:], pos)
+		pos += uint32(len(chunk))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("II")
+	out.Write(shorts(42))
+	out.Write(longs(8))
+	out.Write(shorts(uint16(len(fields))))
+	for i, f := range fields {
+		out.Write(shorts(f.tag, f.typ))
+		out.Write(longs(f.count))
+		if len(f.data) > 4 {
+			out.Write(longs(valueOffsets[i]))
+		} else {
+			var inline [4]byte
+			copy(inline[:], f.data)
+			out.Write(inline[:])
+		}
+	}
+	out.Write(longs(0))
+	for _, f := range fields {
+		if len(f.data) > 4 {
+			out.Write(f.data)
+		}
+	}
+	for _, chunk := range chunks {
+		out.Write(chunk)
+	}
+
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rampGrid has a different value at every sample, including negative and
+// fractional ones if float is set
+func rampGrid(width, height int, float bool) *grid {
+	g := &grid{west: 6.0125, north: 45.9875, dx: 0.025, dy: 0.025, width: width, height: height}
+	g.data = make([]float32, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := float32(100*y + x - 50)
+			if float {
+				v = v/4 - 0.125
+			}
+			g.data[y*width+x] = v
+		}
+	}
+	return g
+}
+
+func TestGeoTIFFEncodings(t *testing.T) {
+	cases := []struct {
+		name string
+		opts tiffOptions
+	}{
+		{"int16 one strip", tiffOptions{}},
+		{"int16 strips with a short last strip", tiffOptions{rowsPerStrip: 7}},
+		{"int16 deflate horizontal predictor", tiffOptions{rowsPerStrip: 4, deflate: true, predictor: predictorHorizontal}},
+		{"int16 padded tiles", tiffOptions{tileSize: 16, deflate: true}},
+		{"float32 strips", tiffOptions{float: true, rowsPerStrip: 5}},
+		{"float32 tiles floating point predictor", tiffOptions{float: true, tileSize: 16, deflate: true, predictor: predictorFloat}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			want := rampGrid(20, 18, tc.opts.float)
+			path := filepath.Join(t.TempDir(), "ramp.tif")
+			writeGeoTIFF(t, path, want, tc.opts)
+
+			got, err := loadGeoTIFF(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.width != want.width || got.height != want.height {
+				t.Fatalf("size %dx%d, want %dx%d", got.width, got.height, want.width, want.height)
+			}
+			if !near(got.west, want.west) || !near(got.north, want.north) || got.dx != want.dx || got.dy != want.dy {
+				t.Errorf("georeferenced at %g, %g step %g, %g, want %g, %g step %g, %g",
+					got.west, got.north, got.dx, got.dy, want.west, want.north, want.dx, want.dy)
+			}
+			for i := range want.data {
+				if got.data[i] != want.data[i] {
+					t.Fatalf("sample %d,%d = %g, want %g", i%want.width, i/want.width, got.data[i], want.data[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGeoTIFFPixelIsPoint(t *testing.T) {
+	want := rampGrid(4, 4, false)
+	path := filepath.Join(t.TempDir(), "point.tif")
+	writeGeoTIFF(t, path, want, tiffOptions{pixelIsPoint: true})
+
+	got, _, err := openGeoTIFF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !near(got.west, want.west) || !near(got.north, want.north) {
+		t.Errorf("first sample at %g, %g, want %g, %g", got.west, got.north, want.west, want.north)
+	}
+	if got.data != nil {
+		t.Error("openGeoTIFF loaded the samples")
+	}
+}
+
+func TestGeoTIFFNoData(t *testing.T) {
+	g := rampGrid(4, 4, true)
+	// Exact in binary, so the point below is exactly on the sample
+	g.west, g.north, g.dx, g.dy = 6.125, 45.875, 0.25, 0.25
+	g.data[5] = -9999
+	path := filepath.Join(t.TempDir(), "nodata.tif")
+	writeGeoTIFF(t, path, g, tiffOptions{float: true, noData: "-9999"})
+
+	got, err := loadGeoTIFF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.hasNoData || got.noData != -9999 {
+		t.Fatalf("nodata = %g, %v, want -9999", got.noData, got.hasNoData)
+	}
+	lng, lat := got.west+got.dx, got.north-got.dy
+	if v, ok := got.at(lng, lat); ok {
+		t.Errorf("at the nodata sample = %g, want no data", v)
+	}
+}
+
+func TestGeoTIFFRejects(t *testing.T) {
+	dir := t.TempDir()
+	notTIFF := filepath.Join(dir, "not.tif")
+	if err := os.WriteFile(notTIFF, []byte("GIF89a\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadGeoTIFF(notTIFF); err == nil {
+		t.Error("expected error for a file that isn't a TIFF")
+	}
+
+	bigTIFF := filepath.Join(dir, "big.tif")
+	if err := os.WriteFile(bigTIFF, []byte("II\x2b\x00\x08\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadGeoTIFF(bigTIFF); err == nil {
+		t.Error("expected error for a BigTIFF")
+	}
+
+	raster := &tiffRaster{bitsPerSample: 16, sampleFormat: sampleInt, compression: 5, predictor: predictorNone}
+	if err := raster.checkFormat(); err == nil {
+		t.Error("expected error for LZW compression")
+	}
+}
@@ -0,0 +1,92 @@
+package elevation
+
+import "math"
+
+// grid is a raster of values in longitude/latitude, stored north to south
+// and west to east.
+type grid struct {
+	// west and north are the position of the center of the first sample
+	west  float64
+	north float64
+	// dx and dy are the (positive) spacing between samples in degrees
+	dx     float64
+	dy     float64
+	width  int
+	height int
+
+	noData    float32
+	hasNoData bool
+
+	// data is nil until the raster is loaded
+	data []float32
+}
+
+// covers reports whether the point is within the raster, counting the half
+// sample around the edge samples.
+func (g *grid) covers(lng, lat float64) bool {
+	fx := (lng - g.west) / g.dx
+	fy := (g.north - lat) / g.dy
+	return fx >= -0.5 && fy >= -0.5 && fx <= float64(g.width)-0.5 && fy <= float64(g.height)-0.5
+}
+
+// bounds returns the extent of the raster, as covers defines it
+func (g *grid) bounds() (minLng, minLat, maxLng, maxLat float64) {
+	minLng = g.west - g.dx/2
+	maxLng = g.west + (float64(g.width)-0.5)*g.dx
+	maxLat = g.north + g.dy/2
+	minLat = g.north - (float64(g.height)-0.5)*g.dy
+	return
+}
+
+func (g *grid) sizeBytes() int64 {
+	return int64(len(g.data)) * 4
+}
+
+func (g *grid) valid(v float32) bool {
+	if math.IsNaN(float64(v)) {
+		return false
+	}
+	return !g.hasNoData || v != g.noData
+}
+
+// at interpolates bilinearly between the four samples around the point.
+// Void samples are left out, so points next to a void still get a value.
+func (g *grid) at(lng, lat float64) (float64, bool) {
+	if !g.covers(lng, lat) {
+		return 0, false
+	}
+	fx := clamp((lng-g.west)/g.dx, 0, float64(g.width-1))
+	fy := clamp((g.north-lat)/g.dy, 0, float64(g.height-1))
+
+	x0, y0 := int(fx), int(fy)
+	x1, y1 := min(x0+1, g.width-1), min(y0+1, g.height-1)
+	tx, ty := fx-float64(x0), fy-float64(y0)
+
+	samples := [4]struct {
+		x, y   int
+		weight float64
+	}{
+		{x0, y0, (1 - tx) * (1 - ty)},
+		{x1, y0, tx * (1 - ty)},
+		{x0, y1, (1 - tx) * ty},
+		{x1, y1, tx * ty},
+	}
+
+	var sum, weights float64
+	for _, s := range samples {
+		v := g.data[s.y*g.width+s.x]
+		if !g.valid(v) {
+			continue
+		}
+		sum += float64(v) * s.weight
+		weights += s.weight
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return sum / weights, true
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,93 @@
+package elevation
+
+import (
+	"math"
+	"testing"
+)
+
+// testGrid is 3x3 samples half a degree apart, from 0,0 to 1,1
+func testGrid() *grid {
+	return &grid{
+		west:   0,
+		north:  1,
+		dx:     0.5,
+		dy:     0.5,
+		width:  3,
+		height: 3,
+		data: []float32{
+			10, 20, 30,
+			40, 50, 60,
+			70, 80, 90,
+		},
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-4
+}
+
+func TestGridAt(t *testing.T) {
+	cases := []struct {
+		name     string
+		lng, lat float64
+		want     float64
+		ok       bool
+	}{
+		{"north west corner", 0, 1, 10, true},
+		{"north east corner", 1, 1, 30, true},
+		{"south west corner", 0, 0, 70, true},
+		{"south east corner", 1, 0, 90, true},
+		{"center sample", 0.5, 0.5, 50, true},
+		{"edge midpoint", 0.25, 1, 15, true},
+		{"cell midpoint", 0.25, 0.75, 30, true},
+		{"cell quarter point", 0.125, 0.875, 20, true},
+		// Half a sample beyond the edge is clamped to the edge
+		{"west half sample", -0.25, 1, 10, true},
+		{"south half sample", 1, -0.25, 90, true},
+		{"outside west", -0.3, 0.5, 0, false},
+		{"outside north", 0.5, 1.3, 0, false},
+	}
+	g := testGrid()
+	for _, tc := range cases {
+		got, ok := g.at(tc.lng, tc.lat)
+		if ok != tc.ok || (ok && !near(got, tc.want)) {
+			t.Errorf("%s: at(%g, %g) = %g, %v, want %g, %v", tc.name, tc.lng, tc.lat, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestGridAtNoData(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		void float32
+		g    func() *grid
+	}{
+		{"nodata value", -32768, func() *grid {
+			g := testGrid()
+			g.noData, g.hasNoData = -32768, true
+			return g
+		}},
+		{"NaN", float32(math.NaN()), testGrid},
+	} {
+		g := tc.g()
+		g.data[0] = tc.void
+
+		if v, ok := g.at(0, 1); ok {
+			t.Errorf("%s: at the void = %g, want no data", tc.name, v)
+		}
+		// The void is left out and the others reweighted
+		if v, ok := g.at(0.25, 0.75); !ok || !near(v, (20+40+50)/3.0) {
+			t.Errorf("%s: next to the void = %g, %v, want the mean of the others", tc.name, v, ok)
+		}
+		if v, ok := g.at(0.5, 0.5); !ok || v != 50 {
+			t.Errorf("%s: at a valid sample = %g, %v, want 50", tc.name, v, ok)
+		}
+	}
+}
+
+func TestGridBounds(t *testing.T) {
+	minLng, minLat, maxLng, maxLat := testGrid().bounds()
+	if minLng != -0.25 || minLat != -0.25 || maxLng != 1.25 || maxLat != 1.25 {
+		t.Errorf("bounds = %g %g %g %g, want half a sample beyond the edge samples", minLng, minLat, maxLng, maxLat)
+	}
+}
@@ -0,0 +1,83 @@
+package elevation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SRTM HGT tiles cover one degree, named after their south west corner (for
+// example N45E006.hgt). They are big-endian int16 samples in rows from north
+// to south, 1201 (3 arc second) or 3601 (1 arc second) samples square, and
+// the edge samples lie on the degree lines.
+
+const hgtVoid = -32768
+
+// hgtCorner parses the south west corner from a tile's file name
+func hgtCorner(path string) (lng, lat int, err error) {
+	name := strings.ToUpper(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	if len(name) != 7 || (name[0] != 'N' && name[0] != 'S') || (name[3] != 'E' && name[3] != 'W') {
+		return 0, 0, fmt.Errorf("elevation: %s: expected a name like N45E006.hgt", path)
+	}
+	lat, err = strconv.Atoi(name[1:3])
+	if err != nil {
+		return 0, 0, fmt.Errorf("elevation: %s: %w", path, err)
+	}
+	lng, err = strconv.Atoi(name[4:7])
+	if err != nil {
+		return 0, 0, fmt.Errorf("elevation: %s: %w", path, err)
+	}
+	if name[0] == 'S' {
+		lat = -lat
+	}
+	if name[3] == 'W' {
+		lng = -lng
+	}
+	return lng, lat, nil
+}
+
+// openHGT reads a tile's extent without loading its samples
+func openHGT(path string) (*grid, error) {
+	lng, lat, err := hgtCorner(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	size := int(math.Round(math.Sqrt(float64(info.Size() / 2))))
+	if size < 2 || int64(size*size*2) != info.Size() {
+		return nil, fmt.Errorf("elevation: %s: size %d is not a square tile", path, info.Size())
+	}
+	return &grid{
+		west:      float64(lng),
+		north:     float64(lat + 1),
+		dx:        1 / float64(size-1),
+		dy:        1 / float64(size-1),
+		width:     size,
+		height:    size,
+		noData:    hgtVoid,
+		hasNoData: true,
+	}, nil
+}
+
+func loadHGT(path string) (*grid, error) {
+	g, err := openHGT(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g.data = make([]float32, g.width*g.height)
+	for i := range g.data {
+		g.data[i] = float32(int16(binary.BigEndian.Uint16(raw[i*2:])))
+	}
+	return g, nil
+}
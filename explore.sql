@@ -134,7 +134,7 @@ FROM flickr_photos,
 GROUP BY key
 ORDER BY count(*) DESC;
 
--- TODO: If GPSStatus = 'Measurement Void' (~2%) don't use the picture
+-- GPSStatus = 'Measurement Void' (~2%) is rejected by the scorer, see photo_scores.gps_status
 
 SELECT exif->>'GPSStatus', count(*)
 FROM flickr_photos
@@ -142,7 +142,8 @@ WHERE exif is not null
 GROUP BY exif->>'GPSStatus'
 ORDER BY count(*) DESC;
 
--- TODO: ~10% of photos have a GPSHPositioningError. Use above threshold to reject? Use as a positive signal?
+-- ~10% of photos have a GPSHPositioningError. The scorer rejects large errors and uses it, or GPSDOP, in
+-- photo_scores.location_confidence
 
 SELECT round(100.0 * count(*) filter (where exif->>'GPSHPositioningError' is not null) / count(*), 2)
 FROM flickr_photos
@@ -1,111 +1,159 @@
 package flickr
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/joho/godotenv"
+	"github.com/cenkalti/backoff/v4"
 	"hash/fnv"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
-var flickrApiKey string
-var flickrEndpoint *url.URL
+// Client calls the Flickr REST API. The zero value is not usable, construct
+// one with NewClient or NewClientFromEnv.
+type Client struct {
+	Endpoint *url.URL
+	APIKey   string
+	HTTP     *http.Client
+	Limiter  Limiter
 
-func init() {
-	err := godotenv.Load(".env", ".env.local")
-	if err != nil {
-		log.Println(err)
-	}
+	// MaxElapsedTime bounds how long a single call will be retried for
+	MaxElapsedTime time.Duration
+}
 
-	flickrApiKey = os.Getenv("FLICKR_API_KEY")
-	if flickrApiKey == "" {
-		log.Fatal("FLICKR_API_KEY not set")
-	}
+// Limiter throttles requests. Wait blocks until a request may be made.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
 
-	flickrEndpointS := os.Getenv("FLICKR_ENDPOINT")
-	if flickrEndpointS == "" {
-		log.Fatal("FLICKR_ENDPOINT not set")
+func NewClient(endpoint string, apiKey string) (*Client, error) {
+	if apiKey == "" {
+		return nil, errors.New("flickr: missing api key")
 	}
-	flickrEndpoint, err = url.Parse(flickrEndpointS)
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("flickr: parse endpoint: %w", err)
+	}
+	return &Client{
+		Endpoint:       u,
+		APIKey:         apiKey,
+		HTTP:           &http.Client{Timeout: time.Minute},
+		Limiter:        &intervalLimiter{interval: time.Second + 100*time.Millisecond},
+		MaxElapsedTime: 5 * time.Minute,
+	}, nil
+}
+
+// NewClientFromEnv configures a client from FLICKR_ENDPOINT and FLICKR_API_KEY.
+func NewClientFromEnv() (*Client, error) {
+	apiKey := os.Getenv("FLICKR_API_KEY")
+	if apiKey == "" {
+		return nil, errors.New("FLICKR_API_KEY not set")
+	}
+	endpoint := os.Getenv("FLICKR_ENDPOINT")
+	if endpoint == "" {
+		return nil, errors.New("FLICKR_ENDPOINT not set")
 	}
+	return NewClient(endpoint, apiKey)
 }
 
-type SearchResponse struct {
-	Page    int `json:"page"`
-	Pages   int `json:"pages"`
-	Perpage int `json:"perpage"`
-	Total   int `json:"total"`
-	Photos  struct {
-		Page    int     `json:"page"`
-		Pages   int     `json:"pages"`
-		PerPage int     `json:"perpage"`
-		Total   int     `json:"total"`
-		Photo   []Photo `json:"photo"`
-	} `json:"photos"`
+// Error codes returned by the API in the fail envelope. Codes are
+// method-specific, but these are shared by the photo methods we use.
+const (
+	ErrCodePhotoNotFound      = 1
+	ErrCodePermissionDenied   = 2
+	ErrCodeInvalidAPIKey      = 100
+	ErrCodeServiceUnavailable = 105
+)
+
+// APIError is returned when Flickr responds with `stat: "fail"`.
+type APIError struct {
+	Code    int
+	Message string
 }
 
-type Photo struct {
-	ID     string `json:"id"`
-	Owner  string `json:"owner"`
-	Secret string `json:"secret"`
-	Server string `json:"server"`
-	Title  string `json:"title"`
+func (e *APIError) Error() string {
+	return fmt.Sprintf("flickr: api error %d: %s", e.Code, e.Message)
+}
 
-	// only if you requested the extras
-	DateUpload string `json:"dateupload"`
-	Latitude   string `json:"latitude"`
-	Longitude  string `json:"longitude"`
-	Accuracy   string `json:"accuracy"`
+// StatusError is returned when Flickr responds with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Body       string
 }
 
-var mu sync.Mutex
-var lastCall time.Time
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("flickr: HTTP status %d: %s", e.StatusCode, e.Body)
+}
 
-func Call(method string, resp any, params map[string]string) error {
-	params["method"] = method
-	params["format"] = "json"
-	params["nojsoncallback"] = "1"
+// IsNotFound reports whether err indicates the photo does not exist or is not
+// visible to us.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == ErrCodePhotoNotFound
+}
 
+// IsRateLimited reports whether err indicates we exceeded our request quota.
+func IsRateLimited(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests
+}
+
+// Call invokes method, decoding the response into resp. Transient failures
+// (network errors, 5xx, rate limiting) are retried with exponential backoff.
+func (c *Client) Call(ctx context.Context, method string, resp any, params map[string]string) error {
 	query := url.Values{}
 	for k, v := range params {
 		query.Set(k, v)
 	}
+	query.Set("method", method)
+	query.Set("format", "json")
+	query.Set("nojsoncallback", "1")
 
-	r := *flickrEndpoint
+	r := *c.Endpoint
 	r.Path = "/services/rest"
 	r.RawQuery = query.Encode()
 	log.Println("flickr: ", r.String())
 
-	mu.Lock()
-	defer mu.Unlock()
-	wait := time.Until(lastCall.Add(time.Second + 100*time.Millisecond))
-	if wait > 0 {
-		time.Sleep(wait)
+	policy := backoff.NewExponentialBackOff()
+	policy.MaxElapsedTime = c.MaxElapsedTime
+
+	return backoff.RetryNotify(func() error {
+		err := c.callOnce(ctx, r.String(), resp)
+		if err != nil && !isTransient(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(policy, ctx), func(err error, wait time.Duration) {
+		log.Printf("flickr: %s failed, retrying in %s: %s", method, wait, err)
+	})
+}
+
+func (c *Client) callOnce(ctx context.Context, reqURL string, resp any) error {
+	if c.Limiter != nil {
+		if err := c.Limiter.Wait(ctx); err != nil {
+			return err
+		}
 	}
-	lastCall = time.Now()
 
-	req, err := http.NewRequest(http.MethodGet, r.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("X-Api-Key", flickrApiKey)
+	req.Header.Set("X-Api-Key", c.APIKey)
 
-	httpResp, err := http.DefaultClient.Do(req)
+	httpResp, err := c.HTTP.Do(req)
 	if err != nil {
-		log.Fatal(err)
-	}
-	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP status %d", httpResp.StatusCode)
+		return err
 	}
-
 	defer httpResp.Body.Close()
 
 	body, err := io.ReadAll(httpResp.Body)
@@ -113,14 +161,90 @@ func Call(method string, resp any, params map[string]string) error {
 		return err
 	}
 
-	err = json.Unmarshal(body, &resp)
-	if err != nil {
-		return err
+	if httpResp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: httpResp.StatusCode, Body: truncate(string(body), 200)}
+	}
+
+	var envelope struct {
+		Stat    string `json:"stat"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return fmt.Errorf("flickr: decode envelope: %w (got %s)", err, truncate(string(body), 200))
+	}
+	if envelope.Stat == "fail" {
+		return &APIError{Code: envelope.Code, Message: envelope.Message}
+	}
+
+	return json.Unmarshal(body, resp)
+}
+
+func isTransient(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == ErrCodeServiceUnavailable
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, don't retry
+		return false
+	}
+	// Anything else, such as an invalid URL or a failed TLS handshake, will
+	// fail the same way again
+	return isNetworkBlip(err)
+}
+
+// isNetworkBlip reports whether err is a timeout or a dropped connection.
+func isNetworkBlip(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
 	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		// The server closed the connection mid-response
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
 
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// intervalLimiter enforces a minimum gap between requests made by this process.
+type intervalLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	lastCall time.Time
+}
+
+func (l *intervalLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	wait := time.Until(l.lastCall.Add(l.interval))
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	l.lastCall = time.Now()
 	return nil
 }
 
+// StaticEndpoint is where photo files are served from. Binaries override it
+// from FLICKR_STATIC_ENDPOINT when running against flickrfake.
+var StaticEndpoint = "https://live.staticflickr.com"
+
 /*
 SourceURL returns the URL of the photo with the specified size.
 
@@ -139,31 +263,22 @@ Available sizes:
 */
 func SourceURL(photo Photo, size string) string {
 	// https://live.staticflickr.com/{server-id}/{id}_{secret}_{size-suffix}.jpg
-	return "https://live.staticflickr.com/" + photo.Server + "/" + photo.ID + "_" + photo.Secret + "_" + size + ".jpg"
+	return StaticEndpoint + "/" + photo.Server + "/" + photo.ID + "_" + photo.Secret + "_" + size + ".jpg"
 }
 
-func SourceURLFromID(id string, size string) string {
-	var details struct {
-		Photo struct {
-			ID     string `json:"id"`
-			Server string `json:"server"`
-			Secret string `json:"secret"`
-		} `json:"photo"`
-	}
-	err := Call("flickr.photos.getInfo", &details, map[string]string{
-		"photo_id": id,
-	})
+func (c *Client) SourceURLFromID(ctx context.Context, id string, size string) (string, error) {
+	info, err := c.GetInfo(ctx, id)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	photo := Photo{
 		ID:     id,
-		Server: details.Photo.Server,
-		Secret: details.Photo.Secret,
+		Server: info.Server,
+		Secret: info.Secret,
 	}
 
-	return SourceURL(photo, size)
+	return SourceURL(photo, size), nil
 }
 
 func hash(s string) uint64 {
@@ -0,0 +1,242 @@
+package flickr
+
+import (
+	"context"
+	"contourguessr-ingest/flickr/flickrfake"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failFirst serves a flickrfake with one photo, but responds to the first n
+// requests with fail instead.
+func failFirst(t *testing.T, n int32, fail http.HandlerFunc) (*Client, *atomic.Int32) {
+	fake, err := flickrfake.New([]flickrfake.Fixture{flickrfake.NewPhoto("1", 1, 1, time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= n {
+			fail(w, r)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(srv.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Limiter = nil
+	c.HTTP.Timeout = 200 * time.Millisecond
+	c.MaxElapsedTime = 10 * time.Second
+	return c, &requests
+}
+
+func status(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(code), code)
+	}
+}
+
+func apiFailure(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"stat":"fail","code":%d,"message":"Failure %d"}`, code, code)
+	}
+}
+
+// hangUp closes the connection without responding
+func hangUp(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	_ = conn.Close()
+}
+
+// truncated promises a longer body than it sends
+func truncated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Length", "100")
+	_, _ = io.WriteString(w, `{"stat":"ok",`)
+}
+
+func slow(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(time.Second):
+	case <-r.Context().Done():
+	}
+}
+
+func TestRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		fail     http.HandlerFunc
+		failures int32
+		retried  bool
+	}{
+		{"service unavailable code", apiFailure(ErrCodeServiceUnavailable), 2, true},
+		{"rate limited", status(http.StatusTooManyRequests), 1, true},
+		{"internal server error", status(http.StatusInternalServerError), 1, true},
+		{"bad gateway", status(http.StatusBadGateway), 1, true},
+		{"connection closed", hangUp, 1, true},
+		{"truncated body", truncated, 1, true},
+		{"timeout", slow, 1, true},
+		{"not found code", apiFailure(ErrCodePhotoNotFound), 1, false},
+		{"invalid api key", apiFailure(ErrCodeInvalidAPIKey), 1, false},
+		{"bad request", status(http.StatusBadRequest), 1, false},
+		{"forbidden", status(http.StatusForbidden), 1, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, requests := failFirst(t, tc.failures, tc.fail)
+			_, err := c.GetSizes(context.Background(), "1")
+			if tc.retried {
+				if err == nil {
+					// The fixture has no sizes
+					t.Fatal("expected not found once the failures stop")
+				}
+				if !IsNotFound(err) {
+					t.Errorf("got %v, want the not found after retrying", err)
+				}
+				if got := requests.Load(); got != tc.failures+1 {
+					t.Errorf("made %d requests, want %d", got, tc.failures+1)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("expected the first failure")
+				}
+				if got := requests.Load(); got != 1 {
+					t.Errorf("made %d requests, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIErrorParsing(t *testing.T) {
+	c, _ := failFirst(t, 1, apiFailure(ErrCodePermissionDenied))
+	_, err := c.GetExif(context.Background(), "1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want an APIError", err)
+	}
+	if apiErr.Code != ErrCodePermissionDenied || apiErr.Message != "Failure 2" {
+		t.Errorf("got %+v, want code 2 and its message", apiErr)
+	}
+	if IsNotFound(err) || IsRateLimited(err) {
+		t.Errorf("%v is neither not found nor rate limited", err)
+	}
+
+	c, _ = failFirst(t, 1, apiFailure(ErrCodePhotoNotFound))
+	if _, err := c.GetInfo(context.Background(), "1"); !IsNotFound(err) {
+		t.Errorf("got %v, want not found", err)
+	}
+}
+
+func TestNonJSONResponse(t *testing.T) {
+	c, requests := failFirst(t, 1, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html>Maintenance</html>")
+	})
+	_, err := c.GetInfo(context.Background(), "1")
+	if err == nil {
+		t.Fatal("expected error decoding an HTML page")
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("made %d requests, want 1", got)
+	}
+}
+
+func TestMaxElapsedTime(t *testing.T) {
+	c, requests := failFirst(t, 1<<30, status(http.StatusServiceUnavailable))
+	c.MaxElapsedTime = time.Second
+
+	start := time.Now()
+	_, err := c.GetInfo(context.Background(), "1")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want the last 503", err)
+	}
+	// No retry is started that would end past MaxElapsedTime
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("gave up after %s, want about %s", elapsed, c.MaxElapsedTime)
+	}
+	if requests.Load() < 2 {
+		t.Errorf("made %d requests, want at least one retry", requests.Load())
+	}
+}
+
+func TestCanceledIsNotRetried(t *testing.T) {
+	c, requests := failFirst(t, 1<<30, slow)
+	c.HTTP.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := c.GetInfo(ctx, "1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("made %d requests, want 1", got)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransient(t *testing.T) {
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://api.flickr.com/services/rest", Err: err}
+	}
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"5xx", &StatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"429", &StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"404", &StatusError{StatusCode: http.StatusNotFound}, false},
+		{"code 105", &APIError{Code: ErrCodeServiceUnavailable}, true},
+		{"code 1", &APIError{Code: ErrCodePhotoNotFound}, false},
+		{"timeout", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), true},
+		{"connection reset", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"broken pipe", urlErr(&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}), true},
+		{"unexpected EOF", fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), true},
+		{"EOF", urlErr(io.EOF), true},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), false},
+		{"canceled", urlErr(context.Canceled), false},
+		{"other", errors.New("x509: certificate signed by unknown authority"), false},
+	}
+	for _, tc := range cases {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", tc.name, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestIsRateLimited(t *testing.T) {
+	if !IsRateLimited(fmt.Errorf("search: %w", &StatusError{StatusCode: http.StatusTooManyRequests})) {
+		t.Error("429 should be rate limited")
+	}
+	if IsRateLimited(&StatusError{StatusCode: http.StatusServiceUnavailable}) {
+		t.Error("503 should not be rate limited")
+	}
+}
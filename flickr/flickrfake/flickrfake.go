@@ -0,0 +1,388 @@
+// Package flickrfake serves a stand-in for the parts of the Flickr API we use
+// from a directory of fixtures, so the pipeline can run without network.
+//
+// A fixture directory looks like:
+//
+//	photos/<id>.json   one file per photo, see Fixture
+//	static/...         served as-is, mirroring live.staticflickr.com paths
+//	                   (e.g. static/<server>/<id>_<secret>_m.jpg)
+//
+// Point FLICKR_ENDPOINT (and FLICKR_STATIC_ENDPOINT) at the server.
+package flickrfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fixture is the contents of photos/<id>.json. Only Photo is required.
+type Fixture struct {
+	// Photo is returned as a search result. It should contain the extras the
+	// indexer requests (latitude, longitude, accuracy, dateupload, ...).
+	Photo json.RawMessage `json:"photo"`
+	Info  json.RawMessage `json:"info,omitempty"`
+	Sizes json.RawMessage `json:"sizes,omitempty"`
+	Exif  json.RawMessage `json:"exif,omitempty"`
+
+	// Errors maps a method name to the failure it should return for this photo
+	Errors map[string]APIError `json:"errors,omitempty"`
+}
+
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes used by the real API
+const (
+	codePhotoNotFound  = 1
+	codeInvalidAPIKey  = 100
+	codeMethodNotFound = 112
+)
+
+const defaultPerPage = 100
+const maxPerPage = 500
+
+type Server struct {
+	// APIKey, if set, must match the X-Api-Key header or api_key param
+	APIKey string
+	// MaxSearchResults, if positive, imitates Flickr only letting you page
+	// through the first N results of a search while still reporting the true
+	// total.
+	MaxSearchResults int
+
+	photos []photo
+	byID   map[string]*photo
+	static http.Handler
+}
+
+type photo struct {
+	ID         string
+	Lng        float64
+	Lat        float64
+	DateUpload int64
+	Fixture    Fixture
+}
+
+// Load serves the fixtures in dir, see the package doc for its layout.
+func Load(dir string) (*Server, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "photos", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var fixtures []Fixture
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var f Fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if _, err := parsePhoto(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		fixtures = append(fixtures, f)
+	}
+
+	s, err := New(fixtures)
+	if err != nil {
+		return nil, err
+	}
+	s.static = http.FileServer(http.Dir(filepath.Join(dir, "static")))
+	return s, nil
+}
+
+// New serves fixtures without any static files, which is convenient for
+// tests.
+func New(fixtures []Fixture) (*Server, error) {
+	s := &Server{
+		byID:   make(map[string]*photo),
+		static: http.NotFoundHandler(),
+	}
+	for _, f := range fixtures {
+		p, err := parsePhoto(f)
+		if err != nil {
+			return nil, err
+		}
+		s.photos = append(s.photos, p)
+	}
+
+	sort.SliceStable(s.photos, func(i, j int) bool {
+		return s.photos[i].DateUpload < s.photos[j].DateUpload
+	})
+	for i := range s.photos {
+		if s.byID[s.photos[i].ID] != nil {
+			return nil, fmt.Errorf("photo %s: duplicate id", s.photos[i].ID)
+		}
+		s.byID[s.photos[i].ID] = &s.photos[i]
+	}
+
+	return s, nil
+}
+
+// NewPhoto returns a fixture for a photo with the extras the indexer
+// requests, for tests that need many photos. It has no info, sizes or EXIF.
+func NewPhoto(id string, lng, lat float64, uploaded time.Time) Fixture {
+	summary, err := json.Marshal(map[string]any{
+		"id":         id,
+		"owner":      "12345678@N00",
+		"secret":     "abcdef1234",
+		"server":     "65535",
+		"title":      "Photo " + id,
+		"dateupload": strconv.FormatInt(uploaded.Unix(), 10),
+		"datetaken":  uploaded.UTC().Format("2006-01-02 15:04:05"),
+		"latitude":   strconv.FormatFloat(lat, 'f', -1, 64),
+		"longitude":  strconv.FormatFloat(lng, 'f', -1, 64),
+		"accuracy":   "16",
+		"license":    "4",
+		"ownername":  "example",
+	})
+	if err != nil {
+		panic(err)
+	}
+	return Fixture{Photo: summary}
+}
+
+func parsePhoto(f Fixture) (photo, error) {
+	p := photo{Fixture: f}
+
+	var summary struct {
+		ID         string      `json:"id"`
+		Latitude   json.Number `json:"latitude"`
+		Longitude  json.Number `json:"longitude"`
+		DateUpload json.Number `json:"dateupload"`
+	}
+	if err := json.Unmarshal(p.Fixture.Photo, &summary); err != nil {
+		return p, fmt.Errorf("photo: %w", err)
+	}
+	if summary.ID == "" {
+		return p, fmt.Errorf("photo: missing id")
+	}
+	p.ID = summary.ID
+
+	var err error
+	if p.Lat, err = summary.Latitude.Float64(); err != nil {
+		return p, fmt.Errorf("photo: latitude: %w", err)
+	}
+	if p.Lng, err = summary.Longitude.Float64(); err != nil {
+		return p, fmt.Errorf("photo: longitude: %w", err)
+	}
+	if p.DateUpload, err = summary.DateUpload.Int64(); err != nil {
+		return p, fmt.Errorf("photo: dateupload: %w", err)
+	}
+	return p, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/services/rest" && r.URL.Path != "/services/rest/" {
+		s.static.ServeHTTP(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("format") != "json" || q.Get("nojsoncallback") != "1" {
+		http.Error(w, "only format=json&nojsoncallback=1 is supported", http.StatusBadRequest)
+		return
+	}
+
+	if s.APIKey != "" {
+		key := r.Header.Get("X-Api-Key")
+		if key == "" {
+			key = q.Get("api_key")
+		}
+		if key != s.APIKey {
+			writeFail(w, APIError{Code: codeInvalidAPIKey, Message: "Invalid API Key (Key not found)"})
+			return
+		}
+	}
+
+	method := q.Get("method")
+	switch method {
+	case "flickr.photos.search":
+		s.search(w, q)
+	case "flickr.photos.getInfo":
+		s.photoMethod(w, q, method, "photo", func(f Fixture) json.RawMessage { return f.Info })
+	case "flickr.photos.getSizes":
+		s.photoMethod(w, q, method, "sizes", func(f Fixture) json.RawMessage { return f.Sizes })
+	case "flickr.photos.getExif":
+		s.getExif(w, q)
+	default:
+		writeFail(w, APIError{Code: codeMethodNotFound, Message: fmt.Sprintf("Method \"%s\" not found", method)})
+	}
+}
+
+func (s *Server) search(w http.ResponseWriter, q map[string][]string) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	var bbox []float64
+	if v := get("bbox"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(part, 64)
+			if err != nil {
+				writeFail(w, APIError{Code: 4, Message: "Not a valid bbox"})
+				return
+			}
+			bbox = append(bbox, f)
+		}
+		if len(bbox) != 4 {
+			writeFail(w, APIError{Code: 4, Message: "Not a valid bbox"})
+			return
+		}
+	}
+
+	minUpload, err := parseUnixParam(get("min_upload_date"), 0)
+	if err != nil {
+		writeFail(w, APIError{Code: 3, Message: "Invalid min_upload_date"})
+		return
+	}
+	maxUpload, err := parseUnixParam(get("max_upload_date"), time.Now().Unix())
+	if err != nil {
+		writeFail(w, APIError{Code: 3, Message: "Invalid max_upload_date"})
+		return
+	}
+
+	perPage := defaultPerPage
+	if v := get("per_page"); v != "" {
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage <= 0 {
+			perPage = defaultPerPage
+		}
+		perPage = min(perPage, maxPerPage)
+	}
+	page := 1
+	if v := get("page"); v != "" {
+		page, err = strconv.Atoi(v)
+		if err != nil || page <= 0 {
+			page = 1
+		}
+	}
+
+	var matches []json.RawMessage
+	for _, p := range s.photos {
+		if p.DateUpload < minUpload || p.DateUpload > maxUpload {
+			continue
+		}
+		if bbox != nil && (p.Lng < bbox[0] || p.Lat < bbox[1] || p.Lng > bbox[2] || p.Lat > bbox[3]) {
+			continue
+		}
+		matches = append(matches, p.Fixture.Photo)
+	}
+
+	total := len(matches)
+	if s.MaxSearchResults > 0 && len(matches) > s.MaxSearchResults {
+		matches = matches[:s.MaxSearchResults]
+	}
+	pages := (total + perPage - 1) / perPage
+
+	// Like Flickr, a page past the end repeats the last page we are willing to
+	// serve rather than failing.
+	servable := max((len(matches)+perPage-1)/perPage, 1)
+	start := (min(page, servable) - 1) * perPage
+	end := min(start+perPage, len(matches))
+	pageMatches := matches[start:end]
+	if pageMatches == nil {
+		pageMatches = []json.RawMessage{}
+	}
+
+	writeOK(w, map[string]any{
+		"photos": map[string]any{
+			"page":    page,
+			"pages":   pages,
+			"perpage": perPage,
+			"total":   total,
+			"photo":   pageMatches,
+		},
+	})
+}
+
+func (s *Server) photoMethod(w http.ResponseWriter, q map[string][]string, method string, key string, field func(Fixture) json.RawMessage) {
+	p, ok := s.lookup(w, q, method)
+	if !ok {
+		return
+	}
+	value := field(p.Fixture)
+	if value == nil {
+		writeFail(w, APIError{Code: codePhotoNotFound, Message: "Photo not found"})
+		return
+	}
+	writeOK(w, map[string]any{key: value})
+}
+
+func (s *Server) getExif(w http.ResponseWriter, q map[string][]string) {
+	p, ok := s.lookup(w, q, "flickr.photos.getExif")
+	if !ok {
+		return
+	}
+	exif := p.Fixture.Exif
+	if exif == nil {
+		exif = json.RawMessage("[]")
+	}
+	writeOK(w, map[string]any{
+		"photo": map[string]any{
+			"id":     p.ID,
+			"secret": "",
+			"server": "",
+			"camera": "",
+			"exif":   exif,
+		},
+	})
+}
+
+func (s *Server) lookup(w http.ResponseWriter, q map[string][]string, method string) (*photo, bool) {
+	var id string
+	if v := q["photo_id"]; len(v) > 0 {
+		id = v[0]
+	}
+	p := s.byID[id]
+	if p == nil {
+		writeFail(w, APIError{Code: codePhotoNotFound, Message: "Photo not found"})
+		return nil, false
+	}
+	if apiErr, ok := p.Fixture.Errors[method]; ok {
+		writeFail(w, apiErr)
+		return nil, false
+	}
+	return p, true
+}
+
+func parseUnixParam(v string, fallback int64) (int64, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func writeOK(w http.ResponseWriter, body map[string]any) {
+	body["stat"] = "ok"
+	writeJSON(w, body)
+}
+
+func writeFail(w http.ResponseWriter, apiErr APIError) {
+	writeJSON(w, map[string]any{
+		"stat":    "fail",
+		"code":    apiErr.Code,
+		"message": apiErr.Message,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("flickrfake: error writing response:", err)
+	}
+}
@@ -0,0 +1,203 @@
+package flickrfake_test
+
+import (
+	"context"
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/flickr/flickrfake"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serve starts s and returns a client for it without the rate limit
+func serve(t *testing.T, s *flickrfake.Server) *flickr.Client {
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c, err := flickr.NewClient(srv.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Limiter = nil
+	c.MaxElapsedTime = time.Second
+	return c
+}
+
+var everywhere = [4]float64{-180, -90, 180, 90}
+
+func TestClientAgainstExample(t *testing.T) {
+	s, err := flickrfake.Load("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := serve(t, s)
+	ctx := context.Background()
+
+	page, err := c.Search(ctx, flickr.SearchParams{
+		BBox:          [4]float64{-4, 57, -3, 58},
+		MinUploadDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		MaxUploadDate: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		Page:          1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Pages != 1 || len(page.Photo) != 1 {
+		t.Fatalf("search = %+v, want the one example photo", page)
+	}
+	photo := page.Photo[0]
+	if photo.ID != "53500000001" || photo.Latitude != "57.069421" || photo.License != "4" || photo.OwnerName != "example" {
+		t.Errorf("search photo = %+v", photo)
+	}
+
+	info, err := c.GetInfo(ctx, photo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken, err := info.DateTaken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Owner.NSID != "12345678@N00" || info.Secret != "abcdef1234" ||
+		taken == nil || !taken.Equal(time.Date(2023, 12, 30, 11, 2, 45, 0, time.UTC)) {
+		t.Errorf("info = %+v, taken %v", info, taken)
+	}
+
+	sizes, err := c.GetSizes(ctx, photo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(sizes.Photos()); got != 4 {
+		t.Errorf("got %d sizes, want 4", got)
+	}
+
+	exif, err := c.GetExif(ctx, photo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := exif.Values()["GPSAltitude"]; got != "1021.4 m" {
+		t.Errorf("GPSAltitude = %q, want %q", got, "1021.4 m")
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	s, err := flickrfake.Load("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		size          string
+		width, height int
+	}{
+		{"t", 100, 75},
+		{"m", 240, 180},
+		{"n", 320, 240},
+		{"b", 1024, 768},
+	} {
+		resp, err := http.Get(srv.URL + "/65535/53500000001_abcdef1234_" + tc.size + ".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("size %s: %s", tc.size, err)
+			continue
+		}
+		if config.Width != tc.width || config.Height != tc.height {
+			t.Errorf("size %s is %dx%d, want %dx%d", tc.size, config.Width, config.Height, tc.width, tc.height)
+		}
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var fixtures []flickrfake.Fixture
+	for i := 0; i < 250; i++ {
+		fixtures = append(fixtures, flickrfake.NewPhoto(fmt.Sprint(1000+i), 1, 1, start.Add(time.Duration(i)*time.Minute)))
+	}
+	// Outside the searched bbox
+	fixtures = append(fixtures, flickrfake.NewPhoto("2000", 50, 50, start))
+	s, err := flickrfake.New(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxSearchResults = 200
+	c := serve(t, s)
+
+	search := func(page int) *flickr.SearchPage {
+		resp, err := c.Search(context.Background(), flickr.SearchParams{
+			BBox:          [4]float64{0, 0, 2, 2},
+			MinUploadDate: start,
+			MaxUploadDate: start.Add(24 * time.Hour),
+			Page:          page,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := search(1)
+	if first.Total != 250 || first.Pages != 3 || first.PerPage != 100 || len(first.Photo) != 100 {
+		t.Fatalf("page 1 = total %d, pages %d, per page %d, %d photos",
+			first.Total, first.Pages, first.PerPage, len(first.Photo))
+	}
+	if first.Photo[0].ID != "1000" {
+		t.Errorf("page 1 starts with %s, want the earliest upload", first.Photo[0].ID)
+	}
+	// Past MaxSearchResults the last servable page repeats
+	third := search(3)
+	if len(third.Photo) != 100 || third.Photo[0].ID != "1100" {
+		t.Errorf("page 3 has %d photos starting with %s, want a repeat of page 2", len(third.Photo), third.Photo[0].ID)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	example := flickrfake.NewPhoto("1", 1, 1, time.Now())
+	example.Errors = map[string]flickrfake.APIError{
+		"flickr.photos.getExif": {Code: flickr.ErrCodePermissionDenied, Message: "Permission denied"},
+	}
+	s, err := flickrfake.New([]flickrfake.Fixture{example})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	c := serve(t, s)
+	_, err = c.GetExif(ctx, "1")
+	var apiErr *flickr.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != flickr.ErrCodePermissionDenied {
+		t.Errorf("GetExif with an error fixture = %v, want permission denied", err)
+	}
+	if _, err := c.GetInfo(ctx, "1"); !flickr.IsNotFound(err) {
+		t.Errorf("GetInfo without info = %v, want not found", err)
+	}
+	if _, err := c.GetSizes(ctx, "2"); !flickr.IsNotFound(err) {
+		t.Errorf("GetSizes of a missing photo = %v, want not found", err)
+	}
+
+	s.APIKey = "other"
+	_, err = c.Search(ctx, flickr.SearchParams{BBox: everywhere, Page: 1})
+	if !errors.As(err, &apiErr) || apiErr.Code != flickr.ErrCodeInvalidAPIKey {
+		t.Errorf("search with the wrong key = %v, want invalid key", err)
+	}
+}
+
+func TestDuplicateFixtures(t *testing.T) {
+	now := time.Now()
+	_, err := flickrfake.New([]flickrfake.Fixture{
+		flickrfake.NewPhoto("1", 1, 1, now),
+		flickrfake.NewPhoto("1", 2, 2, now),
+	})
+	if err == nil {
+		t.Error("expected error for duplicate photo ids")
+	}
+}
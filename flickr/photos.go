@@ -0,0 +1,431 @@
+package flickr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The response types below keep the exact JSON they were decoded from, and
+// marshal back to it. This means a value fetched from the API can be stored
+// as jsonb and later scanned back into the same type without losing fields we
+// don't model.
+
+// Photo is a search result. The extras fields are only present if requested.
+type Photo struct {
+	ID     string `json:"id"`
+	Owner  string `json:"owner"`
+	Secret string `json:"secret"`
+	Server string `json:"server"`
+	Title  string `json:"title"`
+
+	// only if you requested the extras
+	DateUpload string `json:"dateupload"`
+	DateTaken  string `json:"datetaken"`
+	Latitude   string `json:"latitude"`
+	Longitude  string `json:"longitude"`
+	Accuracy   string `json:"accuracy"`
+	License    string `json:"license"`
+	OwnerName  string `json:"ownername"`
+
+	raw json.RawMessage
+}
+
+func (p *Photo) UnmarshalJSON(data []byte) error {
+	type plain Photo
+	// Flickr sends some extras as numbers or strings depending on the endpoint
+	var fields struct {
+		plain
+		Latitude  FlexString `json:"latitude"`
+		Longitude FlexString `json:"longitude"`
+		Accuracy  FlexString `json:"accuracy"`
+		License   FlexString `json:"license"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*p = Photo(fields.plain)
+	p.Latitude = string(fields.Latitude)
+	p.Longitude = string(fields.Longitude)
+	p.Accuracy = string(fields.Accuracy)
+	p.License = string(fields.License)
+	p.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (p Photo) MarshalJSON() ([]byte, error) {
+	if p.raw != nil {
+		return p.raw, nil
+	}
+	type plain Photo
+	return json.Marshal(plain(p))
+}
+
+// Raw returns the JSON the photo was decoded from, or nil.
+func (p Photo) Raw() json.RawMessage {
+	return p.raw
+}
+
+type SearchPage struct {
+	Page    int     `json:"page"`
+	Pages   int     `json:"pages"`
+	PerPage int     `json:"perpage"`
+	Total   int     `json:"total"`
+	Photo   []Photo `json:"photo"`
+}
+
+func (p *SearchPage) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Page    FlexInt `json:"page"`
+		Pages   FlexInt `json:"pages"`
+		PerPage FlexInt `json:"perpage"`
+		Total   FlexInt `json:"total"`
+		Photo   []Photo `json:"photo"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*p = SearchPage{
+		Page:    int(fields.Page),
+		Pages:   int(fields.Pages),
+		PerPage: int(fields.PerPage),
+		Total:   int(fields.Total),
+		Photo:   fields.Photo,
+	}
+	return nil
+}
+
+type SearchParams struct {
+	// BBox is min_lng,min_lat,max_lng,max_lat
+	BBox          [4]float64
+	MinUploadDate time.Time
+	MaxUploadDate time.Time
+	Extras        []string
+	Page          int
+}
+
+// Search calls flickr.photos.search for geotagged, safe photos (not
+// screenshots or other content types) sorted by upload date ascending.
+func (c *Client) Search(ctx context.Context, params SearchParams) (*SearchPage, error) {
+	var resp struct {
+		Photos SearchPage `json:"photos"`
+	}
+	err := c.Call(ctx, "flickr.photos.search", &resp, map[string]string{
+		"bbox": fmt.Sprintf("%f,%f,%f,%f",
+			params.BBox[0], params.BBox[1], params.BBox[2], params.BBox[3]),
+		"min_upload_date": strconv.FormatInt(params.MinUploadDate.Unix(), 10),
+		"max_upload_date": strconv.FormatInt(params.MaxUploadDate.Unix(), 10),
+		"sort":            "date-posted-asc",
+		"safe_search":     "1",
+		"content_type":    "1", // photos only
+		"extras":          strings.Join(params.Extras, ","),
+		"page":            strconv.Itoa(params.Page),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Photos, nil
+}
+
+// Content is how Flickr wraps text values
+type Content struct {
+	Content string `json:"_content"`
+}
+
+type PhotoInfo struct {
+	ID           string     `json:"id"`
+	Secret       string     `json:"secret"`
+	Server       string     `json:"server"`
+	DateUploaded string     `json:"dateuploaded"`
+	License      FlexString `json:"license"`
+	Owner        Owner      `json:"owner"`
+	Title        Content    `json:"title"`
+	Description  Content    `json:"description"`
+	Visibility   struct {
+		IsPublic FlexInt `json:"ispublic"`
+		IsFriend FlexInt `json:"isfriend"`
+		IsFamily FlexInt `json:"isfamily"`
+	} `json:"visibility"`
+	Dates struct {
+		Posted           string  `json:"posted"`
+		Taken            string  `json:"taken"`
+		TakenGranularity FlexInt `json:"takengranularity"`
+		LastUpdate       string  `json:"lastupdate"`
+	} `json:"dates"`
+	Location *struct {
+		Latitude  FlexString `json:"latitude"`
+		Longitude FlexString `json:"longitude"`
+		Accuracy  FlexString `json:"accuracy"`
+	} `json:"location,omitempty"`
+
+	raw json.RawMessage
+}
+
+type Owner struct {
+	NSID       string  `json:"nsid"`
+	Username   string  `json:"username"`
+	Realname   string  `json:"realname"`
+	Location   string  `json:"location"`
+	Iconserver string  `json:"iconserver"`
+	Iconfarm   FlexInt `json:"iconfarm"`
+	PathAlias  string  `json:"path_alias"`
+}
+
+func (p *PhotoInfo) UnmarshalJSON(data []byte) error {
+	type plain PhotoInfo
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (p PhotoInfo) MarshalJSON() ([]byte, error) {
+	if p.raw != nil {
+		return p.raw, nil
+	}
+	type plain PhotoInfo
+	return json.Marshal(plain(p))
+}
+
+// DateTaken parses Dates.Taken, returning nil if the photo has no date taken.
+func (p PhotoInfo) DateTaken() (*time.Time, error) {
+	if p.Dates.Taken == "" {
+		return nil, nil
+	}
+	value, err := time.Parse("2006-01-02 15:04:05", p.Dates.Taken)
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func (c *Client) GetInfo(ctx context.Context, photoID string) (*PhotoInfo, error) {
+	var resp struct {
+		Photo PhotoInfo `json:"photo"`
+	}
+	err := c.Call(ctx, "flickr.photos.getInfo", &resp, map[string]string{
+		"photo_id": photoID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Photo, nil
+}
+
+type Sizes struct {
+	CanBlog     FlexInt `json:"canblog"`
+	CanPrint    FlexInt `json:"canprint"`
+	CanDownload FlexInt `json:"candownload"`
+	Size        []Size  `json:"size"`
+
+	raw json.RawMessage
+}
+
+type Size struct {
+	Label  string  `json:"label"`
+	Width  FlexInt `json:"width"`
+	Height FlexInt `json:"height"`
+	Source string  `json:"source"`
+	URL    string  `json:"url"`
+	Media  string  `json:"media"`
+}
+
+func (s *Sizes) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		CanBlog     FlexInt           `json:"canblog"`
+		CanPrint    FlexInt           `json:"canprint"`
+		CanDownload FlexInt           `json:"candownload"`
+		Size        []json.RawMessage `json:"size"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	*s = Sizes{
+		CanBlog:     fields.CanBlog,
+		CanPrint:    fields.CanPrint,
+		CanDownload: fields.CanDownload,
+		raw:         append(json.RawMessage(nil), data...),
+	}
+	for _, sizeJSON := range fields.Size {
+		var size Size
+		if err := json.Unmarshal(sizeJSON, &size); err != nil {
+			// Certain images have obsolete video media entries with a different
+			// schema. We never use them, so keep just enough to identify them.
+			var media struct {
+				Label string `json:"label"`
+				Media string `json:"media"`
+			}
+			if json.Unmarshal(sizeJSON, &media) != nil || media.Media != "video" {
+				// One bad size shouldn't lose us the photo
+				log.Printf("flickr: skipping size: %s (got %s)", err, sizeJSON)
+				continue
+			}
+			size = Size{Label: media.Label, Media: media.Media}
+		}
+		s.Size = append(s.Size, size)
+	}
+	return nil
+}
+
+func (s Sizes) MarshalJSON() ([]byte, error) {
+	if s.raw != nil {
+		return s.raw, nil
+	}
+	type plain Sizes
+	return json.Marshal(plain(s))
+}
+
+// Photos returns the sizes excluding video media entries.
+func (s Sizes) Photos() []Size {
+	out := make([]Size, 0, len(s.Size))
+	for _, size := range s.Size {
+		if size.Media == "video" {
+			continue
+		}
+		out = append(out, size)
+	}
+	return out
+}
+
+func (c *Client) GetSizes(ctx context.Context, photoID string) (*Sizes, error) {
+	var resp struct {
+		Sizes Sizes `json:"sizes"`
+	}
+	err := c.Call(ctx, "flickr.photos.getSizes", &resp, map[string]string{
+		"photo_id": photoID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Sizes, nil
+}
+
+type ExifTag struct {
+	TagSpace   string   `json:"tagspace"`
+	TagSpaceID FlexInt  `json:"tagspaceid"`
+	Tag        string   `json:"tag"`
+	Label      string   `json:"label"`
+	Raw        Content  `json:"raw"`
+	Clean      *Content `json:"clean,omitempty"`
+}
+
+// Exif is the list of tags returned by flickr.photos.getExif. The same tag
+// name can appear in multiple tagspaces.
+type Exif struct {
+	Tags []ExifTag
+
+	raw json.RawMessage
+}
+
+func (e *Exif) UnmarshalJSON(data []byte) error {
+	var tags []ExifTag
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	*e = Exif{Tags: tags, raw: append(json.RawMessage(nil), data...)}
+	return nil
+}
+
+func (e Exif) MarshalJSON() ([]byte, error) {
+	if e.raw != nil {
+		return e.raw, nil
+	}
+	return json.Marshal(e.Tags)
+}
+
+// Raw returns the JSON the tags were decoded from, or nil if the response
+// had none.
+func (e Exif) Raw() json.RawMessage {
+	return e.raw
+}
+
+// Values maps tag names to raw values. Where a tag appears in several
+// tagspaces the last wins.
+func (e Exif) Values() map[string]string {
+	out := make(map[string]string)
+	for _, tag := range e.Tags {
+		out[tag.Tag] = tag.Raw.Content
+	}
+	return out
+}
+
+// GetExif returns an empty Exif, with a nil Raw, if the response has no
+// EXIF.
+func (c *Client) GetExif(ctx context.Context, photoID string) (Exif, error) {
+	var resp struct {
+		Photo struct {
+			Exif Exif `json:"exif"`
+		} `json:"photo"`
+	}
+	err := c.Call(ctx, "flickr.photos.getExif", &resp, map[string]string{
+		"photo_id": photoID,
+	})
+	if err != nil {
+		return Exif{}, err
+	}
+	return resp.Photo.Exif, nil
+}
+
+// FlexInt decodes an integer that Flickr may send as a number, a numeric
+// string, or an empty string.
+type FlexInt int
+
+func (v *FlexInt) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*v = 0
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			*v = 0
+			return nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("flickr: expected integer, got %q", s)
+		}
+		*v = FlexInt(n)
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*v = FlexInt(n)
+	return nil
+}
+
+// FlexString decodes a value Flickr may send as either a string or a number.
+type FlexString string
+
+func (v *FlexString) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*v = ""
+		return nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = FlexString(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*v = FlexString(n.String())
+	return nil
+}
@@ -0,0 +1,197 @@
+package flickr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// compact removes insignificant whitespace, as json.Marshal does
+func compact(t *testing.T, s string) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestFlexInt(t *testing.T) {
+	cases := []struct {
+		json    string
+		want    FlexInt
+		wantErr bool
+	}{
+		{`12`, 12, false},
+		{`"12"`, 12, false},
+		{`""`, 0, false},
+		{`null`, 0, false},
+		{`-3`, -3, false},
+		{`"abc"`, 0, true},
+		{`1.5`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tc := range cases {
+		var got FlexInt
+		err := json.Unmarshal([]byte(tc.json), &got)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("FlexInt %s = %d, want error", tc.json, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("FlexInt %s = %d, %v, want %d", tc.json, got, err, tc.want)
+		}
+	}
+}
+
+func TestFlexString(t *testing.T) {
+	cases := []struct {
+		json    string
+		want    FlexString
+		wantErr bool
+	}{
+		{`"57.069421"`, "57.069421", false},
+		{`57.069421`, "57.069421", false},
+		{`4`, "4", false},
+		{`""`, "", false},
+		{`null`, "", false},
+		{`{}`, "", true},
+	}
+	for _, tc := range cases {
+		var got FlexString
+		err := json.Unmarshal([]byte(tc.json), &got)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("FlexString %s = %q, want error", tc.json, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("FlexString %s = %q, %v, want %q", tc.json, got, err, tc.want)
+		}
+	}
+}
+
+func TestPhotoNumericExtras(t *testing.T) {
+	data := `{"id":"1","latitude":57.1,"longitude":"-3.5","accuracy":16,"license":4,"extra":"kept"}`
+	var p Photo
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Latitude != "57.1" || p.Longitude != "-3.5" || p.Accuracy != "16" || p.License != "4" {
+		t.Errorf("got %+v", p)
+	}
+	out, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != data {
+		t.Errorf("marshalled %s, want the original %s", out, data)
+	}
+}
+
+// A photo with the obsolete video media entries, which have numbers where
+// photos have strings and vice versa
+const sizesWithVideo = `{"canblog":0,"canprint":"0","candownload":1,"size":[
+	{"label":"Small","width":240,"height":"180","source":"https://live.staticflickr.com/1/2_abc_m.jpg","url":"","media":"photo"},
+	{"label":"Video Player","width":{"w":640},"height":360,"source":"https://www.flickr.com/apps/video/stewart.swf","url":"","media":"video"},
+	{"label":"Broken","width":"wide","height":1,"source":"","url":"","media":"photo"}
+]}`
+
+func TestSizesSkipsVideoAndMalformed(t *testing.T) {
+	var sizes Sizes
+	if err := json.Unmarshal([]byte(sizesWithVideo), &sizes); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes.Size) != 2 {
+		t.Fatalf("got %d sizes, want the photo and the video", len(sizes.Size))
+	}
+	if video := sizes.Size[1]; video.Label != "Video Player" || video.Media != "video" {
+		t.Errorf("video size = %+v", video)
+	}
+	photos := sizes.Photos()
+	if len(photos) != 1 || photos[0].Label != "Small" || photos[0].Width != 240 || photos[0].Height != 180 {
+		t.Errorf("Photos() = %+v, want just Small", photos)
+	}
+	if sizes.CanDownload != 1 {
+		t.Errorf("CanDownload = %d, want 1", sizes.CanDownload)
+	}
+
+	out, err := json.Marshal(sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != compact(t, sizesWithVideo) {
+		t.Errorf("marshalled %s, want the original", out)
+	}
+}
+
+const exifJSON = `[
+	{"tagspace":"GPS","tagspaceid":0,"tag":"GPSAltitude","label":"GPS Altitude","raw":{"_content":"1021.4 m"},"clean":{"_content":"1021.4 m"}},
+	{"tagspace":"IFD0","tagspaceid":"0","tag":"Make","label":"Make","raw":{"_content":"Canon"},"unmodelled":true},
+	{"tagspace":"XMP-tiff","tagspaceid":0,"tag":"Make","label":"Make","raw":{"_content":"Canon Inc."}}
+]`
+
+func TestExifRoundTrip(t *testing.T) {
+	var exif Exif
+	if err := json.Unmarshal([]byte(exifJSON), &exif); err != nil {
+		t.Fatal(err)
+	}
+	values := exif.Values()
+	if values["GPSAltitude"] != "1021.4 m" || values["Make"] != "Canon Inc." || len(values) != 2 {
+		t.Errorf("Values() = %v", values)
+	}
+	if string(exif.Raw()) != exifJSON {
+		t.Errorf("Raw() = %s, want the original", exif.Raw())
+	}
+	out, err := json.Marshal(exif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != compact(t, exifJSON) {
+		t.Errorf("marshalled %s, want the original", out)
+	}
+}
+
+func TestGetExif(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		wantRaw  string
+		wantTags int
+	}{
+		{"tags", `{"stat":"ok","photo":{"id":"1","exif":` + exifJSON + `}}`, exifJSON, 3},
+		{"empty", `{"stat":"ok","photo":{"id":"1","exif":[]}}`, `[]`, 0},
+		// Stored as a NULL raw_exif
+		{"missing", `{"stat":"ok","photo":{"id":"1"}}`, ``, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, tc.response)
+			}))
+			defer srv.Close()
+			c, err := NewClient(srv.URL, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Limiter = nil
+
+			exif, err := c.GetExif(context.Background(), "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(exif.Raw()) != tc.wantRaw || (exif.Raw() == nil) != (tc.wantRaw == "") {
+				t.Errorf("Raw() = %q, want %q", exif.Raw(), tc.wantRaw)
+			}
+			if len(exif.Tags) != tc.wantTags {
+				t.Errorf("got %d tags, want %d", len(exif.Tags), tc.wantTags)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"contourguessr-ingest/flickr/flickrfake"
+	flag "github.com/spf13/pflag"
+	"log"
+	"net/http"
+)
+
+var addr = flag.String("addr", "localhost:5060", "Address to listen on")
+var fixtures = flag.String("fixtures", "", "Fixture directory (see package flickrfake)")
+var apiKey = flag.String("api-key", "", "Reject requests without this API key")
+var maxSearchResults = flag.Int("max-search-results", 4000, "Imitate Flickr's limit on how deep searches can be paged (0 to disable)")
+
+func main() {
+	flag.Parse()
+
+	if *fixtures == "" {
+		log.Fatal("Usage: flickr_fake --fixtures <dir>")
+	}
+
+	server, err := flickrfake.Load(*fixtures)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.APIKey = *apiKey
+	server.MaxSearchResults = *maxSearchResults
+
+	log.Println("Listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"context"
 	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/geom"
+	"contourguessr-ingest/notify"
+	"contourguessr-ingest/queue"
+	"contourguessr-ingest/ratelimit"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -14,7 +18,6 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"strconv"
 	"time"
 )
 
@@ -29,17 +32,21 @@ var overlapPeriod = time.Hour * 24
 
 var exifBatchMax = 1000
 
+const legacyExifQueueKey = "cg-flickr-indexer:want-exif"
+
 // Environment variables
 var databaseURL string
 var redisAddr string
 
 // Arguments
 var onlyRegion = flag.Int("only-region", -1, "Only process this region")
+var printStatus = flag.Bool("status", false, "Print indexing progress for each region and exit")
 
 var db *pgx.Conn
 var rdb *redis.Client
-
-// TODO: Add retry logic to flickr.Call
+var fc *flickr.Client
+var allowedLicenses flickr.LicenseSet
+var exifQueue = queue.New(queue.FlickrExif)
 
 func main() {
 	// Environment variables
@@ -75,10 +82,36 @@ func main() {
 	}
 	defer db.Close(ctx)
 
+	if *printStatus {
+		if err := writeStatus(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	allowedLicenses, err = flickr.AllowedLicensesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fc, err = flickr.NewClientFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	rdb = redis.NewClient(&redis.Options{
 		Addr: redisAddr,
 	})
 
+	fc.Limiter, err = ratelimit.FlickrAPI(rdb)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := drainLegacyExifQueue(); err != nil {
+		log.Fatal("failed to drain legacy exif queue", err)
+	}
+
 	initialDelay := time.Duration(rand.Intn(int(maxInitialDelay)))
 	if initialDelay < minInitialDelay {
 		initialDelay = minInitialDelay
@@ -86,6 +119,12 @@ func main() {
 	log.Printf("sleeping for initial delay of %s", initialDelay)
 	time.Sleep(initialDelay)
 
+	listener, err := notify.Listen(ctx, databaseURL, notify.PhotosAccepted, notify.ExifQueued)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close(ctx)
+
 	for {
 		log.Println("starting sizes batch")
 		doSizesBatch()
@@ -99,13 +138,20 @@ func main() {
 		doExifBatch()
 		log.Println("completed exif batch")
 
+		log.Println("starting verify batch")
+		doVerifyBatch()
+		log.Println("completed verify batch")
+
 		log.Println("starting index run")
 		doIndex()
 		log.Println("completed index run")
 
+		// Polling is only a fallback in case we missed a notification
 		loopSleep := loopSleepBase + time.Duration(rand.Intn(30))*time.Second
-		log.Printf("sleeping for %s", loopSleep)
-		time.Sleep(loopSleep)
+		log.Printf("waiting for work for up to %s", loopSleep)
+		if channel := listener.Wait(ctx, loopSleep); channel != "" {
+			log.Printf("woken by %s", channel)
+		}
 	}
 }
 
@@ -114,8 +160,8 @@ func doSizesBatch() {
 	rows, err := db.Query(ctx, `
 		SELECT flickr_id
 		FROM flickr_photos as p
-		LEFT JOIN photo_scores as s ON p.flickr_id = s.flickr_photo_id
-		WHERE s.is_accepted AND p.sizes IS NULL
+		LEFT JOIN current_photo_scores as s ON p.flickr_id = s.flickr_photo_id
+		WHERE s.is_accepted AND p.sizes IS NULL AND p.gone_at IS NULL
 		ORDER BY random()
 		LIMIT 1000
 	`)
@@ -132,10 +178,16 @@ func doSizesBatch() {
 		ids = append(ids, id)
 	}
 
+	saved := 0
 	for _, id := range ids {
 		log.Printf("Getting sizes for %s", id)
-		sizes, err := callFlickrGetSizes(id)
-		if err != nil {
+		sizes, err := fc.GetSizes(ctx, id)
+		if flickr.IsNotFound(err) {
+			if err := markGone(ctx, id, "not found"); err != nil {
+				log.Fatal("failed to mark photo gone", err)
+			}
+			continue
+		} else if err != nil {
 			log.Println("failed to get photo sizes", err)
 			continue
 		}
@@ -147,6 +199,13 @@ func doSizesBatch() {
 		if err != nil {
 			log.Fatal("failed to save sizes", err)
 		}
+		saved++
+	}
+
+	if saved > 0 {
+		if err := notify.Notify(ctx, db, notify.PhotosReady); err != nil {
+			log.Fatal(err)
+		}
 	}
 }
 
@@ -155,8 +214,8 @@ func doInfoBatch() {
 	rows, err := db.Query(ctx, `
 		SELECT flickr_id
 		FROM flickr_photos as p
-		LEFT JOIN photo_scores as s ON p.flickr_id = s.flickr_photo_id
-		WHERE s.is_accepted AND p.info IS NULL
+		LEFT JOIN current_photo_scores as s ON p.flickr_id = s.flickr_photo_id
+		WHERE s.is_accepted AND p.info IS NULL AND p.gone_at IS NULL
 		ORDER BY random()
 		LIMIT 1000
 	`)
@@ -173,59 +232,147 @@ func doInfoBatch() {
 		ids = append(ids, id)
 	}
 
+	saved := 0
 	for _, id := range ids {
 		log.Printf("Getting info for %s", id)
-		info, err := callFlickrGetInfo(id)
-		if err != nil {
+		info, err := fc.GetInfo(ctx, id)
+		if flickr.IsNotFound(err) {
+			if err := markGone(ctx, id, "not found"); err != nil {
+				log.Fatal("failed to mark photo gone", err)
+			}
+			continue
+		} else if err != nil {
 			log.Println("failed to get photo info", err)
 			continue
 		}
 
-		_, err = db.Exec(ctx, `
-			UPDATE flickr_photos SET info = $2
-			WHERE flickr_id = $1
-		`, id, info)
-		if err != nil {
+		if err := saveInfo(ctx, id, info, false); err != nil {
 			log.Fatal("failed to save info", err)
 		}
+		saved++
+	}
+
+	if saved > 0 {
+		if err := notify.Notify(ctx, db, notify.PhotosReady); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// saveInfo stores info along with the license and owner it reports, which
+// may have changed since the photo was indexed.
+func saveInfo(ctx context.Context, flickrID string, info *flickr.PhotoInfo, verified bool) error {
+	var license *int
+	if id, ok := flickr.ParseLicenseID(string(info.License)); ok {
+		license = &id
 	}
+	_, err := db.Exec(ctx, `
+		UPDATE flickr_photos
+		SET info = $2, license = $3, owner_name = $4,
+			last_verified_at = CASE WHEN $5::bool THEN CURRENT_TIMESTAMP ELSE last_verified_at END
+		WHERE flickr_id = $1
+	`, flickrID, info, license, info.Owner.Username, verified)
+	return err
 }
 
 func doExifBatch() {
 	ctx := context.Background()
-	for i := 0; i < exifBatchMax; i++ {
-		flickrID, err := rdb.RPop(ctx, "cg-flickr-indexer:want-exif").Result()
-		if errors.Is(err, redis.Nil) {
-			log.Println("want-exif queue empty")
-			break
-		}
-		if err != nil {
-			log.Fatal(err)
+	items, err := exifQueue.Claim(ctx, db, exifBatchMax)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(items) == 0 {
+		log.Println("exif queue empty")
+		return
+	}
+
+	// Fetches are rate limited, so a full batch takes longer than the lease
+	leasedAt := time.Now()
+	saved := 0
+	for len(items) > 0 {
+		if time.Since(leasedAt) > exifQueue.Lease/2 {
+			items, err = exifQueue.Extend(ctx, db, items)
+			if err != nil {
+				log.Fatal(err)
+			}
+			leasedAt = time.Now()
+			if len(items) == 0 {
+				break
+			}
 		}
-		log.Printf("Populating EXIF for %s", flickrID)
+		item := items[0]
+		items = items[1:]
 
-		value, err := callFlickrGetExif(flickrID)
-		if err != nil {
+		log.Printf("Populating EXIF for %s", item.Item)
+
+		value, err := fc.GetExif(ctx, item.Item)
+		var apiErr *flickr.APIError
+		if flickr.IsNotFound(err) {
+			if err := markGone(ctx, item.Item, "not found"); err != nil {
+				log.Fatal("failed to mark photo gone", err)
+			}
+		} else if errors.As(err, &apiErr) && apiErr.Code == flickr.ErrCodePermissionDenied {
+			// The owner has hidden their EXIF, which is as good as having none
+			err = saveExif(ctx, item.Item, flickr.Exif{})
+			if err != nil {
+				log.Fatal("failed to save exif", err)
+			}
+		} else if err != nil {
 			log.Println("failed to get photo exif", err)
+			if err := exifQueue.Fail(ctx, db, item, err); err != nil {
+				log.Fatal(err)
+			}
 			continue
+		} else {
+			err = saveExif(ctx, item.Item, value)
+			if err != nil {
+				log.Fatal("failed to save exif", err)
+			}
 		}
 
-		err = saveExif(ctx, flickrID, value)
-		if err != nil {
-			log.Fatal("failed to save exif", err)
+		if err := exifQueue.Ack(ctx, db, item.Item); err != nil {
+			log.Fatal(err)
+		}
+		saved++
+	}
+
+	if saved > 0 {
+		if err := notify.Notify(ctx, db, notify.ExifFetched); err != nil {
+			log.Fatal(err)
 		}
 	}
 }
 
-func saveExif(ctx context.Context, flickrID string, value exifData) error {
-	valuesJSON, err := json.Marshal(value.Values)
-	if err != nil {
-		return err
+// drainLegacyExifQueue moves anything left in the Redis list the scorer used
+// to push to into exifQueue.
+func drainLegacyExifQueue() error {
+	ctx := context.Background()
+	for {
+		ids, err := rdb.RPopCount(ctx, legacyExifQueueKey, 1000).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		added, err := exifQueue.Enqueue(ctx, db, ids...)
+		if err != nil {
+			// Put them back so they aren't lost
+			if err := rdb.RPush(ctx, legacyExifQueueKey, ids).Err(); err != nil {
+				log.Println("failed to restore legacy exif queue entries", err)
+			}
+			return err
+		}
+		log.Printf("Moved %d legacy exif queue entries (%d new)", len(ids), added)
 	}
-	_, err = db.Exec(ctx, `
+}
+
+// saveExif stores a NULL raw_exif if the response had no EXIF.
+func saveExif(ctx context.Context, flickrID string, value flickr.Exif) error {
+	// As []byte, as pgx would encode a nil json.RawMessage as JSON null
+	_, err := db.Exec(ctx, `
 		UPDATE flickr_photos SET raw_exif = $2, exif = $3
 		WHERE flickr_id = $1
-	`, flickrID, value.Raw, valuesJSON)
+	`, flickrID, []byte(value.Raw()), value.Values())
 	return err
 }
 
@@ -245,109 +392,9 @@ func doIndex() {
 			continue
 		}
 
-		if region.LatestRequest.Valid && time.Since(region.LatestRequest.Time) < minCheckInterval {
-			log.Printf("Skipping %+v", region)
-			continue
-		}
-
-		bbox := fmt.Sprintf("%f,%f,%f,%f", region.MinLng, region.MinLat, region.MaxLng, region.MaxLat)
-
-		var startDate time.Time
-		if !region.LatestRequest.Valid {
-			log.Printf("No progress for region %d, starting from %s", region.RegionID, minDate)
-			startDate = minDate
-		} else {
-			startDate = region.LatestRequest.Time.Add(-overlapPeriod)
-			log.Printf("Resuming region %d from %s", region.RegionID, startDate)
-			if startDate.Before(minDate) {
-				startDate = minDate
-				log.Printf("Clamping to %s", startDate)
-			}
-		}
-
-		// We search in steps of 300 days because flickr seems to limit searches to the
-		// low hundreds of pages. This is clumsy but ends up working for our region sizes.
-		// By searching in a step that doesn't line up with seasons we ensure in the long run the distribution is okay.
-
-		latestRequest := startDate
-		stepSize := time.Hour * 24 * 300
-		for stepStart := startDate; !stepStart.After(indexTime); stepStart = stepStart.Add(stepSize) {
-			stepEnd := stepStart.Add(stepSize)
-			if stepEnd.After(indexTime) {
-				stepEnd = indexTime
-			}
-			log.Printf("Downloading region %d %s to %s", region.RegionID, stepStart, stepEnd)
-			for page := 1; ; page++ {
-				resp, err := callFlickrSearch(bbox, stepStart, stepEnd, page)
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				log.Printf("Processing page %d of %d", resp.Photos.Page, resp.Photos.Pages)
-
-				for _, photo := range resp.Photos.Photo {
-					var p flickr.Photo
-					if err := json.Unmarshal(photo, &p); err != nil {
-						log.Printf("Failed to unmarshal photo: %s (got %s)", err, photo)
-					}
-
-					dateUploadInt, err := strconv.ParseInt(p.DateUpload, 10, 64)
-					if err != nil {
-						log.Printf("Failed to parse dateupload: %s (got %s)", err, p.DateUpload)
-						continue
-					}
-					dateUpload := time.Unix(dateUploadInt, 0)
-
-					if dateUploadInt > latestRequest.Unix() {
-						latestRequest = dateUpload
-					}
-
-					lng, err := strconv.ParseFloat(p.Longitude, 64)
-					if err != nil {
-						log.Printf("Failed to parse longitude: %s (got %s)", err, p.Longitude)
-						continue
-					}
-					lat, err := strconv.ParseFloat(p.Latitude, 64)
-					if err != nil {
-						log.Printf("Failed to parse latitude: %s (got %s)", err, p.Latitude)
-						continue
-					}
-					accuracy, err := strconv.ParseInt(p.Accuracy, 10, 64)
-					if err != nil {
-						log.Printf("Failed to parse accuracy: %s (got %s)", err, p.Accuracy)
-						continue
-					}
-
-					inside, err := queryPointInsideRegion(lng, lat, region)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					if !inside {
-						continue
-					}
-
-					err = savePhoto(p.ID, lng, lat, int(accuracy), photo, region.RegionID)
-					if err != nil {
-						log.Printf("Failed to save photo %s: %s", p.ID, err)
-					}
-				}
-
-				err = updateProgress(region.RegionID, latestRequest)
-				if err != nil {
-					log.Fatal("failed to update progress", err)
-				}
-
-				if resp.Photos.Page >= resp.Photos.Pages {
-					break
-				}
-			}
-
-			latestRequest = stepEnd
-			err = updateProgress(region.RegionID, latestRequest)
-			if err != nil {
-				log.Fatal("failed to update progress", err)
-			}
+		// A failure here is resumed from the last completed page next run
+		if err := indexRegion(region, indexTime); err != nil {
+			log.Printf("Failed to index region %d: %s", region.RegionID, err)
 		}
 	}
 }
@@ -359,11 +406,14 @@ type regionProgress struct {
 	MinLat        float64
 	MaxLng        float64
 	MaxLat        float64
+	Geo           geom.MultiPolygon
+	GeoBounds     geom.BBox
 }
 
 func listRegions() ([]regionProgress, error) {
 	rows, err := db.Query(context.Background(), `
-		SELECT r.id, p.latest_request, r.min_lng, r.min_lat, r.max_lng, r.max_lat
+		SELECT r.id, p.latest_request, r.min_lng, r.min_lat, r.max_lng, r.max_lat,
+		       ST_AsGeoJSON(r.geo::geometry)
 		FROM regions as r
 		LEFT JOIN flickr_indexer_progress as p ON r.id = p.region_id
 `)
@@ -375,140 +425,96 @@ func listRegions() ([]regionProgress, error) {
 	var regions []regionProgress
 	for rows.Next() {
 		var r regionProgress
+		var geoJSON []byte
 		if err := rows.Scan(&r.RegionID, &r.LatestRequest,
 			&r.MinLng, &r.MinLat, &r.MaxLng, &r.MaxLat,
+			&geoJSON,
 		); err != nil {
 			return nil, err
 		}
+		if geoJSON == nil {
+			log.Printf("Skipping region %d as it has no geometry", r.RegionID)
+			continue
+		}
+		r.Geo, err = geom.ParseGeoJSON(geoJSON)
+		if err != nil {
+			return nil, fmt.Errorf("region %d: %w", r.RegionID, err)
+		}
+		r.GeoBounds = r.Geo.Bounds()
 		regions = append(regions, r)
 	}
 	return regions, nil
 }
 
-func queryPointInsideRegion(lng, lat float64, region regionProgress) (bool, error) {
-	// It's a bit silly to do a whole database round trip just for this but there
-	// isn't a good go library that supports this check.
-	row := db.QueryRow(context.Background(), `
-		SELECT ST_Covers(geo, ST_Point($1, $2, 4326))
-		FROM regions
-		WHERE id = $3
-`, lng, lat, region.RegionID)
-	var inside bool
-	if err := row.Scan(&inside); err != nil {
-		return false, err
-	}
-	return inside, nil
-}
-
-func savePhoto(id string, lng, lat float64, accuracy int, summary json.RawMessage, regionId int) error {
-	_, err := db.Exec(context.Background(), `
-		INSERT INTO flickr_photos (flickr_id, geo, geo_accuracy, summary, region_id)
-		VALUES ($1, ST_Point($2, $3, 4326), $4, $5, $6)
-		ON CONFLICT (flickr_id) DO NOTHING
-`, id, lng, lat, accuracy, summary, regionId)
-	return err
+func (r regionProgress) covers(lng, lat float64) bool {
+	p := geom.Point{Lng: lng, Lat: lat}
+	return r.GeoBounds.Contains(p) && r.Geo.Covers(p)
 }
 
-func updateProgress(regionID int, latestRequest time.Time) error {
-	_, err := db.Exec(context.Background(), `
-		INSERT INTO flickr_indexer_progress (region_id, latest_request)
-		VALUES ($1, $2)
-		ON CONFLICT (region_id) DO UPDATE SET latest_request = $2
-	`, regionID, latestRequest)
-	return err
+type newPhoto struct {
+	ID        string
+	Lng       float64
+	Lat       float64
+	Accuracy  int
+	License   *int
+	OwnerName string
+	Summary   json.RawMessage
+	RegionID  int
 }
 
-type flickrSearchPage struct {
-	Photos struct {
-		Page    int               `json:"page"`
-		Pages   int               `json:"pages"`
-		PerPage int               `json:"perpage"`
-		Total   int               `json:"total"`
-		Photo   []json.RawMessage `json:"photo"`
-	} `json:"photos"`
-}
+// savePhotos inserts photos in a single batch, returning how many were new.
+func savePhotos(photos []newPhoto) (int, error) {
+	if len(photos) == 0 {
+		return 0, nil
+	}
 
-func callFlickrSearch(bbox string, stepStart, stepEnd time.Time, page int) (flickrSearchPage, error) {
-	var resp flickrSearchPage
-	err := flickr.Call("flickr.photos.search", &resp, map[string]string{
-		"bbox":            bbox,
-		"min_upload_date": fmt.Sprintf("%d", stepStart.Unix()),
-		"max_upload_date": fmt.Sprintf("%d", stepEnd.Unix()),
-		"sort":            "date-posted-asc",
-		"safe_search":     "1",
-		"content_type":    "1", // photos only
-		"extras":          "geo,date_upload,date_taken",
-		"page":            fmt.Sprintf("%d", page),
-	})
-	return resp, err
-}
+	batch := &pgx.Batch{}
+	for _, p := range photos {
+		batch.Queue(`
+			INSERT INTO flickr_photos (flickr_id, geo, geo_accuracy, license, owner_name, summary, region_id)
+			VALUES ($1, ST_Point($2, $3, 4326), $4, $5, $6, $7, $8)
+			ON CONFLICT (flickr_id) DO NOTHING
+		`, p.ID, p.Lng, p.Lat, p.Accuracy, p.License, p.OwnerName, p.Summary, p.RegionID)
+	}
 
-type exifData struct {
-	Values map[string]string
-	Raw    json.RawMessage
-}
+	results := db.SendBatch(context.Background(), batch)
+	defer results.Close()
 
-func callFlickrGetExif(photoID string) (out exifData, err error) {
-	var resp struct {
-		Photo struct {
-			Exif json.RawMessage `json:"exif"`
-		} `json:"photo"`
+	inserted := 0
+	for _, p := range photos {
+		tag, err := results.Exec()
+		if err != nil {
+			return 0, fmt.Errorf("insert %s: %w", p.ID, err)
+		}
+		inserted += int(tag.RowsAffected())
 	}
-	err = flickr.Call("flickr.photos.getExif", &resp, map[string]string{
-		"photo_id": photoID,
-	})
-	if err != nil {
-		return
+	if err := results.Close(); err != nil {
+		return 0, err
 	}
-	out.Raw = resp.Photo.Exif
 
-	var parsed []struct {
-		Raw struct {
-			Content string `json:"_content"`
-		} `json:"raw"`
-		Tag        string `json:"tag"`
-		Label      string `json:"label"`
-		TagSpace   string `json:"tagspace"`
-		TagSpaceID int    `json:"tagspaceid"`
-	}
-	if resp.Photo.Exif != nil {
-		if err = json.Unmarshal(resp.Photo.Exif, &parsed); err != nil {
-			return
+	if inserted > 0 {
+		if err := notify.Notify(context.Background(), db, notify.PhotosIndexed); err != nil {
+			return 0, err
 		}
 	}
-
-	out.Values = make(map[string]string)
-	for _, value := range parsed {
-		out.Values[value.Tag] = value.Raw.Content
-	}
-
-	return
+	return inserted, nil
 }
 
-func callFlickrGetSizes(photoID string) (json.RawMessage, error) {
-	var resp struct {
-		Sizes json.RawMessage `json:"sizes"`
-	}
-	err := flickr.Call("flickr.photos.getSizes", &resp, map[string]string{
-		"photo_id": photoID,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return resp.Sizes, nil
+func updateProgress(conn execer, regionID int, latestRequest time.Time) error {
+	_, err := conn.Exec(context.Background(), `
+		INSERT INTO flickr_indexer_progress (region_id, latest_request)
+		VALUES ($1, $2)
+		ON CONFLICT (region_id) DO UPDATE SET latest_request = $2
+	`, regionID, latestRequest)
+	return err
 }
 
-func callFlickrGetInfo(photoID string) (json.RawMessage, error) {
-	var resp struct {
-		Photo json.RawMessage `json:"photo"`
-	}
-	err := flickr.Call("flickr.photos.getInfo", &resp, map[string]string{
-		"photo_id": photoID,
+func callFlickrSearch(bbox [4]float64, stepStart, stepEnd time.Time, page int) (*flickr.SearchPage, error) {
+	return fc.Search(context.Background(), flickr.SearchParams{
+		BBox:          bbox,
+		MinUploadDate: stepStart,
+		MaxUploadDate: stepEnd,
+		Extras:        []string{"geo", "date_upload", "date_taken", "license", "owner_name"},
+		Page:          page,
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return resp.Photo, nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// writeStatus prints a table of each region's indexing progress, including
+// how far through any unfinished run it is.
+func writeStatus(out io.Writer) error {
+	rows, err := db.Query(context.Background(), `
+		SELECT r.id, r.name, p.latest_request,
+		       root.min_upload, root.max_upload, root.inserted_at,
+		       count(w.id) FILTER (WHERE w.split IS NULL),
+		       count(w.id) FILTER (WHERE w.split IS NULL AND w.completed_at IS NOT NULL),
+		       coalesce(sum(w.last_page) FILTER (WHERE w.split IS NULL), 0),
+		       coalesce(sum(w.pages) FILTER (WHERE w.split IS NULL), 0),
+		       count(w.id) FILTER (WHERE w.split IS NULL AND w.pages IS NULL)
+		FROM regions AS r
+				 LEFT JOIN flickr_indexer_progress AS p ON p.region_id = r.id
+				 LEFT JOIN LATERAL (SELECT id, min_upload, max_upload, inserted_at
+									FROM flickr_indexer_windows
+									WHERE region_id = r.id AND parent_id IS NULL AND completed_at IS NULL
+									ORDER BY id DESC
+									LIMIT 1) AS root ON true
+				 LEFT JOIN flickr_indexer_windows AS w ON w.region_id = r.id AND w.inserted_at >= root.inserted_at
+		GROUP BY r.id, r.name, p.latest_request, root.min_upload, root.max_upload, root.inserted_at
+		ORDER BY r.name
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "REGION\tLATEST REQUEST\tRUN\tWINDOWS\tPAGES")
+	for rows.Next() {
+		var id int
+		var name sql.NullString
+		var latestRequest, runStart, runEnd, runInserted sql.NullTime
+		var windows, windowsDone, pagesDone, pagesKnown, windowsUnsearched int
+		err := rows.Scan(&id, &name, &latestRequest, &runStart, &runEnd, &runInserted,
+			&windows, &windowsDone, &pagesDone, &pagesKnown, &windowsUnsearched)
+		if err != nil {
+			return err
+		}
+
+		latest := "never"
+		if latestRequest.Valid {
+			latest = latestRequest.Time.Format("2006-01-02 15:04")
+		}
+
+		run, windowsText, pagesText := "-", "-", "-"
+		if runStart.Valid {
+			run = fmt.Sprintf("%s to %s (started %s)",
+				runStart.Time.Format("2006-01-02"), runEnd.Time.Format("2006-01-02"),
+				runInserted.Time.Format("2006-01-02 15:04"))
+			windowsText = fmt.Sprintf("%d/%d", windowsDone, windows)
+			pagesText = fmt.Sprintf("%d/%d", pagesDone, pagesKnown)
+			if windowsUnsearched > 0 {
+				pagesText += fmt.Sprintf(" (+%d windows unsearched)", windowsUnsearched)
+			}
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s (%d)\t%s\t%s\t%s\t%s\n", name.String, id, latest, run, windowsText, pagesText)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return tw.Flush()
+}
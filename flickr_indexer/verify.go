@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/flickr"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var verifyInterval = time.Hour * 24 * 30
+var verifyBatchMax = 500
+
+// doVerifyBatch re-fetches info for photos backing live challenges, retiring
+// the challenges of any photo that has since been deleted, made private, or
+// relicensed under a license we don't allow.
+func doVerifyBatch() {
+	ctx := context.Background()
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT p.flickr_id, p.verify_attempted_at
+		FROM flickr_photos as p
+		JOIN flickr_challenge_sources as src ON src.flickr_id = p.flickr_id
+		JOIN challenges as c ON c.id = src.challenge_id
+		WHERE c.retired_at IS NULL AND p.gone_at IS NULL
+			AND (p.verify_attempted_at IS NULL OR p.verify_attempted_at < $1)
+		ORDER BY p.verify_attempted_at NULLS FIRST
+		LIMIT $2
+	`, time.Now().Add(-verifyInterval), verifyBatchMax)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		var attemptedAt *time.Time
+		if err := rows.Scan(&id, &attemptedAt); err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, id := range ids {
+		log.Printf("Verifying %s", id)
+		// Recorded up front so a photo that fails below waits its turn
+		// rather than starving the rest of the batch
+		if err := recordVerifyAttempt(ctx, id); err != nil {
+			log.Fatal("failed to record verify attempt", err)
+		}
+		info, err := fc.GetInfo(ctx, id)
+
+		var goneReason string
+		var apiErr *flickr.APIError
+		if flickr.IsNotFound(err) {
+			goneReason = "not found"
+		} else if errors.As(err, &apiErr) && apiErr.Code == flickr.ErrCodePermissionDenied {
+			goneReason = "permission denied"
+		} else if err != nil {
+			log.Println("failed to verify photo", err)
+			continue
+		} else if info.Visibility.IsPublic == 0 {
+			goneReason = "not public"
+		}
+
+		if goneReason != "" {
+			log.Printf("Photo %s is gone (%s)", id, goneReason)
+			if err := markGone(ctx, id, goneReason); err != nil {
+				log.Fatal("failed to mark photo gone", err)
+			}
+			continue
+		}
+
+		if err := saveInfo(ctx, id, info, true); err != nil {
+			log.Fatal("failed to save verified info", err)
+		}
+
+		license, ok := flickr.ParseLicenseID(string(info.License))
+		if ok && !allowedLicenses.Allows(license) {
+			log.Printf("Photo %s was relicensed to %d", id, license)
+			if err := retireChallenges(ctx, db, id, fmt.Sprintf("flickr photo relicensed to %d", license)); err != nil {
+				log.Fatal("failed to retire challenges", err)
+			}
+		}
+	}
+}
+
+func recordVerifyAttempt(ctx context.Context, flickrID string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE flickr_photos SET verify_attempted_at = CURRENT_TIMESTAMP
+		WHERE flickr_id = $1
+	`, flickrID)
+	return err
+}
+
+func markGone(ctx context.Context, flickrID string, reason string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE flickr_photos
+		SET gone_at = CURRENT_TIMESTAMP, gone_reason = $2, last_verified_at = CURRENT_TIMESTAMP
+		WHERE flickr_id = $1
+	`, flickrID, reason)
+	if err != nil {
+		return err
+	}
+
+	if err := retireChallenges(ctx, tx, flickrID, "flickr photo "+reason); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// retireChallenges retires the live challenges built from flickrID.
+func retireChallenges(ctx context.Context, conn execer, flickrID string, reason string) error {
+	tag, err := conn.Exec(ctx, `
+		UPDATE challenges
+		SET retired_at = CURRENT_TIMESTAMP, retired_reason = $2
+		WHERE retired_at IS NULL
+			AND id IN (SELECT challenge_id FROM flickr_challenge_sources WHERE flickr_id = $1)
+	`, flickrID, reason)
+	if err != nil {
+		return err
+	}
+	log.Printf("Retired %d challenges based on %s", tag.RowsAffected(), flickrID)
+	return nil
+}
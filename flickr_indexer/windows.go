@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/flickr"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Flickr only lets you page through roughly the first 4000 results of a
+// search, no matter how many it reports in total. We split any window with
+// more results than this until each piece can be fully paged.
+const maxSearchResults = 4000
+
+// Below this we split the bbox rather than the date range. Bursts of uploads
+// (e.g. someone importing an old library) can exceed the limit in minutes.
+var minDateSplit = time.Hour
+
+// Each bbox split quarters the area, so this allows windows down to 1/256th of
+// a region.
+const maxBBoxDepth = 4
+
+// How many pages in a row of already indexed photos end the re-scan of an
+// overlap window. The overlap is there to catch photos Flickr indexed late,
+// which are searched by their upload date and so can turn up on any page, not
+// just the first. A few pages rather than one lowers the chance of stopping
+// before one of them, but any on later pages will be missed.
+const overlapKnownPages = 3
+
+// A searchWindow is a row of flickr_indexer_windows. Each index run of a
+// region starts with a root window covering the whole region since the last
+// run, which is split into children until every leaf can be paged through.
+// Leaves record the last page processed so an interrupted run resumes where
+// it left off.
+type searchWindow struct {
+	ID       int64
+	ParentID *int64
+	RegionID int
+	BBox     [4]float64
+	Start    time.Time
+	End      time.Time
+	// BBoxDepth is how many times the region's bbox has been quartered
+	BBoxDepth int
+	// Pages is nil until the window has been searched
+	Pages    *int
+	LastPage int
+}
+
+// windowStore saves what indexWindow finds and records its progress. Outside
+// tests it is dbWindowStore.
+type windowStore interface {
+	savePhotos(photos []newPhoto) (int, error)
+	splitWindow(w searchWindow, split string, total int, children []searchWindow) error
+	checkpointWindow(w searchWindow, total int, page int) error
+	completeWindow(w searchWindow) error
+}
+
+type dbWindowStore struct{}
+
+func (dbWindowStore) savePhotos(photos []newPhoto) (int, error) { return savePhotos(photos) }
+
+func (dbWindowStore) splitWindow(w searchWindow, split string, total int, children []searchWindow) error {
+	return splitWindow(w, split, total, children)
+}
+
+func (dbWindowStore) checkpointWindow(w searchWindow, total int, page int) error {
+	return checkpointWindow(w, total, page)
+}
+
+func (dbWindowStore) completeWindow(w searchWindow) error { return completeWindow(w) }
+
+func (w searchWindow) String() string {
+	return fmt.Sprintf("region %d %s to %s bbox %v", w.RegionID, w.Start, w.End, w.BBox)
+}
+
+// indexRegion resumes any unfinished run for region, or otherwise starts a
+// new one from where the last run ended.
+func indexRegion(region regionProgress, indexTime time.Time) error {
+	pending, err := nextPendingWindow(region.RegionID)
+	if err != nil {
+		return err
+	}
+
+	if pending != nil {
+		log.Printf("Resuming unfinished run for region %d", region.RegionID)
+	} else {
+		if region.LatestRequest.Valid && time.Since(region.LatestRequest.Time) < minCheckInterval {
+			log.Printf("Skipping %+v", region)
+			return nil
+		}
+
+		var startDate time.Time
+		if !region.LatestRequest.Valid {
+			log.Printf("No progress for region %d, starting from %s", region.RegionID, minDate)
+			startDate = minDate
+		} else {
+			startDate = region.LatestRequest.Time.Add(-overlapPeriod)
+			log.Printf("Resuming region %d from %s", region.RegionID, startDate)
+			if startDate.Before(minDate) {
+				startDate = minDate
+				log.Printf("Clamping to %s", startDate)
+			}
+		}
+
+		root := searchWindow{
+			RegionID: region.RegionID,
+			BBox:     [4]float64{region.MinLng, region.MinLat, region.MaxLng, region.MaxLat},
+			Start:    startDate,
+			End:      indexTime,
+		}
+		roots := []searchWindow{root}
+		if region.LatestRequest.Valid && region.LatestRequest.Time.After(startDate) {
+			// Search the overlap with the previous run separately so we can stop
+			// once it turns out to be already indexed.
+			overlap := root
+			overlap.End = region.LatestRequest.Time
+			root.Start = region.LatestRequest.Time
+			roots = []searchWindow{overlap, root}
+		}
+		if err := insertWindows(db, roots); err != nil {
+			return err
+		}
+	}
+
+	for {
+		w, err := nextPendingWindow(region.RegionID)
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			return nil
+		}
+		if err := indexWindow(dbWindowStore{}, region, *w); err != nil {
+			return err
+		}
+	}
+}
+
+// indexWindow searches w, splitting it if Flickr reports too many results to
+// page through. Progress is checkpointed after every page.
+func indexWindow(store windowStore, region regionProgress, w searchWindow) error {
+	page := w.LastPage + 1
+
+	// Windows that end before the previous run did are re-scanning the
+	// overlap, and stop after overlapKnownPages pages in a row of photos we
+	// already have.
+	isOverlap := region.LatestRequest.Valid && !w.End.After(region.LatestRequest.Time)
+	knownPages := 0
+	alreadyIndexed := func(inserted, known int) bool {
+		if inserted > 0 || known == 0 {
+			knownPages = 0
+			return false
+		}
+		knownPages++
+		return isOverlap && knownPages >= overlapKnownPages
+	}
+
+	if w.Pages == nil {
+		first, err := callFlickrSearch(w.BBox, w.Start, w.End, 1)
+		if err != nil {
+			return fmt.Errorf("search %s: %w", w, err)
+		}
+
+		if split, children := planSplit(w, first.Total); split != "" {
+			log.Printf("Splitting %s of %s (%d results)", split, w, first.Total)
+			return store.splitWindow(w, split, first.Total, children)
+		} else if first.Total > maxSearchResults {
+			log.Printf("Warning: %s has %d results but can't be split further, some will be missed", w, first.Total)
+		}
+
+		pages := first.Pages
+		if first.PerPage > 0 {
+			pages = min(pages, (maxSearchResults+first.PerPage-1)/first.PerPage)
+		}
+		w.Pages = &pages
+
+		log.Printf("Downloading %s (%d results)", w, first.Total)
+
+		inserted, known, err := processSearchPage(store, region, first)
+		if err != nil {
+			return err
+		}
+		if err := store.checkpointWindow(w, first.Total, 1); err != nil {
+			return err
+		}
+		if alreadyIndexed(inserted, known) {
+			log.Printf("Overlap %s is already indexed, skipping remaining pages", w)
+			return store.completeWindow(w)
+		}
+		page = 2
+	}
+
+	for ; page <= *w.Pages; page++ {
+		resp, err := callFlickrSearch(w.BBox, w.Start, w.End, page)
+		if err != nil {
+			return fmt.Errorf("search %s: %w", w, err)
+		}
+
+		log.Printf("Processing page %d of %d", page, *w.Pages)
+
+		inserted, known, err := processSearchPage(store, region, resp)
+		if err != nil {
+			return err
+		}
+		if err := store.checkpointWindow(w, resp.Total, page); err != nil {
+			return err
+		}
+		if alreadyIndexed(inserted, known) {
+			log.Printf("Overlap %s is already indexed, skipping remaining pages", w)
+			break
+		}
+	}
+
+	return store.completeWindow(w)
+}
+
+// planSplit decides whether a window with total results must be split to be
+// paged through, returning how ("date" or "bbox") and the children. The date
+// range is halved until it is shorter than minDateSplit, then the bbox is
+// quartered up to maxBBoxDepth times. It returns "" if the window can be
+// searched as is, or can't be split further.
+func planSplit(w searchWindow, total int) (string, []searchWindow) {
+	if total <= maxSearchResults {
+		return "", nil
+	}
+
+	if w.End.Sub(w.Start) > minDateSplit {
+		mid := w.Start.Add(w.End.Sub(w.Start) / 2).Truncate(time.Second)
+		before := w
+		before.End = mid
+		after := w
+		after.Start = mid
+		return "date", []searchWindow{before, after}
+	}
+
+	if w.BBoxDepth < maxBBoxDepth {
+		var children []searchWindow
+		for _, quadrant := range quarterBBox(w.BBox) {
+			child := w
+			child.BBox = quadrant
+			child.BBoxDepth++
+			children = append(children, child)
+		}
+		return "bbox", children
+	}
+
+	return "", nil
+}
+
+// processSearchPage saves the photos in page that fall inside region,
+// returning how many were new and how many we already had.
+func processSearchPage(store windowStore, region regionProgress, page *flickr.SearchPage) (inserted int, known int, err error) {
+	var photos []newPhoto
+	for _, p := range page.Photo {
+		lng, err := strconv.ParseFloat(p.Longitude, 64)
+		if err != nil {
+			log.Printf("Failed to parse longitude: %s (got %s)", err, p.Longitude)
+			continue
+		}
+		lat, err := strconv.ParseFloat(p.Latitude, 64)
+		if err != nil {
+			log.Printf("Failed to parse latitude: %s (got %s)", err, p.Latitude)
+			continue
+		}
+		accuracy, err := strconv.ParseInt(p.Accuracy, 10, 64)
+		if err != nil {
+			log.Printf("Failed to parse accuracy: %s (got %s)", err, p.Accuracy)
+			continue
+		}
+
+		if !region.covers(lng, lat) {
+			continue
+		}
+
+		var license *int
+		if id, ok := flickr.ParseLicenseID(p.License); ok {
+			license = &id
+		} else {
+			log.Printf("Photo %s has no license (got %q)", p.ID, p.License)
+		}
+
+		photos = append(photos, newPhoto{
+			ID:        p.ID,
+			Lng:       lng,
+			Lat:       lat,
+			Accuracy:  int(accuracy),
+			License:   license,
+			OwnerName: p.OwnerName,
+			Summary:   p.Raw(),
+			RegionID:  region.RegionID,
+		})
+	}
+
+	inserted, err = store.savePhotos(photos)
+	if err != nil {
+		return 0, 0, fmt.Errorf("save photos: %w", err)
+	}
+	known = len(photos) - inserted
+	log.Printf("Page %d: %d of %d results in region, %d new, %d already known",
+		page.Page, len(photos), len(page.Photo), inserted, known)
+	return inserted, known, nil
+}
+
+func quarterBBox(bbox [4]float64) [4][4]float64 {
+	midLng := (bbox[0] + bbox[2]) / 2
+	midLat := (bbox[1] + bbox[3]) / 2
+	return [4][4]float64{
+		{bbox[0], bbox[1], midLng, midLat},
+		{midLng, bbox[1], bbox[2], midLat},
+		{bbox[0], midLat, midLng, bbox[3]},
+		{midLng, midLat, bbox[2], bbox[3]},
+	}
+}
+
+func nextPendingWindow(regionID int) (*searchWindow, error) {
+	var w searchWindow
+	err := db.QueryRow(context.Background(), `
+		SELECT id, parent_id, region_id, min_lng, min_lat, max_lng, max_lat,
+		       min_upload, max_upload, bbox_depth, pages, last_page
+		FROM flickr_indexer_windows
+		WHERE region_id = $1 AND completed_at IS NULL AND split IS NULL
+		ORDER BY min_upload, id
+		LIMIT 1
+	`, regionID).Scan(&w.ID, &w.ParentID, &w.RegionID, &w.BBox[0], &w.BBox[1], &w.BBox[2], &w.BBox[3],
+		&w.Start, &w.End, &w.BBoxDepth, &w.Pages, &w.LastPage)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("load pending window: %w", err)
+	}
+	return &w, nil
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+func insertWindows(conn execer, windows []searchWindow) error {
+	for _, w := range windows {
+		_, err := conn.Exec(context.Background(), `
+			INSERT INTO flickr_indexer_windows
+				(region_id, parent_id, min_lng, min_lat, max_lng, max_lat, min_upload, max_upload, bbox_depth)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`, w.RegionID, w.ParentID, w.BBox[0], w.BBox[1], w.BBox[2], w.BBox[3], w.Start, w.End, w.BBoxDepth)
+		if err != nil {
+			return fmt.Errorf("insert window %s: %w", w, err)
+		}
+	}
+	return nil
+}
+
+func splitWindow(w searchWindow, split string, total int, children []searchWindow) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE flickr_indexer_windows SET split = $2, total = $3
+		WHERE id = $1
+	`, w.ID, split, total)
+	if err != nil {
+		return fmt.Errorf("split window %s: %w", w, err)
+	}
+
+	for i := range children {
+		children[i].ParentID = &w.ID
+	}
+	if err := insertWindows(tx, children); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func checkpointWindow(w searchWindow, total int, page int) error {
+	_, err := db.Exec(context.Background(), `
+		UPDATE flickr_indexer_windows SET total = $2, pages = $3, last_page = $4
+		WHERE id = $1
+	`, w.ID, total, w.Pages, page)
+	if err != nil {
+		return fmt.Errorf("checkpoint window %s: %w", w, err)
+	}
+	return nil
+}
+
+// completeWindow marks w completed, along with any ancestors whose children
+// are now all complete. Once the root completes the region's progress is
+// advanced to the end of the run.
+func completeWindow(w searchWindow) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	id := w.ID
+	for {
+		var parentID *int64
+		var end time.Time
+		err := tx.QueryRow(ctx, `
+			UPDATE flickr_indexer_windows SET completed_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+			RETURNING parent_id, max_upload
+		`, id).Scan(&parentID, &end)
+		if err != nil {
+			return fmt.Errorf("complete window %d: %w", id, err)
+		}
+
+		if parentID == nil {
+			if err := updateProgress(tx, w.RegionID, end); err != nil {
+				return fmt.Errorf("update progress: %w", err)
+			}
+			break
+		}
+
+		var siblingsPending bool
+		err = tx.QueryRow(ctx, `
+			SELECT exists(SELECT 1 FROM flickr_indexer_windows WHERE parent_id = $1 AND completed_at IS NULL)
+		`, *parentID).Scan(&siblingsPending)
+		if err != nil {
+			return err
+		}
+		if siblingsPending {
+			break
+		}
+		id = *parentID
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/flickr/flickrfake"
+	"contourguessr-ingest/geom"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a windowStore that keeps everything in memory
+type memStore struct {
+	known       map[string]bool
+	saved       []string
+	checkpoints []int
+	split       string
+	children    []searchWindow
+	completed   bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{known: make(map[string]bool)}
+}
+
+func (s *memStore) savePhotos(photos []newPhoto) (int, error) {
+	inserted := 0
+	for _, p := range photos {
+		s.saved = append(s.saved, p.ID)
+		if !s.known[p.ID] {
+			s.known[p.ID] = true
+			inserted++
+		}
+	}
+	return inserted, nil
+}
+
+func (s *memStore) splitWindow(w searchWindow, split string, total int, children []searchWindow) error {
+	s.split = split
+	s.children = children
+	return nil
+}
+
+func (s *memStore) checkpointWindow(w searchWindow, total int, page int) error {
+	s.checkpoints = append(s.checkpoints, page)
+	return nil
+}
+
+func (s *memStore) completeWindow(w searchWindow) error {
+	s.completed = true
+	return nil
+}
+
+// fakeFlickr points fc at a flickrfake serving fixtures, returning the search
+// pages requested.
+func fakeFlickr(t *testing.T, fixtures []flickrfake.Fixture) func() []int {
+	s, err := flickrfake.New(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var pages []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("method") == "flickr.photos.search" {
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			mu.Lock()
+			pages = append(pages, page)
+			mu.Unlock()
+		}
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	prev := fc
+	fc, err = flickr.NewClient(srv.URL, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Limiter = nil
+	fc.MaxElapsedTime = time.Second
+	t.Cleanup(func() { fc = prev })
+
+	return func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), pages...)
+	}
+}
+
+var testStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// uploads returns n photos uploaded a minute apart from testStart, with ids
+// counting up from first.
+func uploads(first int, n int, lng, lat float64) []flickrfake.Fixture {
+	var out []flickrfake.Fixture
+	for i := 0; i < n; i++ {
+		out = append(out, flickrfake.NewPhoto(strconv.Itoa(first+i), lng, lat, testStart.Add(time.Duration(first+i)*time.Minute)))
+	}
+	return out
+}
+
+// testRegion is a triangle in the lower left of its 0,0 to 2,2 bbox
+func testRegion(t *testing.T) regionProgress {
+	geo, err := geom.ParseGeoJSON([]byte(`{"type":"Polygon","coordinates":[[[0,0],[2,0],[0,2],[0,0]]]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return regionProgress{
+		RegionID:  1,
+		MinLng:    0,
+		MinLat:    0,
+		MaxLng:    2,
+		MaxLat:    2,
+		Geo:       geo,
+		GeoBounds: geo.Bounds(),
+	}
+}
+
+func rootWindow(region regionProgress) searchWindow {
+	return searchWindow{
+		ID:       1,
+		RegionID: region.RegionID,
+		BBox:     [4]float64{region.MinLng, region.MinLat, region.MaxLng, region.MaxLat},
+		Start:    testStart,
+		End:      testStart.Add(30 * 24 * time.Hour),
+	}
+}
+
+func TestIndexWindowAgainstFake(t *testing.T) {
+	var fixtures []flickrfake.Fixture
+	fixtures = append(fixtures, uploads(0, 150, 0.5, 0.5)...)
+	// In the bbox but outside the region
+	fixtures = append(fixtures, uploads(1000, 10, 1.5, 1.5)...)
+	// Outside the bbox
+	fixtures = append(fixtures, uploads(2000, 10, 5, 5)...)
+	requested := fakeFlickr(t, fixtures)
+
+	region := testRegion(t)
+	store := newMemStore()
+	if err := indexWindow(store, region, rootWindow(region)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(requested()); got != "[1 2]" {
+		t.Errorf("requested pages %s, want [1 2]", got)
+	}
+	if got := fmt.Sprint(store.checkpoints); got != "[1 2]" {
+		t.Errorf("checkpointed pages %s, want [1 2]", got)
+	}
+	if len(store.saved) != 150 || len(store.known) != 150 {
+		t.Errorf("saved %d photos (%d distinct), want the 150 in the region", len(store.saved), len(store.known))
+	}
+	for i := 0; i < 150; i++ {
+		if !store.known[strconv.Itoa(i)] {
+			t.Errorf("photo %d not saved", i)
+		}
+	}
+	if !store.completed {
+		t.Error("window not completed")
+	}
+}
+
+func TestPlanSplit(t *testing.T) {
+	bbox := [4]float64{0, 0, 2, 2}
+	window := func(d time.Duration, depth int) searchWindow {
+		return searchWindow{RegionID: 1, BBox: bbox, Start: testStart, End: testStart.Add(d), BBoxDepth: depth}
+	}
+
+	cases := []struct {
+		name  string
+		w     searchWindow
+		total int
+		want  string
+	}{
+		{"under the limit", window(30*24*time.Hour, 0), maxSearchResults, ""},
+		{"long window", window(30*24*time.Hour, 0), maxSearchResults + 1, "date"},
+		{"just over minDateSplit", window(minDateSplit+2*time.Second, 0), maxSearchResults + 1, "date"},
+		{"at minDateSplit", window(minDateSplit, 0), maxSearchResults + 1, "bbox"},
+		{"short split bbox", window(minDateSplit, maxBBoxDepth-1), maxSearchResults + 1, "bbox"},
+		{"max depth", window(minDateSplit, maxBBoxDepth), maxSearchResults + 1, ""},
+		{"max depth but long", window(2*minDateSplit, maxBBoxDepth), maxSearchResults + 1, "date"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			split, children := planSplit(tc.w, tc.total)
+			if split != tc.want {
+				t.Fatalf("split %q, want %q", split, tc.want)
+			}
+
+			switch split {
+			case "":
+				if children != nil {
+					t.Errorf("got children %v without a split", children)
+				}
+			case "date":
+				if len(children) != 2 {
+					t.Fatalf("got %d children, want 2", len(children))
+				}
+				before, after := children[0], children[1]
+				if !before.Start.Equal(tc.w.Start) || !after.End.Equal(tc.w.End) || !before.End.Equal(after.Start) {
+					t.Errorf("children %s and %s don't cover %s", before, after, tc.w)
+				}
+				if before.End.Truncate(time.Second) != before.End {
+					t.Errorf("split at %s, want whole seconds", before.End)
+				}
+				mid := tc.w.Start.Add(tc.w.End.Sub(tc.w.Start) / 2)
+				if d := mid.Sub(before.End); d < 0 || d >= time.Second {
+					t.Errorf("split at %s, want the midpoint %s", before.End, mid)
+				}
+				for _, c := range children {
+					if c.BBox != tc.w.BBox || c.BBoxDepth != tc.w.BBoxDepth {
+						t.Errorf("date split changed the bbox: %s", c)
+					}
+				}
+			case "bbox":
+				want := [][4]float64{{0, 0, 1, 1}, {1, 0, 2, 1}, {0, 1, 1, 2}, {1, 1, 2, 2}}
+				if len(children) != len(want) {
+					t.Fatalf("got %d children, want %d", len(children), len(want))
+				}
+				for i, c := range children {
+					if c.BBox != want[i] || c.BBoxDepth != tc.w.BBoxDepth+1 ||
+						!c.Start.Equal(tc.w.Start) || !c.End.Equal(tc.w.End) {
+						t.Errorf("child %d = %s depth %d, want bbox %v depth %d", i, c, c.BBoxDepth, want[i], tc.w.BBoxDepth+1)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIndexWindowSplits(t *testing.T) {
+	requested := fakeFlickr(t, uploads(0, maxSearchResults+1, 0.5, 0.5))
+
+	region := testRegion(t)
+	store := newMemStore()
+	if err := indexWindow(store, region, rootWindow(region)); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.split != "date" || len(store.children) != 2 {
+		t.Errorf("split %q into %d children, want a date split in 2", store.split, len(store.children))
+	}
+	if got := fmt.Sprint(requested()); got != "[1]" {
+		t.Errorf("requested pages %s, want only the first to count the results", got)
+	}
+	if len(store.saved) != 0 || store.completed {
+		t.Error("a split window shouldn't save photos or complete")
+	}
+}
+
+func TestIndexWindowResumes(t *testing.T) {
+	requested := fakeFlickr(t, uploads(0, 250, 0.5, 0.5))
+
+	region := testRegion(t)
+	w := rootWindow(region)
+	pages := 3
+	w.Pages = &pages
+	w.LastPage = 1
+
+	store := newMemStore()
+	if err := indexWindow(store, region, w); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(requested()); got != "[2 3]" {
+		t.Errorf("requested pages %s, want [2 3] after the checkpoint", got)
+	}
+	if got := fmt.Sprint(store.checkpoints); got != "[2 3]" {
+		t.Errorf("checkpointed pages %s, want [2 3]", got)
+	}
+	// Page 1 was saved before the interruption
+	if len(store.known) != 150 || store.known["99"] || !store.known["100"] || !store.known["249"] {
+		t.Errorf("saved %d photos, want the 150 after the first page", len(store.known))
+	}
+	if !store.completed {
+		t.Error("window not completed")
+	}
+}
+
+func TestIndexWindowResumesCompletedPages(t *testing.T) {
+	requested := fakeFlickr(t, uploads(0, 50, 0.5, 0.5))
+
+	region := testRegion(t)
+	w := rootWindow(region)
+	pages := 1
+	w.Pages = &pages
+	w.LastPage = 1
+
+	// Interrupted after the last checkpoint but before completing
+	store := newMemStore()
+	if err := indexWindow(store, region, w); err != nil {
+		t.Fatal(err)
+	}
+	if got := requested(); len(got) != 0 {
+		t.Errorf("requested pages %v, want none", got)
+	}
+	if !store.completed {
+		t.Error("window not completed")
+	}
+}
+
+func TestIndexWindowStopsInKnownOverlap(t *testing.T) {
+	// Ten pages of photos, all already known unless listed in newPhotos
+	requested := fakeFlickr(t, uploads(0, 1000, 0.5, 0.5))
+
+	cases := []struct {
+		name      string
+		isOverlap bool
+		newPhotos []int
+		want      string
+	}{
+		{"overlap", true, nil, "[1 2 3]"},
+		{"overlap with a late photo", true, []int{150}, "[1 2 3 4 5]"},
+		{"not overlap", false, nil, "[1 2 3 4 5 6 7 8 9 10]"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := len(requested())
+
+			region := testRegion(t)
+			w := rootWindow(region)
+			if tc.isOverlap {
+				region.LatestRequest = sql.NullTime{Time: w.End, Valid: true}
+			} else {
+				region.LatestRequest = sql.NullTime{Time: w.Start, Valid: true}
+			}
+
+			store := newMemStore()
+			for i := 0; i < 1000; i++ {
+				store.known[strconv.Itoa(i)] = true
+			}
+			for _, id := range tc.newPhotos {
+				delete(store.known, strconv.Itoa(id))
+			}
+
+			if err := indexWindow(store, region, w); err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(requested()[before:]); got != tc.want {
+				t.Errorf("requested pages %s, want %s", got, tc.want)
+			}
+			if got := fmt.Sprint(store.checkpoints); got != tc.want {
+				t.Errorf("checkpointed pages %s, want %s", got, tc.want)
+			}
+			if !store.completed {
+				t.Error("window not completed")
+			}
+		})
+	}
+}
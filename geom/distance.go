@@ -0,0 +1,51 @@
+package geom
+
+import "math"
+
+// LineString is a sequence of connected points, such as a road.
+type LineString []Point
+
+// earthRadius is the mean radius in meters
+const earthRadius = 6_371_008.8
+
+// DistanceTo returns the distance in meters from p to the nearest point on
+// the line. It projects onto a plane tangent at p, which is accurate to well
+// under a meter within a few kilometers.
+func (l LineString) DistanceTo(p Point) float64 {
+	if len(l) == 0 {
+		return math.Inf(1)
+	}
+
+	kx := earthRadius * math.Pi / 180 * math.Cos(p.Lat*math.Pi/180)
+	ky := earthRadius * math.Pi / 180
+	project := func(q Point) (float64, float64) {
+		dLng := q.Lng - p.Lng
+		// Handle lines crossing the antimeridian
+		if dLng > 180 {
+			dLng -= 360
+		} else if dLng < -180 {
+			dLng += 360
+		}
+		return dLng * kx, (q.Lat - p.Lat) * ky
+	}
+
+	ax, ay := project(l[0])
+	best := math.Hypot(ax, ay)
+	for _, q := range l[1:] {
+		bx, by := project(q)
+		best = math.Min(best, distanceToSegment(ax, ay, bx, by))
+		ax, ay = bx, by
+	}
+	return best
+}
+
+// distanceToSegment returns the distance from the origin to segment ab.
+func distanceToSegment(ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	lengthSq := dx*dx + dy*dy
+	t := 0.0
+	if lengthSq > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/lengthSq))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
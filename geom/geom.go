@@ -0,0 +1,263 @@
+// Package geom tests whether points fall within polygons, so that we don't
+// need a database round trip per point.
+//
+// Edges are great circle arcs, like PostGIS geography, which is how our
+// regions are stored. Treating them as straight lines in lng/lat would be off
+// by tens of meters over a region-width edge at Scottish latitudes. Polygons
+// must not contain a pole or cross the antimeridian.
+package geom
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+type Point struct {
+	Lng float64
+	Lat float64
+}
+
+// Ring is a closed linear ring. The last point may or may not repeat the first.
+type Ring []Point
+
+// Polygon is an outer ring followed by zero or more holes.
+type Polygon []Ring
+
+type MultiPolygon []Polygon
+
+type BBox struct {
+	MinLng, MinLat, MaxLng, MaxLat float64
+}
+
+// epsilon is how close (in degrees) a point must be to an edge to count as on
+// it. 1e-9 degrees is about 0.1mm.
+const epsilon = 1e-9
+
+// ParseGeoJSON parses a GeoJSON Polygon or MultiPolygon geometry, as returned
+// by ST_AsGeoJSON.
+func ParseGeoJSON(data []byte) (MultiPolygon, error) {
+	var raw struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	switch raw.Type {
+	case "Polygon":
+		var coords [][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &coords); err != nil {
+			return nil, err
+		}
+		poly, err := polygonFromCoords(coords)
+		if err != nil {
+			return nil, err
+		}
+		return MultiPolygon{poly}, nil
+	case "MultiPolygon":
+		var coords [][][][]float64
+		if err := json.Unmarshal(raw.Coordinates, &coords); err != nil {
+			return nil, err
+		}
+		out := make(MultiPolygon, 0, len(coords))
+		for _, polyCoords := range coords {
+			poly, err := polygonFromCoords(polyCoords)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, poly)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("geom: unsupported geometry type %q", raw.Type)
+	}
+}
+
+func polygonFromCoords(coords [][][]float64) (Polygon, error) {
+	if len(coords) == 0 {
+		return nil, fmt.Errorf("geom: polygon has no rings")
+	}
+	poly := make(Polygon, 0, len(coords))
+	for _, ringCoords := range coords {
+		if len(ringCoords) < 3 {
+			return nil, fmt.Errorf("geom: ring has %d points, need at least 3", len(ringCoords))
+		}
+		ring := make(Ring, 0, len(ringCoords))
+		for _, c := range ringCoords {
+			if len(c) < 2 {
+				return nil, fmt.Errorf("geom: position has %d values, need at least 2", len(c))
+			}
+			ring = append(ring, Point{Lng: c[0], Lat: c[1]})
+		}
+		poly = append(poly, ring)
+	}
+	return poly, nil
+}
+
+// Covers reports whether p is inside mp or on its boundary, matching ST_Covers.
+func (mp MultiPolygon) Covers(p Point) bool {
+	for _, poly := range mp {
+		if poly.Covers(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Bounds includes the bulge of edges towards the pole, which can take them
+// beyond their vertices.
+func (mp MultiPolygon) Bounds() BBox {
+	b := BBox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, poly := range mp {
+		if len(poly) == 0 {
+			continue
+		}
+		ring := poly[0]
+		for i, pt := range ring {
+			b.MinLng = math.Min(b.MinLng, pt.Lng)
+			b.MinLat = math.Min(b.MinLat, pt.Lat)
+			b.MaxLng = math.Max(b.MaxLng, pt.Lng)
+			b.MaxLat = math.Max(b.MaxLat, pt.Lat)
+
+			minLat, maxLat := arcLatRange(pt, ring[(i+1)%len(ring)])
+			b.MinLat = math.Min(b.MinLat, minLat)
+			b.MaxLat = math.Max(b.MaxLat, maxLat)
+		}
+	}
+	return b
+}
+
+func (b BBox) Contains(p Point) bool {
+	return p.Lng >= b.MinLng-epsilon && p.Lng <= b.MaxLng+epsilon &&
+		p.Lat >= b.MinLat-epsilon && p.Lat <= b.MaxLat+epsilon
+}
+
+// Covers reports whether p is inside the polygon or on its boundary. A point
+// on the boundary of a hole is on the boundary of the polygon, so is covered.
+func (poly Polygon) Covers(p Point) bool {
+	if len(poly) == 0 {
+		return false
+	}
+
+	switch poly[0].locate(p) {
+	case onBoundary:
+		return true
+	case outside:
+		return false
+	}
+
+	for _, hole := range poly[1:] {
+		switch hole.locate(p) {
+		case onBoundary:
+			return true
+		case inside:
+			return false
+		}
+	}
+	return true
+}
+
+type location int
+
+const (
+	outside location = iota
+	inside
+	onBoundary
+)
+
+// locate casts a ray north from p along its meridian and counts the edges it
+// crosses, after first checking whether p lies on any edge. As meridians are
+// great circles, whether the ray crosses an edge only depends on the latitude
+// of the edge at p's longitude.
+func (r Ring) locate(p Point) location {
+	n := len(r)
+	if n == 0 {
+		return outside
+	}
+
+	in := false
+	for i := 0; i < n; i++ {
+		a := r[i]
+		b := r[(i+1)%n]
+
+		if onArc(p, a, b) {
+			return onBoundary
+		}
+
+		// Half-open on lng so a ray through a vertex is counted exactly once.
+		// Edges along a meridian are never crossed.
+		if (a.Lng > p.Lng) != (b.Lng > p.Lng) {
+			if p.Lat < arcLatAt(a, b, p.Lng) {
+				in = !in
+			}
+		}
+	}
+
+	if in {
+		return inside
+	}
+	return outside
+}
+
+func onArc(p, a, b Point) bool {
+	if math.Abs(b.Lng-a.Lng) <= epsilon {
+		// Along a meridian
+		return math.Abs(p.Lng-a.Lng) <= epsilon &&
+			p.Lat >= math.Min(a.Lat, b.Lat)-epsilon && p.Lat <= math.Max(a.Lat, b.Lat)+epsilon
+	}
+	if p.Lng < math.Min(a.Lng, b.Lng)-epsilon || p.Lng > math.Max(a.Lng, b.Lng)+epsilon {
+		return false
+	}
+	lng := math.Max(math.Min(p.Lng, math.Max(a.Lng, b.Lng)), math.Min(a.Lng, b.Lng))
+	return math.Abs(p.Lat-arcLatAt(a, b, lng)) <= epsilon
+}
+
+// arcLatAt returns the latitude of the great circle through a and b at lng.
+// a and b must be on different meridians.
+func arcLatAt(a, b Point, lng float64) float64 {
+	latA, latB := radians(a.Lat), radians(b.Lat)
+	lngA, lngB, l := radians(a.Lng), radians(b.Lng), radians(lng)
+	tanLat := (math.Tan(latA)*math.Sin(lngB-l) + math.Tan(latB)*math.Sin(l-lngA)) / math.Sin(lngB-lngA)
+	return degrees(math.Atan(tanLat))
+}
+
+// arcLatRange returns the latitude range of the arc from a to b, which may
+// extend beyond a and b where the arc passes its most poleward point.
+func arcLatRange(a, b Point) (float64, float64) {
+	minLat, maxLat := math.Min(a.Lat, b.Lat), math.Max(a.Lat, b.Lat)
+	if math.Abs(b.Lng-a.Lng) <= epsilon {
+		return minLat, maxLat
+	}
+
+	// The great circle's northernmost point is the pole projected onto its
+	// plane, and its southernmost point is opposite that
+	va, vb := toVector(a), toVector(b)
+	nx := va[1]*vb[2] - va[2]*vb[1]
+	ny := va[2]*vb[0] - va[0]*vb[2]
+	nz := va[0]*vb[1] - va[1]*vb[0]
+	top := Point{
+		Lng: degrees(math.Atan2(-ny*nz, -nx*nz)),
+		Lat: degrees(math.Atan2(nx*nx+ny*ny, math.Abs(nz)*math.Hypot(nx, ny))),
+	}
+	bottom := Point{Lng: top.Lng + 180, Lat: -top.Lat}
+	if bottom.Lng > 180 {
+		bottom.Lng -= 360
+	}
+	for _, extreme := range []Point{top, bottom} {
+		if extreme.Lng > math.Min(a.Lng, b.Lng) && extreme.Lng < math.Max(a.Lng, b.Lng) {
+			minLat = math.Min(minLat, extreme.Lat)
+			maxLat = math.Max(maxLat, extreme.Lat)
+		}
+	}
+	return minLat, maxLat
+}
+
+func toVector(p Point) [3]float64 {
+	lng, lat := radians(p.Lng), radians(p.Lat)
+	return [3]float64{math.Cos(lat) * math.Cos(lng), math.Cos(lat) * math.Sin(lng), math.Sin(lat)}
+}
+
+func radians(deg float64) float64 { return deg * math.Pi / 180 }
+func degrees(rad float64) float64 { return rad * 180 / math.Pi }
@@ -0,0 +1,148 @@
+package geom
+
+import (
+	"math"
+	"testing"
+)
+
+// The expected values are for
+//
+//	SELECT ST_Covers(ST_GeomFromGeoJSON(<geometry>)::geography, ST_Point(<lng>, <lat>)::geography)
+//
+// Points near a slanted or east-west edge are placed on its great circle arc,
+// or about a meter to one side, so they are unambiguous. Several fall
+// between the arc and the straight lng/lat line, where geometry would differ.
+
+// A square with a square hole, both with a vertex at the same longitude as
+// some of the test points to exercise ray casting through vertices.
+const squareWithHole = `{"type":"Polygon","coordinates":[
+	[[0,0],[10,0],[10,10],[0,10],[0,0]],
+	[[4,4],[6,4],[6,6],[4,6],[4,4]]
+]}`
+
+// A concave "U" shape
+const uShape = `{"type":"Polygon","coordinates":[
+	[[0,0],[3,0],[3,3],[2,3],[2,1],[1,1],[1,3],[0,3],[0,0]]
+]}`
+
+// Two disjoint triangles
+const twoTriangles = `{"type":"MultiPolygon","coordinates":[
+	[[[-3.5,56.5],[-3.0,56.5],[-3.25,57.0],[-3.5,56.5]]],
+	[[[-1.0,56.5],[-0.5,56.5],[-0.75,57.0],[-1.0,56.5]]]
+]}`
+
+// A real-world style region ring with many decimal places
+const cairngorms = `{"type":"Polygon","coordinates":[[
+	[-3.9654541,56.8679974],[-3.3302307,56.8679974],[-3.3302307,57.1954272],
+	[-3.9654541,57.1954272],[-3.9654541,56.8679974]
+]]}`
+
+var coversCases = []struct {
+	name     string
+	geometry string
+	lng, lat float64
+	want     bool
+}{
+	{"square interior", squareWithHole, 2, 2, true},
+	{"square exterior", squareWithHole, 11, 5, false},
+	{"square vertex", squareWithHole, 0, 0, true},
+	{"square far vertex", squareWithHole, 10, 10, true},
+	{"square edge midpoint", squareWithHole, 5, 0, true},
+	{"square vertical edge", squareWithHole, 10, 3, true},
+	{"just outside square edge", squareWithHole, 10.000001, 3, false},
+	{"just inside square edge", squareWithHole, 9.999999, 3, true},
+	{"inside hole", squareWithHole, 5, 5, false},
+	{"hole edge", squareWithHole, 4, 5, true},
+	{"hole vertex", squareWithHole, 6, 6, true},
+	{"just inside hole edge", squareWithHole, 4.000001, 5, false},
+	{"ray through hole vertices", squareWithHole, 2, 4, true},
+	{"ray through outer vertices", squareWithHole, -1, 0, false},
+	{"ray along outer edge", squareWithHole, -1, 10, false},
+	{"above straight top edge, below arc", squareWithHole, 5, 10.03, true},
+	{"above top edge arc", squareWithHole, 5, 10.04, false},
+
+	{"u left arm", uShape, 0.5, 2, true},
+	{"u right arm", uShape, 2.5, 2, true},
+	{"u notch", uShape, 1.5, 2, false},
+	{"u notch floor", uShape, 1.5, 1, true},
+	{"u notch side", uShape, 1, 2, true},
+	{"u base", uShape, 1.5, 0.5, true},
+	{"u above notch", uShape, 1.5, 3, false},
+
+	{"first triangle", twoTriangles, -3.25, 56.7, true},
+	{"second triangle", twoTriangles, -0.75, 56.7, true},
+	{"between triangles", twoTriangles, -2, 56.7, false},
+	{"second triangle apex", twoTriangles, -0.75, 57.0, true},
+	{"second triangle slanted edge arc", twoTriangles, -0.8758319033222292, 56.750062519585605, true},
+	{"on straight slanted edge, inside arc", twoTriangles, -0.875, 56.75, true},
+	{"beside second triangle slanted edge arc", twoTriangles, -0.8758319, 56.7501, false},
+
+	{"cairngorms interior", cairngorms, -3.669472, 57.069421, true},
+	{"cairngorms west edge", cairngorms, -3.9654541, 57.0, true},
+	{"cairngorms north vertex latitude", cairngorms, -3.5, 57.1954272, true},
+	{"cairngorms north of straight edge, below arc", cairngorms, -3.5, 57.1957, true},
+	{"cairngorms north edge arc", cairngorms, -3.6478424, 57.195828076124755, true},
+	{"cairngorms outside north arc", cairngorms, -3.6478424, 57.19584, false},
+	{"cairngorms outside north", cairngorms, -3.5, 57.19576, false},
+}
+
+func TestCovers(t *testing.T) {
+	for _, tc := range coversCases {
+		geom, err := ParseGeoJSON([]byte(tc.geometry))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		got := geom.Covers(Point{Lng: tc.lng, Lat: tc.lat})
+		if got != tc.want {
+			t.Errorf("%s: Covers(%v, %v) = %v, want %v", tc.name, tc.lng, tc.lat, got, tc.want)
+		}
+	}
+}
+
+func TestBoundsContainsCoveredPoints(t *testing.T) {
+	for _, tc := range coversCases {
+		if !tc.want {
+			continue
+		}
+		geom, err := ParseGeoJSON([]byte(tc.geometry))
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if !geom.Bounds().Contains(Point{Lng: tc.lng, Lat: tc.lat}) {
+			t.Errorf("%s: bounds %+v don't contain %v, %v", tc.name, geom.Bounds(), tc.lng, tc.lat)
+		}
+	}
+}
+
+func TestParseGeoJSONRejectsOtherTypes(t *testing.T) {
+	_, err := ParseGeoJSON([]byte(`{"type":"Point","coordinates":[0,0]}`))
+	if err == nil {
+		t.Error("expected error for Point")
+	}
+}
+
+// The expected values are great circle distances on a sphere. The tolerance
+// covers the difference from the spheroid ST_Distance on geography uses.
+var distanceCases = []struct {
+	name     string
+	line     LineString
+	lng, lat float64
+	want     float64
+}{
+	{"on vertex", LineString{{-3.6, 57.0}, {-3.5, 57.0}}, -3.6, 57.0, 0},
+	{"north of segment", LineString{{-3.6, 57.0}, {-3.5, 57.0}}, -3.55, 57.005, 556.6},
+	{"beyond end", LineString{{-3.6, 57.0}, {-3.6, 57.01}}, -3.6, 57.02, 1113.3},
+	{"east of meridian segment", LineString{{-3.6, 57.0}, {-3.6, 57.01}}, -3.59, 57.005, 606.8},
+	{"nearest of several segments", LineString{{0, 0}, {0.01, 0}, {0.01, 0.01}}, 0.012, 0.005, 222.6},
+}
+
+func TestLineStringDistanceTo(t *testing.T) {
+	for _, c := range distanceCases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.line.DistanceTo(Point{Lng: c.lng, Lat: c.lat})
+			if math.Abs(got-c.want) > 0.01*c.want+0.5 {
+				t.Errorf("got %.1f, want %.1f", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+// Package imagestore caches photo files fetched from Flickr on disk, so that
+// the scorer, admin and training exports download each image at most once.
+//
+// Images are keyed by flickr_id, secret and size suffix (see
+// flickr.SourceURL). Flickr gives a photo a new secret when it is replaced,
+// so a key always names the same image content and stored images never need
+// revalidating. The store is a plain directory, which can be shared between
+// processes.
+package imagestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Key struct {
+	FlickrID string
+	Secret   string
+	// Size is the size suffix, empty for the default size
+	Size string
+}
+
+var keyPartRe = regexp.MustCompile(`^[0-9A-Za-z]*$`)
+
+func (k Key) validate() error {
+	if k.FlickrID == "" || k.Secret == "" ||
+		!keyPartRe.MatchString(k.FlickrID) || !keyPartRe.MatchString(k.Secret) || !keyPartRe.MatchString(k.Size) {
+		return fmt.Errorf("imagestore: invalid key %+v", k)
+	}
+	return nil
+}
+
+// String is the key's file name without extension, as on Flickr.
+func (k Key) String() string {
+	if k.Size == "" {
+		return k.FlickrID + "_" + k.Secret
+	}
+	return k.FlickrID + "_" + k.Secret + "_" + k.Size
+}
+
+// name is the key's path within the store. Keys are spread over
+// subdirectories by hash so no directory gets too large.
+func (k Key) name() string {
+	sum := sha256.Sum256([]byte(k.String()))
+	return filepath.Join(hex.EncodeToString(sum[:1]), k.String()+".jpg")
+}
+
+// Store is a directory of cached images. A nil *Store caches nothing, so
+// callers can use one unconditionally.
+type Store struct {
+	Dir string
+	// TTL is how long an image is kept after it was fetched, so photos
+	// we've stopped using don't fill the store
+	TTL time.Duration
+	// MaxBytes bounds the size of the store, Evict removes the oldest images
+	// beyond it
+	MaxBytes int64
+}
+
+// FromEnv configures a store from IMAGE_STORE_DIR, IMAGE_STORE_TTL (default
+// 720h) and IMAGE_STORE_MAX_MB (default 10240). It returns nil if
+// IMAGE_STORE_DIR is not set.
+func FromEnv() (*Store, error) {
+	dir := os.Getenv("IMAGE_STORE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	s := &Store{Dir: dir, TTL: 30 * 24 * time.Hour, MaxBytes: 10 << 30}
+	if value := os.Getenv("IMAGE_STORE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("IMAGE_STORE_TTL: %w", err)
+		}
+		s.TTL = ttl
+	}
+	if value := os.Getenv("IMAGE_STORE_MAX_MB"); value != "" {
+		mb, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("IMAGE_STORE_MAX_MB: %w", err)
+		}
+		s.MaxBytes = mb << 20
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ErrNotFound is returned by Read for images that aren't stored or have
+// expired
+var ErrNotFound = errors.New("imagestore: not found")
+
+// Read returns a stored image.
+func (s *Store) Read(key Key) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNotFound
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.Dir, key.name())
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if s.expired(info) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Evicted since we checked
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Write stores an image, replacing any previous version.
+func (s *Store) Write(key Key, data []byte) error {
+	if s == nil {
+		return nil
+	}
+	if err := key.validate(); err != nil {
+		return err
+	}
+	path := filepath.Join(s.Dir, key.name())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see part of an image
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns the stored image, or calls fetch and stores the result.
+// Failing to store is logged rather than returned, as the caller still has
+// the image.
+func (s *Store) Get(ctx context.Context, key Key, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	data, err := s.Read(key)
+	if err == nil {
+		return data, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Printf("imagestore: read %s: %s", key, err)
+	}
+
+	data, err = fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Write(key, data); err != nil {
+		log.Printf("imagestore: write %s: %s", key, err)
+	}
+	return data, nil
+}
+
+func (s *Store) expired(info fs.FileInfo) bool {
+	return s.TTL > 0 && time.Since(info.ModTime()) > s.TTL
+}
+
+// Evict removes expired images, then the oldest images until the store is
+// within MaxBytes.
+func (s *Store) Evict() error {
+	if s == nil {
+		return nil
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		fetched time.Time
+	}
+	var files []file
+	var total int64
+	removed := 0
+	err := filepath.WalkDir(s.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Leftovers from interrupted writes count as expired
+		if s.expired(info) || strings.HasPrefix(entry.Name(), ".tmp-") && time.Since(info.ModTime()) > time.Hour {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			removed++
+			return nil
+		}
+		files = append(files, file{path: path, size: info.Size(), fetched: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.MaxBytes > 0 && total > s.MaxBytes {
+		sort.Slice(files, func(i, j int) bool { return files[i].fetched.Before(files[j].fetched) })
+		for _, f := range files {
+			if total <= s.MaxBytes {
+				break
+			}
+			if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			total -= f.size
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.Printf("imagestore: evicted %d images, %d MB remain", removed, total>>20)
+	}
+	return nil
+}
+
+// RunEviction calls Evict every interval until ctx is done.
+func (s *Store) RunEviction(ctx context.Context, interval time.Duration) {
+	if s == nil {
+		return
+	}
+	for {
+		if err := s.Evict(); err != nil {
+			log.Println("imagestore: evict:", err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sourceURLRe matches flickr.SourceURL, {server}/{id}_{secret}_{size}.jpg
+var sourceURLRe = regexp.MustCompile(`/[0-9A-Za-z]+/([0-9]+)_([0-9A-Za-z]+)(?:_([0-9A-Za-z]+))?\.jpg$`)
+
+// KeyFromSourceURL parses the key of a Flickr static URL.
+func KeyFromSourceURL(url string) (Key, bool) {
+	groups := sourceURLRe.FindStringSubmatch(url)
+	if groups == nil {
+		return Key{}, false
+	}
+	return Key{FlickrID: groups[1], Secret: groups[2], Size: groups[3]}, true
+}
@@ -0,0 +1,188 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingFetch returns data, counting how often it is called
+func countingFetch(data []byte) (func(ctx context.Context) ([]byte, error), *int) {
+	calls := 0
+	return func(ctx context.Context) ([]byte, error) {
+		calls++
+		return data, nil
+	}, &calls
+}
+
+// age backdates when the key was fetched
+func age(t *testing.T, s *Store, key Key, by time.Duration) {
+	when := time.Now().Add(-by)
+	if err := os.Chtimes(filepath.Join(s.Dir, key.name()), when, when); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetStoresFetched(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), TTL: time.Hour}
+	key := Key{FlickrID: "123", Secret: "abc", Size: "m"}
+	fetch, calls := countingFetch([]byte("image"))
+
+	for i := 0; i < 2; i++ {
+		data, err := s.Get(context.Background(), key, fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte("image")) {
+			t.Errorf("Get %d = %q, want %q", i, data, "image")
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("fetched %d times, want 1", *calls)
+	}
+
+	// Another secret is another version of the photo
+	replaced := Key{FlickrID: "123", Secret: "def", Size: "m"}
+	if _, err := s.Get(context.Background(), replaced, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Errorf("fetched %d times after the secret changed, want 2", *calls)
+	}
+}
+
+func TestGetRefetchesExpired(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), TTL: time.Hour}
+	key := Key{FlickrID: "123", Secret: "abc"}
+	fetch, calls := countingFetch([]byte("image"))
+
+	if _, err := s.Get(context.Background(), key, fetch); err != nil {
+		t.Fatal(err)
+	}
+	age(t, s, key, 2*time.Hour)
+	if _, err := s.Read(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read expired = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.Get(context.Background(), key, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if *calls != 2 {
+		t.Errorf("fetched %d times, want 2", *calls)
+	}
+}
+
+func TestGetDoesNotStoreErrors(t *testing.T) {
+	s := &Store{Dir: t.TempDir()}
+	key := Key{FlickrID: "123", Secret: "abc", Size: "m"}
+	fetchErr := errors.New("fetch failed")
+
+	_, err := s.Get(context.Background(), key, func(ctx context.Context) ([]byte, error) {
+		return nil, fetchErr
+	})
+	if !errors.Is(err, fetchErr) {
+		t.Errorf("Get = %v, want %v", err, fetchErr)
+	}
+	if _, err := s.Read(key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read after failed fetch = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestGetNilStore(t *testing.T) {
+	var s *Store
+	key := Key{FlickrID: "123", Secret: "abc", Size: "m"}
+	fetch, calls := countingFetch([]byte("image"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Get(context.Background(), key, fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *calls != 2 {
+		t.Errorf("fetched %d times, want 2", *calls)
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	s := &Store{Dir: t.TempDir()}
+	for _, key := range []Key{
+		{FlickrID: "", Secret: "abc"},
+		{FlickrID: "123", Secret: ""},
+		{FlickrID: "../123", Secret: "abc"},
+		{FlickrID: "123", Secret: "abc", Size: "m/../x"},
+	} {
+		if err := s.Write(key, []byte("image")); err == nil {
+			t.Errorf("Write(%+v) succeeded, want error", key)
+		}
+	}
+}
+
+func TestEvict(t *testing.T) {
+	s := &Store{Dir: t.TempDir(), TTL: 24 * time.Hour, MaxBytes: 10}
+	expired := Key{FlickrID: "1", Secret: "a"}
+	oldest := Key{FlickrID: "2", Secret: "a"}
+	older := Key{FlickrID: "3", Secret: "a"}
+	newest := Key{FlickrID: "4", Secret: "a"}
+	for i, key := range []Key{expired, oldest, older, newest} {
+		if err := s.Write(key, []byte("12345")); err != nil {
+			t.Fatal(err)
+		}
+		age(t, s, key, time.Duration(4-i)*time.Hour)
+	}
+	age(t, s, expired, 48*time.Hour)
+
+	// An interrupted write, old enough to be abandoned
+	tmp := filepath.Join(s.Dir, ".tmp-123")
+	if err := os.WriteFile(tmp, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	abandoned := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(tmp, abandoned, abandoned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Evict(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key  Key
+		kept bool
+	}{
+		{expired, false},
+		{oldest, false},
+		{older, true},
+		{newest, true},
+	} {
+		_, err := os.Stat(filepath.Join(s.Dir, tc.key.name()))
+		if kept := err == nil; kept != tc.kept {
+			t.Errorf("%s kept = %v, want %v", tc.key, kept, tc.kept)
+		}
+	}
+	if _, err := os.Stat(tmp); err == nil {
+		t.Error("abandoned temporary file kept")
+	}
+}
+
+func TestKeyFromSourceURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want Key
+		ok   bool
+	}{
+		{"https://live.staticflickr.com/65535/53123456789_1a2b3c4d5e_m.jpg", Key{"53123456789", "1a2b3c4d5e", "m"}, true},
+		{"https://live.staticflickr.com/65535/53123456789_1a2b3c4d5e.jpg", Key{"53123456789", "1a2b3c4d5e", ""}, true},
+		{"http://localhost:8080/7372/53123456789_1a2b3c4d5e_b.jpg", Key{"53123456789", "1a2b3c4d5e", "b"}, true},
+		{"https://live.staticflickr.com/65535/53123456789_1a2b3c4d5e_m.png", Key{}, false},
+		{"https://www.flickr.com/photos/someone/53123456789", Key{}, false},
+	}
+	for _, tc := range cases {
+		got, ok := KeyFromSourceURL(tc.url)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("KeyFromSourceURL(%q) = %+v, %v, want %+v, %v", tc.url, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE flickr_indexer_windows;
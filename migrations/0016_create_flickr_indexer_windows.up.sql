@@ -0,0 +1,21 @@
+-- Every search window the indexer queried. Windows with more results than
+-- Flickr will page through are split by date or bbox, and the children point
+-- at their parent. A window with no split but a total over the limit could
+-- not be split further and was only partially indexed.
+CREATE TABLE flickr_indexer_windows
+(
+    id          BIGSERIAL PRIMARY KEY,
+    region_id   INT REFERENCES regions (id) ON DELETE CASCADE,
+    parent_id   BIGINT REFERENCES flickr_indexer_windows (id) ON DELETE CASCADE,
+    min_lng     DOUBLE PRECISION,
+    min_lat     DOUBLE PRECISION,
+    max_lng     DOUBLE PRECISION,
+    max_lat     DOUBLE PRECISION,
+    min_upload  TIMESTAMP,
+    max_upload  TIMESTAMP,
+    total       INT,
+    split       TEXT CHECK (split IN ('date', 'bbox')),
+    inserted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX flickr_indexer_windows_region_id_idx ON flickr_indexer_windows (region_id);
@@ -0,0 +1,5 @@
+DROP INDEX flickr_indexer_windows_pending_idx;
+ALTER TABLE flickr_indexer_windows DROP COLUMN completed_at;
+ALTER TABLE flickr_indexer_windows DROP COLUMN last_page;
+ALTER TABLE flickr_indexer_windows DROP COLUMN pages;
+ALTER TABLE flickr_indexer_windows DROP COLUMN bbox_depth;
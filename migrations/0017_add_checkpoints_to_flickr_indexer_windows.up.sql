@@ -0,0 +1,11 @@
+ALTER TABLE flickr_indexer_windows ADD COLUMN bbox_depth INT DEFAULT 0 NOT NULL;
+-- The number of pages we will fetch, which may be fewer than Flickr reports
+ALTER TABLE flickr_indexer_windows ADD COLUMN pages INT;
+ALTER TABLE flickr_indexer_windows ADD COLUMN last_page INT DEFAULT 0 NOT NULL;
+ALTER TABLE flickr_indexer_windows ADD COLUMN completed_at TIMESTAMP;
+
+-- Windows recorded before checkpointing can't be resumed
+UPDATE flickr_indexer_windows SET completed_at = inserted_at;
+
+CREATE INDEX flickr_indexer_windows_pending_idx ON flickr_indexer_windows (region_id, min_upload, id)
+    WHERE completed_at IS NULL AND split IS NULL;
@@ -0,0 +1,6 @@
+ALTER TABLE challenges DROP COLUMN retired_reason;
+ALTER TABLE challenges DROP COLUMN retired_at;
+
+ALTER TABLE flickr_photos DROP COLUMN gone_reason;
+ALTER TABLE flickr_photos DROP COLUMN gone_at;
+ALTER TABLE flickr_photos DROP COLUMN last_verified_at;
@@ -0,0 +1,8 @@
+ALTER TABLE flickr_photos ADD COLUMN last_verified_at TIMESTAMP;
+-- Set once the photo is deleted or no longer public
+ALTER TABLE flickr_photos ADD COLUMN gone_at TIMESTAMP;
+ALTER TABLE flickr_photos ADD COLUMN gone_reason TEXT;
+
+-- Retired challenges are kept for history but should no longer be served
+ALTER TABLE challenges ADD COLUMN retired_at TIMESTAMP;
+ALTER TABLE challenges ADD COLUMN retired_reason TEXT;
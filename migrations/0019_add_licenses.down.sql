@@ -0,0 +1,7 @@
+ALTER TABLE challenges DROP COLUMN license_url;
+ALTER TABLE challenges DROP COLUMN license_name;
+ALTER TABLE challenges DROP COLUMN license_id;
+
+DROP INDEX flickr_photos_license_idx;
+ALTER TABLE flickr_photos DROP COLUMN owner_name;
+ALTER TABLE flickr_photos DROP COLUMN license;
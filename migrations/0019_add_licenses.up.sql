@@ -0,0 +1,15 @@
+ALTER TABLE flickr_photos ADD COLUMN license INT;
+ALTER TABLE flickr_photos ADD COLUMN owner_name TEXT;
+
+-- Photos indexed before we requested these extras only have them if we have
+-- fetched info
+UPDATE flickr_photos
+SET license    = (info ->> 'license')::int,
+    owner_name = info -> 'owner' ->> 'username'
+WHERE info IS NOT NULL;
+
+CREATE INDEX flickr_photos_license_idx ON flickr_photos (license);
+
+ALTER TABLE challenges ADD COLUMN license_id INT;
+ALTER TABLE challenges ADD COLUMN license_name TEXT;
+ALTER TABLE challenges ADD COLUMN license_url TEXT;
@@ -0,0 +1,18 @@
+-- Items waiting to be processed by a worker. Workers claim items with
+-- SELECT ... FOR UPDATE SKIP LOCKED and hold them until claimed_until, after
+-- which an unacknowledged item can be claimed again. An item is deleted once
+-- processed, or marked dead after too many failed attempts.
+CREATE TABLE work_queue
+(
+    queue         TEXT      NOT NULL,
+    item          TEXT      NOT NULL,
+    attempts      INT       NOT NULL DEFAULT 0,
+    ready_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    claimed_until TIMESTAMP,
+    last_error    TEXT,
+    dead_at       TIMESTAMP,
+    inserted_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (queue, item)
+);
+
+CREATE INDEX work_queue_ready_idx ON work_queue (queue, ready_at) WHERE dead_at IS NULL;
@@ -0,0 +1,4 @@
+-- The scorer now decides these with its stage registry and acceptance policy,
+-- so a rule change no longer needs a migration. Existing values are kept.
+ALTER TABLE photo_scores ALTER COLUMN is_complete DROP EXPRESSION;
+ALTER TABLE photo_scores ALTER COLUMN is_accepted DROP EXPRESSION;
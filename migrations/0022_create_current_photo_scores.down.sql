@@ -0,0 +1,2 @@
+DROP VIEW current_photo_scores;
+DROP INDEX photo_scores_flickr_photo_id_vsn_idx;
@@ -0,0 +1,21 @@
+-- Each photo should have at most one score per version. Keep the most recently
+-- updated where there are duplicates.
+DELETE
+FROM photo_scores as s
+    USING photo_scores as newer
+WHERE s.flickr_photo_id = newer.flickr_photo_id
+  AND s.vsn = newer.vsn
+  AND (s.updated_at, s.id) < (newer.updated_at, newer.id);
+
+CREATE UNIQUE INDEX photo_scores_flickr_photo_id_vsn_idx ON photo_scores (flickr_photo_id, vsn);
+
+-- The score readers should use. This is the latest complete score for each
+-- photo, or the latest score if none is complete, so a photo being re-scored
+-- keeps its old result until the new one is finished.
+--
+-- The column list is fixed when the view is created, so recreate it after
+-- adding columns to photo_scores.
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
@@ -0,0 +1,2 @@
+DROP TABLE osm_highway_imports;
+DROP TABLE osm_highways;
@@ -0,0 +1,24 @@
+-- Highways imported from OSM extracts by `scorer import-roads`, so the road
+-- check can run without Overpass.
+CREATE TABLE osm_highways
+(
+    id        BIGSERIAL PRIMARY KEY,
+    region_id INT REFERENCES regions (id) ON DELETE CASCADE,
+    osm_id    BIGINT,
+    highway   TEXT,
+    surface   TEXT,
+    geo       GEOGRAPHY(LINESTRING, 4326)
+);
+
+CREATE INDEX osm_highways_geo_idx ON osm_highways USING GIST (geo);
+CREATE INDEX osm_highways_region_id_idx ON osm_highways (region_id);
+
+-- A region's highways are only trusted once it has an import, as an empty
+-- table would otherwise mean no roads anywhere
+CREATE TABLE osm_highway_imports
+(
+    region_id   INT PRIMARY KEY REFERENCES regions (id) ON DELETE CASCADE,
+    source      TEXT,
+    way_count   INT,
+    imported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,14 @@
+DROP VIEW current_photo_scores;
+
+ALTER TABLE regions DROP COLUMN min_road_distance;
+
+ALTER TABLE photo_scores DROP COLUMN path_distance;
+ALTER TABLE photo_scores DROP COLUMN track_distance;
+ALTER TABLE photo_scores DROP COLUMN road_surface;
+ALTER TABLE photo_scores DROP COLUMN road_highway;
+ALTER TABLE photo_scores DROP COLUMN road_distance;
+
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
@@ -0,0 +1,18 @@
+-- Distances are in meters and null if there is none within the scorer's
+-- search radius (2000m)
+ALTER TABLE photo_scores ADD COLUMN road_distance FLOAT;
+ALTER TABLE photo_scores ADD COLUMN road_highway TEXT;
+ALTER TABLE photo_scores ADD COLUMN road_surface TEXT;
+ALTER TABLE photo_scores ADD COLUMN track_distance FLOAT;
+ALTER TABLE photo_scores ADD COLUMN path_distance FLOAT;
+
+-- Photos closer than this to a road are rejected. It can't exceed the search
+-- radius.
+ALTER TABLE regions ADD COLUMN min_road_distance FLOAT NOT NULL DEFAULT 1000
+    CHECK (min_road_distance <= 2000);
+
+DROP VIEW current_photo_scores;
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
@@ -0,0 +1,10 @@
+DROP VIEW current_photo_scores;
+
+ALTER TABLE photo_scores DROP COLUMN altitude_above_terrain;
+ALTER TABLE photo_scores DROP COLUMN terrain_altitude_datum;
+ALTER TABLE photo_scores DROP COLUMN gps_altitude_datum;
+
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
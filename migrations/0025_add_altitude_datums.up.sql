@@ -0,0 +1,16 @@
+-- Datums are 'msl' (relative to the geoid) or 'ellipsoid' (relative to WGS84)
+ALTER TABLE photo_scores ADD COLUMN gps_altitude_datum TEXT;
+ALTER TABLE photo_scores ADD COLUMN terrain_altitude_datum TEXT;
+-- gps_altitude - terrain_altitude after converting both to the ellipsoid
+ALTER TABLE photo_scores ADD COLUMN altitude_above_terrain FLOAT;
+
+-- EXIF altitudes are relative to sea level, and until now we requested
+-- ellipsoid heights from Bing
+UPDATE photo_scores SET gps_altitude_datum = 'msl' WHERE gps_altitude IS NOT NULL;
+UPDATE photo_scores SET terrain_altitude_datum = 'ellipsoid' WHERE terrain_altitude IS NOT NULL;
+
+DROP VIEW current_photo_scores;
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
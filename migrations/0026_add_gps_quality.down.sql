@@ -0,0 +1,13 @@
+DROP VIEW current_photo_scores;
+
+ALTER TABLE photo_scores DROP COLUMN location_confidence;
+ALTER TABLE photo_scores DROP COLUMN gps_differential;
+ALTER TABLE photo_scores DROP COLUMN gps_satellites;
+ALTER TABLE photo_scores DROP COLUMN gps_dop;
+ALTER TABLE photo_scores DROP COLUMN gps_h_positioning_error;
+ALTER TABLE photo_scores DROP COLUMN gps_status;
+
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
@@ -0,0 +1,14 @@
+-- GPS fix quality from the EXIF, null where the camera didn't record it
+ALTER TABLE photo_scores ADD COLUMN gps_status TEXT;
+ALTER TABLE photo_scores ADD COLUMN gps_h_positioning_error FLOAT;
+ALTER TABLE photo_scores ADD COLUMN gps_dop FLOAT;
+ALTER TABLE photo_scores ADD COLUMN gps_satellites INT;
+ALTER TABLE photo_scores ADD COLUMN gps_differential BOOLEAN;
+-- 0 (void fix) to 1, derived from the above
+ALTER TABLE photo_scores ADD COLUMN location_confidence FLOAT;
+
+DROP VIEW current_photo_scores;
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
@@ -0,0 +1 @@
+DROP TABLE classifier_models;
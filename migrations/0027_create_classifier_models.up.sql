@@ -0,0 +1,19 @@
+-- Models the classifier has reported, keyed by the name recorded in
+-- photo_scores.validity_model
+CREATE TABLE classifier_models
+(
+    name          TEXT PRIMARY KEY,
+    -- As reported by /api/v0/models, null if the classifier scored with a
+    -- model it didn't list
+    metadata      JSONB,
+    first_seen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO classifier_models (name, first_seen_at, last_seen_at)
+SELECT validity_model,
+       coalesce(min(updated_at), CURRENT_TIMESTAMP),
+       coalesce(max(updated_at), CURRENT_TIMESTAMP)
+FROM photo_scores
+WHERE validity_model IS NOT NULL
+GROUP BY validity_model;
@@ -0,0 +1,8 @@
+ALTER TABLE flickr_photo_fetch_failures DROP CONSTRAINT flickr_photo_fetch_failures_flickr_id_key;
+ALTER TABLE flickr_photo_fetch_failures ALTER COLUMN flickr_id DROP NOT NULL;
+ALTER TABLE flickr_photo_fetch_failures ALTER COLUMN inserted_at DROP NOT NULL;
+
+ALTER TABLE flickr_photo_fetch_failures DROP COLUMN next_retry_at;
+ALTER TABLE flickr_photo_fetch_failures DROP COLUMN updated_at;
+ALTER TABLE flickr_photo_fetch_failures DROP COLUMN attempts;
+ALTER TABLE flickr_photo_fetch_failures DROP COLUMN kind;
@@ -0,0 +1,42 @@
+-- One row per photo, recording its latest failure and how many times we've
+-- tried. Transient failures are retried from next_retry_at, a null
+-- next_retry_at means the photo isn't retried.
+ALTER TABLE flickr_photo_fetch_failures
+    ADD COLUMN kind          TEXT      NOT NULL DEFAULT 'permanent'
+        CHECK (kind IN ('transient', 'permanent')),
+    ADD COLUMN attempts      INT       NOT NULL DEFAULT 1,
+    ADD COLUMN updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN next_retry_at TIMESTAMP;
+
+DELETE
+FROM flickr_photo_fetch_failures
+WHERE flickr_id IS NULL;
+
+UPDATE flickr_photo_fetch_failures AS f
+SET attempts    = history.attempts,
+    inserted_at = coalesce(history.first_at, CURRENT_TIMESTAMP),
+    updated_at  = coalesce(f.inserted_at, CURRENT_TIMESTAMP)
+FROM (SELECT flickr_id, count(*) AS attempts, min(inserted_at) AS first_at
+      FROM flickr_photo_fetch_failures
+      GROUP BY flickr_id) AS history
+WHERE history.flickr_id = f.flickr_id;
+
+DELETE
+FROM flickr_photo_fetch_failures AS f
+WHERE exists (SELECT 1
+              FROM flickr_photo_fetch_failures AS newer
+              WHERE newer.flickr_id = f.flickr_id
+                AND newer.id > f.id);
+
+ALTER TABLE flickr_photo_fetch_failures
+    ALTER COLUMN flickr_id SET NOT NULL,
+    ALTER COLUMN inserted_at SET NOT NULL,
+    ADD UNIQUE (flickr_id);
+
+-- Before this everything was treated as permanent. Anything that wasn't a
+-- client error or a classifier rejection is retried straight away.
+UPDATE flickr_photo_fetch_failures
+SET kind          = 'transient',
+    next_retry_at = CURRENT_TIMESTAMP
+WHERE err NOT LIKE 'classify:%'
+  AND NOT (err ~ '^HTTP status 4[0-9][0-9]' AND err !~ '^HTTP status (408|429)');
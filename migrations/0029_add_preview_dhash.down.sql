@@ -0,0 +1,12 @@
+DROP TABLE flickr_challenge_skips;
+
+DROP FUNCTION hamming_distance(BIGINT, BIGINT);
+
+DROP VIEW current_photo_scores;
+
+ALTER TABLE photo_scores DROP COLUMN preview_dhash;
+
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
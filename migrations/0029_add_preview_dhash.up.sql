@@ -0,0 +1,29 @@
+-- A 64 bit difference hash of the preview, stored as signed
+ALTER TABLE photo_scores ADD COLUMN preview_dhash BIGINT;
+
+DROP VIEW current_photo_scores;
+CREATE VIEW current_photo_scores AS
+SELECT DISTINCT ON (flickr_photo_id) *
+FROM photo_scores
+ORDER BY flickr_photo_id, is_complete IS TRUE DESC, vsn DESC;
+
+-- The number of bits that differ between two hashes
+CREATE FUNCTION hamming_distance(a BIGINT, b BIGINT) RETURNS INT
+    LANGUAGE SQL
+    IMMUTABLE
+    STRICT
+AS
+$$
+SELECT length(replace((a # b)::bit(64)::text, '0', ''))
+$$;
+
+-- Accepted photos the challenge assembler decided not to use, so it doesn't
+-- reconsider them every batch
+CREATE TABLE flickr_challenge_skips
+(
+    flickr_id    TEXT PRIMARY KEY REFERENCES flickr_photos (flickr_id),
+    reason       TEXT      NOT NULL,
+    -- The photo behind the existing challenge it duplicates
+    duplicate_of TEXT REFERENCES flickr_photos (flickr_id),
+    inserted_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+ALTER TABLE regions DROP COLUMN max_challenges_per_cell;
+ALTER TABLE regions DROP COLUMN challenge_cell_precision;
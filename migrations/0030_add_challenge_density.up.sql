@@ -0,0 +1,8 @@
+-- The challenge assembler spreads challenges out by filling the emptiest
+-- geohash cells of the region first, and can cap how many each cell has.
+-- Precision 6 cells are about 1.2km by 0.6km. The cap is null, meaning no
+-- limit, until set for a region.
+ALTER TABLE regions ADD COLUMN challenge_cell_precision INT NOT NULL DEFAULT 6
+    CHECK (challenge_cell_precision BETWEEN 1 AND 12);
+ALTER TABLE regions ADD COLUMN max_challenges_per_cell INT
+    CHECK (max_challenges_per_cell > 0);
@@ -0,0 +1 @@
+ALTER TABLE flickr_photos DROP COLUMN verify_attempted_at;
@@ -0,0 +1,5 @@
+-- Set each time the verifier tries a photo, whether or not it succeeds, so
+-- photos that keep failing to fetch go to the back of the queue instead of
+-- being picked first every batch. last_verified_at is only set on success.
+ALTER TABLE flickr_photos ADD COLUMN verify_attempted_at TIMESTAMP;
+UPDATE flickr_photos SET verify_attempted_at = last_verified_at;
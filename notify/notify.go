@@ -0,0 +1,134 @@
+// Package notify lets pipeline stages wake each other with Postgres
+// LISTEN/NOTIFY rather than polling.
+//
+// Notifications are only a hint that there may be work. They are lost if
+// nobody is listening, so a worker must still poll occasionally, and it
+// must check for work itself rather than trusting the payload.
+package notify
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"time"
+)
+
+// Channels, named after the event that happened.
+const (
+	// PhotosIndexed is sent when the indexer inserts new photos to score.
+	PhotosIndexed = "cg_photos_indexed"
+	// ExifQueued is sent when the scorer wants EXIF for a photo.
+	ExifQueued = "cg_exif_queued"
+	// ExifFetched is sent when the indexer saves EXIF the scorer asked for.
+	ExifFetched = "cg_exif_fetched"
+	// PhotosAccepted is sent when the scorer accepts photos, which then need
+	// sizes and info.
+	PhotosAccepted = "cg_photos_accepted"
+	// PhotosReady is sent when the indexer completes sizes or info for
+	// accepted photos, which can then be assembled into challenges.
+	PhotosReady = "cg_photos_ready"
+	// FetchRetried is sent when photos that failed to fetch are due a retry
+	// early because someone asked for it in admin.
+	FetchRetried = "cg_fetch_retried"
+)
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// Notify sends a notification on channel. If db is in a transaction it is
+// delivered on commit.
+func Notify(ctx context.Context, db execer, channel string) error {
+	_, err := db.Exec(ctx, `SELECT pg_notify($1, '')`, channel)
+	return err
+}
+
+// Listener holds a dedicated connection listening on a set of channels.
+type Listener struct {
+	databaseURL string
+	channels    []string
+	conn        *pgx.Conn
+}
+
+// Listen connects and starts listening on channels.
+func Listen(ctx context.Context, databaseURL string, channels ...string) (*Listener, error) {
+	l := &Listener{databaseURL: databaseURL, channels: channels}
+	if err := l.connect(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Listener) connect(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, l.databaseURL)
+	if err != nil {
+		return err
+	}
+	for _, channel := range l.channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			_ = conn.Close(ctx)
+			return err
+		}
+	}
+	l.conn = conn
+	return nil
+}
+
+// Wait blocks until a notification arrives on any channel or pollInterval
+// elapses. It returns the channel, or "" on timeout. Notifications already
+// pending are drained so a burst wakes the caller once.
+//
+// Connection problems are logged rather than returned and the listener
+// reconnects on the next call, so Wait is always at worst a sleep.
+func (l *Listener) Wait(ctx context.Context, pollInterval time.Duration) string {
+	deadline := time.Now().Add(pollInterval)
+
+	if l.conn == nil {
+		if err := l.connect(ctx); err != nil {
+			log.Printf("notify: reconnect failed: %s", err)
+			sleepUntil(ctx, deadline)
+			return ""
+		}
+		log.Println("notify: reconnected")
+	}
+
+	waitCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	n, err := l.conn.WaitForNotification(waitCtx)
+	if err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			log.Printf("notify: lost connection: %s", err)
+			_ = l.conn.Close(context.Background())
+			l.conn = nil
+			sleepUntil(ctx, deadline)
+		}
+		return ""
+	}
+
+	for {
+		drainCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		_, err := l.conn.WaitForNotification(drainCtx)
+		cancel()
+		if err != nil {
+			break
+		}
+	}
+
+	return n.Channel
+}
+
+func (l *Listener) Close(ctx context.Context) error {
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.Close(ctx)
+}
+
+func sleepUntil(ctx context.Context, deadline time.Time) {
+	select {
+	case <-time.After(time.Until(deadline)):
+	case <-ctx.Done():
+	}
+}
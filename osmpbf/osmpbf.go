@@ -0,0 +1,480 @@
+// Package osmpbf is a minimal reader for OpenStreetMap .osm.pbf extracts.
+//
+// It decodes node locations and way tags and node references, which is all
+// we need to rebuild way geometries. Relations, metadata and node tags are
+// skipped.
+package osmpbf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type Node struct {
+	ID  int64
+	Lat float64
+	Lon float64
+}
+
+type Way struct {
+	ID   int64
+	Tags map[string]string
+	// Refs are the IDs of the way's nodes in order
+	Refs []int64
+}
+
+// Block is the contents of one data block of the file.
+type Block struct {
+	Nodes []Node
+	Ways  []Way
+}
+
+// Limits from the format spec
+const (
+	maxHeaderSize = 64 * 1024
+	maxBlobSize   = 32 * 1024 * 1024
+)
+
+var supportedFeatures = map[string]bool{
+	"OsmSchema-V0.6": true,
+	"DenseNodes":     true,
+}
+
+type Reader struct {
+	r io.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next returns the next data block, or io.EOF at the end of the file.
+func (r *Reader) Next() (*Block, error) {
+	for {
+		blobType, data, err := r.readBlob()
+		if err != nil {
+			return nil, err
+		}
+		switch blobType {
+		case "OSMHeader":
+			if err := checkHeader(data); err != nil {
+				return nil, err
+			}
+		case "OSMData":
+			return decodePrimitiveBlock(data)
+		}
+		// Unknown blob types should be skipped
+	}
+}
+
+func (r *Reader) readBlob() (string, []byte, error) {
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r.r, sizeBuf[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", nil, errTruncated
+		}
+		return "", nil, err
+	}
+	headerSize := binary.BigEndian.Uint32(sizeBuf[:])
+	if headerSize > maxHeaderSize {
+		return "", nil, fmt.Errorf("osmpbf: blob header too large (%d bytes)", headerSize)
+	}
+	headerBuf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.r, headerBuf); err != nil {
+		return "", nil, errTruncated
+	}
+
+	var blobType string
+	var dataSize uint64
+	hr := pbReader{buf: headerBuf}
+	for !hr.done() {
+		num, wire, err := hr.field()
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case num == 1 && wire == wireBytes:
+			b, err := hr.bytes()
+			if err != nil {
+				return "", nil, err
+			}
+			blobType = string(b)
+		case num == 3 && wire == wireVarint:
+			if dataSize, err = hr.varint(); err != nil {
+				return "", nil, err
+			}
+		default:
+			if err := hr.skip(wire); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if dataSize > maxBlobSize {
+		return "", nil, fmt.Errorf("osmpbf: blob too large (%d bytes)", dataSize)
+	}
+
+	blobBuf := make([]byte, dataSize)
+	if _, err := io.ReadFull(r.r, blobBuf); err != nil {
+		return "", nil, errTruncated
+	}
+	data, err := decodeBlob(blobBuf)
+	if err != nil {
+		return "", nil, err
+	}
+	return blobType, data, nil
+}
+
+func decodeBlob(buf []byte) ([]byte, error) {
+	var raw, zlibData []byte
+	var rawSize uint64
+	br := pbReader{buf: buf}
+	for !br.done() {
+		num, wire, err := br.field()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case num == 1 && wire == wireBytes:
+			if raw, err = br.bytes(); err != nil {
+				return nil, err
+			}
+		case num == 2 && wire == wireVarint:
+			if rawSize, err = br.varint(); err != nil {
+				return nil, err
+			}
+		case num == 3 && wire == wireBytes:
+			if zlibData, err = br.bytes(); err != nil {
+				return nil, err
+			}
+		case num >= 4 && num <= 7:
+			return nil, fmt.Errorf("osmpbf: unsupported blob compression (field %d)", num)
+		default:
+			if err := br.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if raw != nil {
+		return raw, nil
+	}
+	if zlibData == nil {
+		return nil, errors.New("osmpbf: empty blob")
+	}
+	if rawSize > maxBlobSize {
+		return nil, fmt.Errorf("osmpbf: blob too large (%d bytes)", rawSize)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(zlibData))
+	if err != nil {
+		return nil, fmt.Errorf("osmpbf: %w", err)
+	}
+	defer zr.Close()
+	out := make([]byte, 0, rawSize)
+	w := bytes.NewBuffer(out)
+	if _, err := io.Copy(w, io.LimitReader(zr, maxBlobSize+1)); err != nil {
+		return nil, fmt.Errorf("osmpbf: %w", err)
+	}
+	if w.Len() > maxBlobSize {
+		return nil, errors.New("osmpbf: decompressed blob too large")
+	}
+	return w.Bytes(), nil
+}
+
+func checkHeader(data []byte) error {
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return err
+		}
+		if num == 4 && wire == wireBytes {
+			feature, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			if !supportedFeatures[string(feature)] {
+				return fmt.Errorf("osmpbf: unsupported required feature %q", feature)
+			}
+			continue
+		}
+		if err := r.skip(wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type blockContext struct {
+	strings     [][]byte
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func (c *blockContext) coord(offset int64, v int64) float64 {
+	return 1e-9 * float64(offset+c.granularity*v)
+}
+
+func (c *blockContext) str(i uint64) (string, error) {
+	if i >= uint64(len(c.strings)) {
+		return "", fmt.Errorf("osmpbf: string index %d out of range", i)
+	}
+	return string(c.strings[i]), nil
+}
+
+func decodePrimitiveBlock(data []byte) (*Block, error) {
+	ctx := blockContext{granularity: 100}
+	var groups [][]byte
+
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case num == 1 && wire == wireBytes:
+			table, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			if ctx.strings, err = decodeStringTable(table); err != nil {
+				return nil, err
+			}
+		case num == 2 && wire == wireBytes:
+			group, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, group)
+		case num == 17 && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			ctx.granularity = int64(v)
+		case num == 19 && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			ctx.latOffset = int64(v)
+		case num == 20 && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			ctx.lonOffset = int64(v)
+		default:
+			if err := r.skip(wire); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Groups are decoded after the loop as the string table and offsets may
+	// follow them
+	block := &Block{}
+	for _, group := range groups {
+		if err := decodeGroup(&ctx, group, block); err != nil {
+			return nil, err
+		}
+	}
+	return block, nil
+}
+
+func decodeStringTable(data []byte) ([][]byte, error) {
+	var out [][]byte
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if num == 1 && wire == wireBytes {
+			s, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, s)
+			continue
+		}
+		if err := r.skip(wire); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func decodeGroup(ctx *blockContext, data []byte, block *Block) error {
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return err
+		}
+		if wire != wireBytes {
+			if err := r.skip(wire); err != nil {
+				return err
+			}
+			continue
+		}
+		msg, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			node, err := decodeNode(ctx, msg)
+			if err != nil {
+				return err
+			}
+			block.Nodes = append(block.Nodes, node)
+		case 2:
+			if block.Nodes, err = decodeDenseNodes(ctx, msg, block.Nodes); err != nil {
+				return err
+			}
+		case 3:
+			way, err := decodeWay(ctx, msg)
+			if err != nil {
+				return err
+			}
+			block.Ways = append(block.Ways, way)
+		}
+	}
+	return nil
+}
+
+func decodeNode(ctx *blockContext, data []byte) (Node, error) {
+	var node Node
+	var lat, lon int64
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return node, err
+		}
+		if wire == wireVarint && (num == 1 || num == 8 || num == 9) {
+			v, err := r.varint()
+			if err != nil {
+				return node, err
+			}
+			switch num {
+			case 1:
+				node.ID = zigzag(v)
+			case 8:
+				lat = zigzag(v)
+			case 9:
+				lon = zigzag(v)
+			}
+			continue
+		}
+		if err := r.skip(wire); err != nil {
+			return node, err
+		}
+	}
+	node.Lat = ctx.coord(ctx.latOffset, lat)
+	node.Lon = ctx.coord(ctx.lonOffset, lon)
+	return node, nil
+}
+
+func decodeDenseNodes(ctx *blockContext, data []byte, out []Node) ([]Node, error) {
+	var ids, lats, lons []uint64
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		switch num {
+		case 1:
+			ids, err = r.packed(wire, ids)
+		case 8:
+			lats, err = r.packed(wire, lats)
+		case 9:
+			lons, err = r.packed(wire, lons)
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return nil, errors.New("osmpbf: dense nodes have mismatched lengths")
+	}
+
+	var id, lat, lon int64
+	for i := range ids {
+		id += zigzag(ids[i])
+		lat += zigzag(lats[i])
+		lon += zigzag(lons[i])
+		out = append(out, Node{
+			ID:  id,
+			Lat: ctx.coord(ctx.latOffset, lat),
+			Lon: ctx.coord(ctx.lonOffset, lon),
+		})
+	}
+	return out, nil
+}
+
+func decodeWay(ctx *blockContext, data []byte) (Way, error) {
+	var way Way
+	var keys, vals, refs []uint64
+	r := pbReader{buf: data}
+	for !r.done() {
+		num, wire, err := r.field()
+		if err != nil {
+			return way, err
+		}
+		switch {
+		case num == 1 && wire == wireVarint:
+			v, err := r.varint()
+			if err != nil {
+				return way, err
+			}
+			way.ID = int64(v)
+		case num == 2:
+			keys, err = r.packed(wire, keys)
+		case num == 3:
+			vals, err = r.packed(wire, vals)
+		case num == 8:
+			refs, err = r.packed(wire, refs)
+		default:
+			err = r.skip(wire)
+		}
+		if err != nil {
+			return way, err
+		}
+	}
+	if len(keys) != len(vals) {
+		return way, fmt.Errorf("osmpbf: way %d has mismatched tags", way.ID)
+	}
+
+	if len(keys) > 0 {
+		way.Tags = make(map[string]string, len(keys))
+		for i := range keys {
+			k, err := ctx.str(keys[i])
+			if err != nil {
+				return way, err
+			}
+			v, err := ctx.str(vals[i])
+			if err != nil {
+				return way, err
+			}
+			way.Tags[k] = v
+		}
+	}
+
+	var ref int64
+	way.Refs = make([]int64, len(refs))
+	for i := range refs {
+		ref += zigzag(refs[i])
+		way.Refs[i] = ref
+	}
+	return way, nil
+}
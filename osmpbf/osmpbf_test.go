@@ -0,0 +1,103 @@
+package osmpbf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// testdata/sample.osm.pbf has a header, then
+//
+//   - a zlib compressed block with nodes 1-3 as dense nodes, node 2 tagged,
+//     and node 4 as a plain node
+//   - a blob of an unknown type
+//   - a raw block with ways 10 and 11, then node 5 as a dense node using a
+//     granularity of 1000 and lat/lon offsets, which follow the groups
+func readSample(t *testing.T) []byte {
+	data, err := os.ReadFile("testdata/sample.osm.pbf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readAll(data []byte) ([]*Block, error) {
+	r := NewReader(bytes.NewReader(data))
+	var blocks []*Block
+	for {
+		block, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return blocks, nil
+		} else if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+func TestReadSample(t *testing.T) {
+	blocks, err := readAll(readSample(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(blocks))
+	}
+
+	wantNodes := [][]Node{
+		{
+			{ID: 1, Lat: 56.5, Lon: -3.5},
+			{ID: 2, Lat: 56.6, Lon: -3.4},
+			{ID: 3, Lat: 56.7, Lon: -3.3},
+			{ID: 4, Lat: -33.9, Lon: 151.2},
+		},
+		{
+			{ID: 5, Lat: 1.0015, Lon: 2.0025},
+		},
+	}
+	for i, block := range blocks {
+		if len(block.Nodes) != len(wantNodes[i]) {
+			t.Fatalf("block %d: got %d nodes, want %d", i, len(block.Nodes), len(wantNodes[i]))
+		}
+		for j, want := range wantNodes[i] {
+			got := block.Nodes[j]
+			if got.ID != want.ID || math.Abs(got.Lat-want.Lat) > 1e-9 || math.Abs(got.Lon-want.Lon) > 1e-9 {
+				t.Errorf("block %d: node %d = %+v, want %+v", i, j, got, want)
+			}
+		}
+	}
+
+	if len(blocks[0].Ways) != 0 {
+		t.Errorf("block 0: got %d ways, want 0", len(blocks[0].Ways))
+	}
+	wantWays := []Way{
+		{ID: 10, Tags: map[string]string{"highway": "residential", "name": "Main Street"}, Refs: []int64{1, 2, 3}},
+		{ID: 11, Tags: map[string]string{"highway": "track", "surface": "gravel"}, Refs: []int64{3, 4}},
+	}
+	if !reflect.DeepEqual(blocks[1].Ways, wantWays) {
+		t.Errorf("block 1: ways = %+v, want %+v", blocks[1].Ways, wantWays)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := readSample(t)
+	for _, size := range []int{2, 10, len(data) - 1} {
+		_, err := readAll(data[:size])
+		if !errors.Is(err, errTruncated) {
+			t.Errorf("truncated to %d bytes: err = %v, want %v", size, err, errTruncated)
+		}
+	}
+}
+
+func TestUnsupportedFeature(t *testing.T) {
+	// The header blob is stored raw, so its features can be swapped in place
+	data := bytes.Replace(readSample(t), []byte("DenseNodes"), []byte("HistoricalInformation")[:10], 1)
+	_, err := readAll(data)
+	if err == nil {
+		t.Error("expected error for unsupported required feature")
+	}
+}
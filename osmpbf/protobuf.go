@@ -0,0 +1,117 @@
+package osmpbf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Just enough of the protobuf wire format to read the OSM schema.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("osmpbf: truncated message")
+
+type pbReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *pbReader) done() bool {
+	return r.pos >= len(r.buf)
+}
+
+func (r *pbReader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if r.pos >= len(r.buf) {
+			return 0, errTruncated
+		}
+		b := r.buf[r.pos]
+		r.pos++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("osmpbf: varint overflow")
+}
+
+// field reads the next field key
+func (r *pbReader) field() (num int, wire int, err error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (r *pbReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.buf)-r.pos) {
+		return nil, errTruncated
+	}
+	out := r.buf[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return out, nil
+}
+
+func (r *pbReader) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := r.varint()
+		return err
+	case wireFixed64:
+		r.pos += 8
+	case wireBytes:
+		_, err := r.bytes()
+		return err
+	case wireFixed32:
+		r.pos += 4
+	default:
+		return fmt.Errorf("osmpbf: unsupported wire type %d", wire)
+	}
+	if r.pos > len(r.buf) {
+		return errTruncated
+	}
+	return nil
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// packed appends the values of a repeated varint field, which may be encoded
+// packed or as individual fields.
+func (r *pbReader) packed(wire int, out []uint64) ([]uint64, error) {
+	if wire == wireVarint {
+		v, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		return append(out, v), nil
+	}
+	if wire != wireBytes {
+		return nil, fmt.Errorf("osmpbf: unexpected wire type %d for repeated field", wire)
+	}
+	data, err := r.bytes()
+	if err != nil {
+		return nil, err
+	}
+	sub := pbReader{buf: data}
+	for !sub.done() {
+		v, err := sub.varint()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
@@ -0,0 +1,249 @@
+// Package queue is a work queue backed by the work_queue table.
+//
+// Items are identified by a string (usually a flickr ID) and are unique within
+// a queue, so enqueueing the same item twice is harmless. A claimed item is
+// leased to the worker until it is acked, failed, or the lease expires, so an
+// item is never lost if a worker crashes part way through. Items that fail
+// MaxAttempts times are kept as dead for inspection rather than retried.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Names of the queues we use.
+const (
+	FlickrExif = "flickr-exif"
+)
+
+// DB is satisfied by *pgx.Conn, *pgxpool.Pool and pgx.Tx.
+type DB interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+type Queue struct {
+	Name string
+
+	// Lease is how long a claimed item is hidden from other workers.
+	Lease time.Duration
+	// MaxAttempts is how many times an item is claimed before it is dead.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, doubling each attempt
+	// up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func New(name string) *Queue {
+	return &Queue{
+		Name:        name,
+		Lease:       15 * time.Minute,
+		MaxAttempts: 8,
+		MinBackoff:  time.Minute,
+		MaxBackoff:  24 * time.Hour,
+	}
+}
+
+type Item struct {
+	Item string
+	// Attempts includes the current one
+	Attempts int
+}
+
+// Enqueue adds items, ignoring any already in the queue (including dead
+// ones). It returns how many were added.
+func (q *Queue) Enqueue(ctx context.Context, db DB, items ...string) (int, error) {
+	if len(items) == 0 {
+		return 0, nil
+	}
+	tag, err := db.Exec(ctx, `
+		INSERT INTO work_queue (queue, item)
+		SELECT $1, unnest($2::text[])
+		ON CONFLICT (queue, item) DO NOTHING
+	`, q.Name, items)
+	if err != nil {
+		return 0, fmt.Errorf("queue %s: enqueue: %w", q.Name, err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Claim leases up to n ready items, oldest first.
+func (q *Queue) Claim(ctx context.Context, db DB, n int) ([]Item, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE work_queue
+		SET claimed_until = CURRENT_TIMESTAMP + make_interval(secs => $3),
+			attempts = attempts + 1
+		WHERE (queue, item) IN (SELECT queue, item
+								FROM work_queue
+								WHERE queue = $1
+								  AND dead_at IS NULL
+								  AND ready_at <= CURRENT_TIMESTAMP
+								  AND (claimed_until IS NULL OR claimed_until < CURRENT_TIMESTAMP)
+								ORDER BY ready_at
+								LIMIT $2 FOR UPDATE SKIP LOCKED)
+		RETURNING item, attempts
+	`, q.Name, n, q.Lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: claim: %w", q.Name, err)
+	}
+	defer rows.Close()
+
+	var out []Item
+	for rows.Next() {
+		var item Item
+		if err := rows.Scan(&item.Item, &item.Attempts); err != nil {
+			return nil, fmt.Errorf("queue %s: claim: %w", q.Name, err)
+		}
+		out = append(out, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queue %s: claim: %w", q.Name, err)
+	}
+	return out, nil
+}
+
+// Extend renews the lease on items, for a worker whose batch takes longer than
+// one lease to get through. It returns the items still leased to the worker,
+// leaving out any whose lease already expired, as another worker may have
+// claimed them since.
+func (q *Queue) Extend(ctx context.Context, db DB, items []Item) ([]Item, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(items))
+	attempts := make([]int32, len(items))
+	for i, item := range items {
+		names[i] = item.Item
+		attempts[i] = int32(item.Attempts)
+	}
+	rows, err := db.Query(ctx, `
+		UPDATE work_queue
+		SET claimed_until = CURRENT_TIMESTAMP + make_interval(secs => $4)
+		WHERE queue = $1
+		  AND (item, attempts) IN (SELECT unnest($2::text[]), unnest($3::int[]))
+		  AND dead_at IS NULL
+		  AND claimed_until >= CURRENT_TIMESTAMP
+		RETURNING item, attempts
+	`, q.Name, names, attempts, q.Lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("queue %s: extend: %w", q.Name, err)
+	}
+	defer rows.Close()
+
+	var out []Item
+	for rows.Next() {
+		var item Item
+		if err := rows.Scan(&item.Item, &item.Attempts); err != nil {
+			return nil, fmt.Errorf("queue %s: extend: %w", q.Name, err)
+		}
+		out = append(out, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queue %s: extend: %w", q.Name, err)
+	}
+	return out, nil
+}
+
+// Ack removes an item that was processed successfully.
+func (q *Queue) Ack(ctx context.Context, db DB, item string) error {
+	_, err := db.Exec(ctx, `DELETE FROM work_queue WHERE queue = $1 AND item = $2`, q.Name, item)
+	if err != nil {
+		return fmt.Errorf("queue %s: ack %s: %w", q.Name, item, err)
+	}
+	return nil
+}
+
+// Fail releases an item to be retried after a backoff, or marks it dead if it
+// has used up its attempts.
+func (q *Queue) Fail(ctx context.Context, db DB, item Item, cause error) error {
+	var err error
+	if item.Attempts >= q.MaxAttempts {
+		_, err = db.Exec(ctx, `
+			UPDATE work_queue
+			SET dead_at = CURRENT_TIMESTAMP, claimed_until = NULL, last_error = $3
+			WHERE queue = $1 AND item = $2
+		`, q.Name, item.Item, cause.Error())
+	} else {
+		_, err = db.Exec(ctx, `
+			UPDATE work_queue
+			SET ready_at = CURRENT_TIMESTAMP + make_interval(secs => $3),
+				claimed_until = NULL, last_error = $4
+			WHERE queue = $1 AND item = $2
+		`, q.Name, item.Item, q.backoff(item.Attempts).Seconds(), cause.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("queue %s: fail %s: %w", q.Name, item.Item, err)
+	}
+	return nil
+}
+
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.MinBackoff
+	for i := 1; i < attempts && wait < q.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > q.MaxBackoff {
+		wait = q.MaxBackoff
+	}
+	return wait
+}
+
+// IsDead reports whether item has used up its attempts. Enqueue ignores dead
+// items, so a producer waiting on one would otherwise wait forever.
+func (q *Queue) IsDead(ctx context.Context, db DB, item string) (bool, error) {
+	var dead bool
+	err := db.QueryRow(ctx, `
+		SELECT exists (SELECT 1 FROM work_queue WHERE queue = $1 AND item = $2 AND dead_at IS NOT NULL)
+	`, q.Name, item).Scan(&dead)
+	if err != nil {
+		return false, fmt.Errorf("queue %s: is dead %s: %w", q.Name, item, err)
+	}
+	return dead, nil
+}
+
+type Stats struct {
+	Queue string
+	// Ready can be claimed now
+	Ready int
+	// Claimed are leased to a worker
+	Claimed int
+	// Waiting are backing off after a failure
+	Waiting int
+	Dead    int
+}
+
+// LoadStats counts the items in every queue.
+func LoadStats(ctx context.Context, db DB) ([]Stats, error) {
+	rows, err := db.Query(ctx, `
+		SELECT queue,
+			   count(*) filter ( where dead_at IS NULL AND ready_at <= CURRENT_TIMESTAMP
+				   AND (claimed_until IS NULL OR claimed_until < CURRENT_TIMESTAMP) ),
+			   count(*) filter ( where dead_at IS NULL AND claimed_until >= CURRENT_TIMESTAMP ),
+			   count(*) filter ( where dead_at IS NULL AND ready_at > CURRENT_TIMESTAMP
+				   AND (claimed_until IS NULL OR claimed_until < CURRENT_TIMESTAMP) ),
+			   count(*) filter ( where dead_at IS NOT NULL )
+		FROM work_queue
+		GROUP BY queue
+		ORDER BY queue
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Stats
+	for rows.Next() {
+		var s Stats
+		if err := rows.Scan(&s.Queue, &s.Ready, &s.Claimed, &s.Waiting, &s.Dead); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,236 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	q := New("test")
+	q.MinBackoff = time.Minute
+	q.MaxBackoff = 10 * time.Minute
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got := q.backoff(tc.attempts); got != tc.want {
+			t.Errorf("backoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+// The queue is tested against QUEUE_TEST_DATABASE_URL, in a schema created
+// for each test and dropped afterwards.
+func testDB(t *testing.T) *pgx.Conn {
+	url := os.Getenv("QUEUE_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("QUEUE_TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close(ctx) })
+
+	schema := fmt.Sprintf("queue_test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema+"; SET search_path TO "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE") })
+
+	migration, err := os.ReadFile("../migrations/0020_create_work_queue.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(ctx, string(migration)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func claimed(items []Item) string {
+	var out []string
+	for _, item := range items {
+		out = append(out, fmt.Sprintf("%s/%d", item.Item, item.Attempts))
+	}
+	return fmt.Sprint(out)
+}
+
+func stats(t *testing.T, db DB) Stats {
+	all, err := LoadStats(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Fatalf("got stats for %d queues, want 1", len(all))
+	}
+	return all[0]
+}
+
+func TestEnqueueDedupes(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New("test")
+
+	if added, err := q.Enqueue(ctx, db, "a", "b", "a"); err != nil || added != 2 {
+		t.Fatalf("Enqueue = %d, %v, want 2 added", added, err)
+	}
+	if added, err := q.Enqueue(ctx, db, "b", "c"); err != nil || added != 1 {
+		t.Fatalf("Enqueue = %d, %v, want only c added", added, err)
+	}
+	// Queues are independent
+	if added, err := New("other").Enqueue(ctx, db, "a"); err != nil || added != 1 {
+		t.Fatalf("Enqueue to another queue = %d, %v, want 1 added", added, err)
+	}
+
+	items, err := q.Claim(ctx, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Errorf("claimed %s, want a, b and c once each", claimed(items))
+	}
+	// Claimed items are still in the queue
+	if added, err := q.Enqueue(ctx, db, "a"); err != nil || added != 0 {
+		t.Errorf("Enqueue of a claimed item = %d, %v, want 0 added", added, err)
+	}
+	if err := q.Ack(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := q.Enqueue(ctx, db, "a"); err != nil || added != 1 {
+		t.Errorf("Enqueue after ack = %d, %v, want 1 added", added, err)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New("test")
+	q.Lease = time.Second
+
+	if _, err := q.Enqueue(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.Claim(ctx, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := claimed(first); got != "[a/1]" {
+		t.Fatalf("claimed %s, want [a/1]", got)
+	}
+	if again, err := q.Claim(ctx, db, 10); err != nil || len(again) != 0 {
+		t.Fatalf("second claim = %s, %v, want nothing while leased", claimed(again), err)
+	}
+	if s := stats(t, db); s.Claimed != 1 || s.Ready != 0 {
+		t.Errorf("stats %+v, want 1 claimed", s)
+	}
+	if extended, err := q.Extend(ctx, db, first); err != nil || claimed(extended) != "[a/1]" {
+		t.Fatalf("Extend = %s, %v, want [a/1]", claimed(extended), err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if extended, err := q.Extend(ctx, db, first); err != nil || len(extended) != 0 {
+		t.Fatalf("Extend after expiry = %s, %v, want nothing", claimed(extended), err)
+	}
+	second, err := q.Claim(ctx, db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := claimed(second); got != "[a/2]" {
+		t.Fatalf("claim after expiry = %s, want [a/2]", got)
+	}
+	// The first worker's lease is gone even though the item is leased again
+	if extended, err := q.Extend(ctx, db, first); err != nil || len(extended) != 0 {
+		t.Errorf("Extend of a reclaimed item = %s, %v, want nothing", claimed(extended), err)
+	}
+}
+
+func TestFailBacksOffThenDies(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New("test")
+	q.MaxAttempts = 2
+	cause := errors.New("boom")
+
+	if _, err := q.Enqueue(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	items, err := q.Claim(ctx, db, 10)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("claim = %s, %v", claimed(items), err)
+	}
+	if err := q.Fail(ctx, db, items[0], cause); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := q.Claim(ctx, db, 10); err != nil || len(again) != 0 {
+		t.Fatalf("claim while backing off = %s, %v, want nothing", claimed(again), err)
+	}
+	if s := stats(t, db); s.Waiting != 1 || s.Dead != 0 {
+		t.Errorf("stats %+v, want 1 waiting", s)
+	}
+
+	// Skip to the end of the backoff
+	if _, err := db.Exec(ctx, `UPDATE work_queue SET ready_at = CURRENT_TIMESTAMP`); err != nil {
+		t.Fatal(err)
+	}
+	items, err = q.Claim(ctx, db, 10)
+	if err != nil || claimed(items) != "[a/2]" {
+		t.Fatalf("claim after backoff = %s, %v, want [a/2]", claimed(items), err)
+	}
+	if err := q.Fail(ctx, db, items[0], cause); err != nil {
+		t.Fatal(err)
+	}
+
+	if dead, err := q.IsDead(ctx, db, "a"); err != nil || !dead {
+		t.Errorf("IsDead = %v, %v, want dead after %d attempts", dead, err, q.MaxAttempts)
+	}
+	if s := stats(t, db); s.Dead != 1 || s.Waiting != 0 || s.Ready != 0 {
+		t.Errorf("stats %+v, want 1 dead", s)
+	}
+	if _, err := db.Exec(ctx, `UPDATE work_queue SET ready_at = CURRENT_TIMESTAMP`); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := q.Claim(ctx, db, 10); err != nil || len(again) != 0 {
+		t.Errorf("claim of a dead item = %s, %v, want nothing", claimed(again), err)
+	}
+	if added, err := q.Enqueue(ctx, db, "a"); err != nil || added != 0 {
+		t.Errorf("Enqueue of a dead item = %d, %v, want it ignored", added, err)
+	}
+
+	var lastError string
+	if err := db.QueryRow(ctx, `SELECT last_error FROM work_queue WHERE item = 'a'`).Scan(&lastError); err != nil {
+		t.Fatal(err)
+	}
+	if lastError != "boom" {
+		t.Errorf("last_error = %q, want %q", lastError, "boom")
+	}
+}
+
+func TestIsDeadOfLiveItems(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	q := New("test")
+
+	if _, err := q.Enqueue(ctx, db, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "missing"} {
+		if dead, err := q.IsDead(ctx, db, item); err != nil || dead {
+			t.Errorf("IsDead(%s) = %v, %v, want false", item, dead, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Package ratelimit provides token bucket rate limiters shared between
+// processes through Redis, so that every replica of every binary draws from
+// the same budget.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys for the budgets we share. Anything that talks to Flickr must use these.
+const (
+	KeyFlickrAPI    = "cg-ratelimit:flickr-api"
+	KeyFlickrStatic = "cg-ratelimit:flickr-static"
+)
+
+var DefaultFlickrAPIBudget = Budget{Rate: 1 / 1.1, Burst: 1}
+var DefaultFlickrStaticBudget = Budget{Rate: 1 / 1.5, Burst: 1}
+
+// FlickrAPI returns the limiter for Flickr REST API calls, configured by
+// RATELIMIT_FLICKR_API. rdb may be nil, in which case the limit is local.
+func FlickrAPI(rdb *redis.Client) (*Limiter, error) {
+	budget, err := BudgetFromEnv("RATELIMIT_FLICKR_API", DefaultFlickrAPIBudget)
+	if err != nil {
+		return nil, err
+	}
+	return New(rdb, KeyFlickrAPI, budget), nil
+}
+
+// FlickrStatic returns the limiter for fetching images from
+// live.staticflickr.com, configured by RATELIMIT_FLICKR_STATIC.
+func FlickrStatic(rdb *redis.Client) (*Limiter, error) {
+	budget, err := BudgetFromEnv("RATELIMIT_FLICKR_STATIC", DefaultFlickrStaticBudget)
+	if err != nil {
+		return nil, err
+	}
+	return New(rdb, KeyFlickrStatic, budget), nil
+}
+
+// Budget allows Rate requests per second on average, with up to Burst
+// requests at once.
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseBudget parses "<n>/<duration>" with an optional ":<burst>" suffix, for
+// example "1/1.1s" or "100/1m:10". Burst defaults to 1.
+func ParseBudget(s string) (Budget, error) {
+	spec, burstS, hasBurst := strings.Cut(s, ":")
+	countS, durS, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Budget{}, fmt.Errorf("invalid budget %q: expected <n>/<duration>", s)
+	}
+	count, err := strconv.ParseFloat(countS, 64)
+	if err != nil || count <= 0 {
+		return Budget{}, fmt.Errorf("invalid budget %q: bad count", s)
+	}
+	dur, err := time.ParseDuration(durS)
+	if err != nil || dur <= 0 {
+		return Budget{}, fmt.Errorf("invalid budget %q: bad duration", s)
+	}
+	burst := 1
+	if hasBurst {
+		burst, err = strconv.Atoi(burstS)
+		if err != nil || burst < 1 {
+			return Budget{}, fmt.Errorf("invalid budget %q: bad burst", s)
+		}
+	}
+	return Budget{Rate: count / dur.Seconds(), Burst: burst}, nil
+}
+
+func BudgetFromEnv(name string, fallback Budget) (Budget, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	budget, err := ParseBudget(value)
+	if err != nil {
+		return Budget{}, fmt.Errorf("%s: %w", name, err)
+	}
+	return budget, nil
+}
+
+// Limiter is a token bucket stored in Redis. If Redis can't be reached it
+// falls back to a bucket local to this process with the same budget.
+type Limiter struct {
+	rdb    *redis.Client
+	key    string
+	budget Budget
+	local  *localBucket
+
+	lastWarnMu sync.Mutex
+	lastWarn   time.Time
+}
+
+func New(rdb *redis.Client, key string, budget Budget) *Limiter {
+	return &Limiter{
+		rdb:    rdb,
+		key:    key,
+		budget: budget,
+		local:  &localBucket{budget: budget, tokens: float64(budget.Burst)},
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	for {
+		wait, err := l.reserve(ctx)
+		if err != nil {
+			return err
+		}
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Allow takes a token if one is available now, without waiting for one.
+func (l *Limiter) Allow(ctx context.Context) (bool, error) {
+	wait, err := l.reserve(ctx)
+	if err != nil {
+		return false, err
+	}
+	return wait <= 0, nil
+}
+
+func (l *Limiter) reserve(ctx context.Context) (time.Duration, error) {
+	if l.rdb == nil {
+		return l.local.reserve(time.Now()), nil
+	}
+
+	waitMs, err := takeScript.Run(ctx, l.rdb, []string{l.key}, l.budget.Rate, l.budget.Burst).Int64()
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return 0, err
+		}
+		l.warn(err)
+		return l.local.reserve(time.Now()), nil
+	}
+	return time.Duration(waitMs) * time.Millisecond, nil
+}
+
+func (l *Limiter) warn(err error) {
+	l.lastWarnMu.Lock()
+	defer l.lastWarnMu.Unlock()
+	if time.Since(l.lastWarn) < time.Minute {
+		return
+	}
+	l.lastWarn = time.Now()
+	log.Printf("ratelimit: redis unavailable for %s, using local limit: %s", l.key, err)
+}
+
+// takeScript takes a token if one is available, returning 0, or otherwise
+// returns how many milliseconds until one will be. It uses the Redis server's
+// clock so that clients with skewed clocks agree.
+var takeScript = redis.NewScript(`
+redis.replicate_commands()
+
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 60000)
+return wait
+`)
+
+type localBucket struct {
+	budget Budget
+	mu     sync.Mutex
+	tokens float64
+	ts     time.Time
+}
+
+func (b *localBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.ts.IsZero() {
+		elapsed := now.Sub(b.ts).Seconds()
+		b.tokens = math.Min(float64(b.budget.Burst), b.tokens+elapsed*b.budget.Rate)
+	}
+	b.ts = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.budget.Rate * float64(time.Second))
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseBudget(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    Budget
+		wantErr bool
+	}{
+		{"1/1.1s", Budget{Rate: 1 / 1.1, Burst: 1}, false},
+		{"100/1m:10", Budget{Rate: 100.0 / 60, Burst: 10}, false},
+		{"3/1s:1", Budget{Rate: 3, Burst: 1}, false},
+		{"1", Budget{}, true},
+		{"0/1s", Budget{}, true},
+		{"1/0s", Budget{}, true},
+		{"1/1s:0", Budget{}, true},
+		{"1/fast", Budget{}, true},
+	}
+	for _, tc := range cases {
+		got, err := ParseBudget(tc.spec)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseBudget(%q) = %+v, want error", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("ParseBudget(%q) = %+v, %v, want %+v", tc.spec, got, err, tc.want)
+		}
+	}
+}
+
+func TestLocalBucket(t *testing.T) {
+	b := &localBucket{budget: Budget{Rate: 1, Burst: 2}, tokens: 2}
+	start := time.Now()
+	at := func(d time.Duration) time.Duration { return b.reserve(start.Add(d)) }
+
+	steps := []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		// The burst is available at once
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		// Refills at the rate, and waiting doesn't take a token
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, 0},
+		// Never refills beyond the burst
+		{10 * time.Second, 0},
+		{10 * time.Second, 0},
+		{10 * time.Second, time.Second},
+	}
+	for i, step := range steps {
+		if got := at(step.at); got != step.want {
+			t.Errorf("step %d at %s: wait %s, want %s", i, step.at, got, step.want)
+		}
+	}
+}
+
+func TestFallsBackToLocal(t *testing.T) {
+	// Nothing listens on port 1
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	defer rdb.Close()
+	l := New(rdb, "cg-ratelimit:test", Budget{Rate: 10, Burst: 1})
+	ctx := context.Background()
+
+	if ok, err := l.Allow(ctx); err != nil || !ok {
+		t.Fatalf("first Allow = %v, %v, want a token from the local bucket", ok, err)
+	}
+	if ok, err := l.Allow(ctx); err != nil || ok {
+		t.Fatalf("second Allow = %v, %v, want no token", ok, err)
+	}
+
+	start := time.Now()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Wait returned after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestWaitCanceled(t *testing.T) {
+	l := New(nil, "cg-ratelimit:test", Budget{Rate: 0.1, Burst: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// The Redis bucket is tested against RATELIMIT_TEST_REDIS_ADDR, for example
+// a throwaway `docker run -p 6379:6379 redis`.
+func testRedis(t *testing.T) *redis.Client {
+	addr := os.Getenv("RATELIMIT_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("RATELIMIT_TEST_REDIS_ADDR not set")
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { _ = rdb.Close() })
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return rdb
+}
+
+func testKey(t *testing.T, rdb *redis.Client) string {
+	key := fmt.Sprintf("cg-ratelimit:test:%s:%d", t.Name(), time.Now().UnixNano())
+	t.Cleanup(func() { rdb.Del(context.Background(), key) })
+	return key
+}
+
+func TestRedisBucketSharedBetweenLimiters(t *testing.T) {
+	rdb := testRedis(t)
+	key := testKey(t, rdb)
+	budget := Budget{Rate: 10, Burst: 3}
+	a := New(rdb, key, budget)
+	b := New(rdb, key, budget)
+	ctx := context.Background()
+
+	// The burst is shared, so between them they get three tokens
+	for i, l := range []*Limiter{a, b, a} {
+		if ok, err := l.Allow(ctx); err != nil || !ok {
+			t.Fatalf("Allow %d = %v, %v, want a token", i, ok, err)
+		}
+	}
+	wait, err := b.reserve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("wait with an empty bucket = %s, want up to 100ms", wait)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if ok, err := b.Allow(ctx); err != nil || !ok {
+		t.Errorf("Allow after refilling = %v, %v, want a token", ok, err)
+	}
+}
+
+func TestRedisBucketExpires(t *testing.T) {
+	rdb := testRedis(t)
+	key := testKey(t, rdb)
+	l := New(rdb, key, Budget{Rate: 1, Burst: 2})
+
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := rdb.PTTL(context.Background(), key).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Long enough to refill the burst, plus a minute
+	if ttl <= time.Minute || ttl > time.Minute+2*time.Second {
+		t.Errorf("ttl = %s, want %s", ttl, time.Minute+2*time.Second)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+)
+
+// previewDHash decodes the preview and returns its difference hash. Near
+// identical photos, such as shots from a burst, differ in only a few bits.
+func previewDHash(data []byte) (int64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	// Stored as BIGINT, the bits are what matter
+	return int64(dHash(img)), nil
+}
+
+// dHash shrinks img to 9x8 grey pixels by averaging, then sets a bit for
+// each pixel that is darker than its neighbour to the right.
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	bounds := img.Bounds()
+
+	var grey [h][w]float64
+	for y := 0; y < h; y++ {
+		y0, y1 := cellSpan(bounds.Min.Y, bounds.Dy(), y, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := cellSpan(bounds.Min.X, bounds.Dx(), x, w)
+			var sum float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, b, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+				}
+			}
+			grey[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grey[y][x] < grey[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// cellSpan returns the source pixels covered by cell i of n along an axis
+// starting at min of length size. Every cell covers at least one pixel, so
+// cells overlap in images smaller than the hash.
+func cellSpan(min, size, i, n int) (int, int) {
+	start := min + i*size/n
+	end := min + (i+1)*size/n
+	if end <= start {
+		end = start + 1
+	}
+	if end > min+size {
+		start, end = min+size-1, min+size
+	}
+	return start, end
+}
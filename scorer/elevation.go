@@ -1,59 +1,105 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"contourguessr-ingest/elevation"
 	"fmt"
-	"net/http"
-	"net/url"
+	"os"
 )
 
-func getElevation(lng, lat float64) (float64, error) {
-	u, err := url.Parse("http://dev.virtualearth.net/REST/v1/Elevation/List")
-	if err != nil {
-		return 0, err
+var terrain elevation.Source
+
+// geoid converts altitudes to a common datum before we compare them. It is
+// nil unless GEOID_GRID is set, and only needed for altitudes recorded with
+// different datums.
+var geoid *elevation.Geoid
+
+// terrainDatum is what we request terrain heights relative to. It matches
+// EXIF altitudes and DEM tiles, so new results need no conversion.
+const terrainDatum = elevation.MeanSeaLevel
+
+// setupElevation picks the terrain backend from ELEVATION_BACKEND, either
+// "bing" (the default, using BING_MAPS_KEY) or "dem" (tiles in DEM_DIR). With
+// the dem backend BING_MAPS_KEY is optional and used for points outside the
+// tiles.
+//
+// GEOID_GRID is optional. It should be EGM96, the model GPS receivers use for
+// sea level, and is needed to compare GPS altitudes with older terrain
+// altitudes, which were requested relative to the ellipsoid.
+func setupElevation() error {
+	if geoidGrid := os.Getenv("GEOID_GRID"); geoidGrid != "" {
+		var err error
+		geoid, err = elevation.LoadGeoid(geoidGrid)
+		if err != nil {
+			return err
+		}
 	}
 
-	q := u.Query()
-	q.Add("heights", "ellipsoid")
-	q.Add("points", fmt.Sprintf("%f,%f", lat, lng))
-	q.Add("key", bingMapsKey)
-	u.RawQuery = q.Encode()
+	bingMapsKey := os.Getenv("BING_MAPS_KEY")
 
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		return 0, err
+	switch backend := os.Getenv("ELEVATION_BACKEND"); backend {
+	case "", "bing":
+		if bingMapsKey == "" {
+			return fmt.Errorf("BING_MAPS_KEY not set")
+		}
+		terrain = elevation.NewBing(bingMapsKey)
+	case "dem":
+		demDir := os.Getenv("DEM_DIR")
+		if demDir == "" {
+			return fmt.Errorf("DEM_DIR not set")
+		}
+		cacheMB, err := envInt("ELEVATION_CACHE_MB", 512)
+		if err != nil {
+			return err
+		}
+
+		dem, err := elevation.OpenDEM(demDir, int64(cacheMB)<<20)
+		if err != nil {
+			return err
+		}
+		dem.Geoid = geoid
+
+		terrain = dem
+		if bingMapsKey != "" {
+			terrain = elevation.WithFallback(dem, elevation.NewBing(bingMapsKey))
+		}
+	default:
+		return fmt.Errorf("unknown ELEVATION_BACKEND %q", backend)
 	}
+	return nil
+}
+
+// getElevation returns the terrain height relative to terrainDatum
+func getElevation(ctx context.Context, lng, lat float64) (float64, error) {
+	return terrain.Elevation(ctx, lng, lat, terrainDatum)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// altitudeDifference returns how far altitude a is above altitude b, each
+// stored with its datum. Altitudes with the same datum are compared as they
+// are, otherwise both are converted to the ellipsoid with geoid.
+func altitudeDifference(lng, lat, a float64, aDatum string, b float64, bDatum string) (float64, error) {
+	from, err := elevation.ParseDatum(aDatum)
 	if err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("unexpected http status %d", resp.StatusCode)
+	to, err := elevation.ParseDatum(bDatum)
+	if err != nil {
+		return 0, err
 	}
-
-	var respData struct {
-		ResourceSets []struct {
-			Resources []struct {
-				Elevations []float64
-			}
-		}
+	if from == to {
+		return a - b, nil
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&respData); err != nil {
-		return 0, err
+	if geoid == nil {
+		return 0, fmt.Errorf("GEOID_GRID is needed to compare %s and %s altitudes", from, to)
 	}
 
-	if len(respData.ResourceSets) != 1 {
-		return 0, fmt.Errorf("unexpected number of ResourceSets: %d", len(respData.ResourceSets))
-	}
-	if len(respData.ResourceSets[0].Resources) != 1 {
-		return 0, fmt.Errorf("unexpected number of Resources: %d", len(respData.ResourceSets[0].Resources))
+	a, err = geoid.Convert(lng, lat, a, from, elevation.Ellipsoid)
+	if err != nil {
+		return 0, err
 	}
-	if len(respData.ResourceSets[0].Resources[0].Elevations) != 1 {
-		return 0, fmt.Errorf("unexpected number of Elevations: %d", len(respData.ResourceSets[0].Resources[0].Elevations))
+	b, err = geoid.Convert(lng, lat, b, to, elevation.Ellipsoid)
+	if err != nil {
+		return 0, err
 	}
-	value := respData.ResourceSets[0].Resources[0].Elevations[0]
-
-	return value, nil
+	return a - b, nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"contourguessr-ingest/elevation"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withGeoid sets geoid to a global grid with a constant undulation of n
+func withGeoid(t *testing.T, n float32) {
+	raw := make([]byte, 40)
+	binary.BigEndian.PutUint64(raw[0:], math.Float64bits(-90))
+	binary.BigEndian.PutUint64(raw[8:], math.Float64bits(-180))
+	binary.BigEndian.PutUint64(raw[16:], math.Float64bits(180))
+	binary.BigEndian.PutUint64(raw[24:], math.Float64bits(360))
+	binary.BigEndian.PutUint32(raw[32:], 2)
+	binary.BigEndian.PutUint32(raw[36:], 2)
+	for i := 0; i < 4; i++ {
+		raw = binary.BigEndian.AppendUint32(raw, math.Float32bits(n))
+	}
+	path := filepath.Join(t.TempDir(), "geoid.gtx")
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := elevation.LoadGeoid(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := geoid
+	geoid = g
+	t.Cleanup(func() { geoid = prev })
+}
+
+func TestAltitudeDifference(t *testing.T) {
+	cases := []struct {
+		name           string
+		withGeoid      bool
+		gpsDatum       string
+		terrainDatum   string
+		gpsAlt, ground float64
+		want           float64
+		wantErr        bool
+	}{
+		{name: "both sea level without a geoid", gpsDatum: "msl", terrainDatum: "msl", gpsAlt: 1100, ground: 1000, want: 100},
+		{name: "both sea level with a geoid", withGeoid: true, gpsDatum: "msl", terrainDatum: "msl", gpsAlt: 1100, ground: 1000, want: 100},
+		{name: "both ellipsoid", gpsDatum: "ellipsoid", terrainDatum: "ellipsoid", gpsAlt: 1100, ground: 1000, want: 100},
+		// Sea level is 50m above the ellipsoid
+		{name: "ellipsoid terrain", withGeoid: true, gpsDatum: "msl", terrainDatum: "ellipsoid", gpsAlt: 1100, ground: 1000, want: 150},
+		{name: "ellipsoid gps", withGeoid: true, gpsDatum: "ellipsoid", terrainDatum: "msl", gpsAlt: 1100, ground: 1000, want: 50},
+		{name: "mixed datums without a geoid", gpsDatum: "msl", terrainDatum: "ellipsoid", wantErr: true},
+		{name: "unknown datum", gpsDatum: "egm2008", terrainDatum: "msl", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.withGeoid {
+				withGeoid(t, 50)
+			}
+			got, err := altitudeDifference(1, 2, tc.gpsAlt, tc.gpsDatum, tc.ground, tc.terrainDatum)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got %g, want error", got)
+				}
+				return
+			}
+			if err != nil || math.Abs(got-tc.want) > 1e-6 {
+				t.Errorf("got %g, %v, want %g", got, err, tc.want)
+			}
+		})
+	}
+}
@@ -6,10 +6,11 @@ import (
 	"strconv"
 )
 
-var altitudeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?) m$`)
+// metersRe matches how Flickr formats EXIF lengths, such as "123.4 m"
+var metersRe = regexp.MustCompile(`^(\d+(?:\.\d+)?) m$`)
 
 func exifGPSAltitude(exif map[string]string) (float64, bool) {
-	valS, ok := exif["GPSAltitude"]
+	val, ok := exifMeters(exif, "GPSAltitude")
 	if !ok {
 		return 0, false
 	}
@@ -19,17 +20,6 @@ func exifGPSAltitude(exif map[string]string) (float64, bool) {
 		return 0, false
 	}
 
-	valGroups := altitudeRe.FindStringSubmatch(valS)
-	if valGroups == nil {
-		log.Printf("Unexpected GPSAltitude (regex does not match): %s", valS)
-		return 0, false
-	}
-	val, err := strconv.ParseFloat(valGroups[1], 64)
-	if err != nil {
-		log.Printf("Unexpected GPSAltitude (not a float): %s", valS)
-		return 0, false
-	}
-
 	switch ref {
 	case "Above Sea Level":
 		return val, true
@@ -40,3 +30,126 @@ func exifGPSAltitude(exif map[string]string) (float64, bool) {
 		return 0, false
 	}
 }
+
+// exifMeters parses a length tag, returning false if it is missing or
+// malformed
+func exifMeters(exif map[string]string, tag string) (float64, bool) {
+	valS, ok := exif[tag]
+	if !ok {
+		return 0, false
+	}
+
+	valGroups := metersRe.FindStringSubmatch(valS)
+	if valGroups == nil {
+		log.Printf("Unexpected %s (regex does not match): %s", tag, valS)
+		return 0, false
+	}
+	val, err := strconv.ParseFloat(valGroups[1], 64)
+	if err != nil {
+		log.Printf("Unexpected %s (not a float): %s", tag, valS)
+		return 0, false
+	}
+	return val, true
+}
+
+// gpsQuality is what the EXIF tells us about the GPS fix. Fields are nil
+// where the camera didn't record them.
+type gpsQuality struct {
+	Status            *string
+	HPositioningError *float64
+	DOP               *float64
+	Satellites        *int
+	Differential      *bool
+}
+
+const gpsStatusVoid = "Measurement Void"
+
+var satellitesRe = regexp.MustCompile(`^(\d+)`)
+
+func exifGPSQuality(exif map[string]string) gpsQuality {
+	var out gpsQuality
+
+	if status, ok := exif["GPSStatus"]; ok {
+		switch status {
+		case "Measurement Active", gpsStatusVoid:
+			out.Status = &status
+		default:
+			log.Printf("Unexpected GPSStatus: %s", status)
+		}
+	}
+
+	if value, ok := exifMeters(exif, "GPSHPositioningError"); ok {
+		out.HPositioningError = &value
+	}
+
+	if valS, ok := exif["GPSDOP"]; ok {
+		if value, err := strconv.ParseFloat(valS, 64); err == nil {
+			out.DOP = &value
+		} else {
+			log.Printf("Unexpected GPSDOP (not a float): %s", valS)
+		}
+	}
+
+	// Usually a count, but some cameras list the satellite numbers
+	if valS, ok := exif["GPSSatellites"]; ok {
+		if groups := satellitesRe.FindStringSubmatch(valS); groups != nil {
+			value, _ := strconv.Atoi(groups[1])
+			out.Satellites = &value
+		} else {
+			log.Printf("Unexpected GPSSatellites: %s", valS)
+		}
+	}
+
+	if valS, ok := exif["GPSDifferential"]; ok {
+		switch valS {
+		case "No Correction":
+			value := false
+			out.Differential = &value
+		case "Differential Corrected":
+			value := true
+			out.Differential = &value
+		default:
+			log.Printf("Unexpected GPSDifferential: %s", valS)
+		}
+	}
+
+	return out
+}
+
+// typicalRangeError approximates the error of a GPS fix in meters per unit
+// of DOP, for when the camera records DOP but not the error itself
+const typicalRangeError = 5
+
+// locationConfidence scores how much we trust the photo's location, from 0
+// (the camera says the fix is void) to 1. Flickr's own geo accuracy is no
+// help as almost every photo has the maximum, so this only uses the EXIF.
+// Photos that record nothing score 0.5.
+func (q gpsQuality) locationConfidence() float64 {
+	if q.Status != nil && *q.Status == gpsStatusVoid {
+		return 0
+	}
+
+	var horizontalError *float64
+	if q.HPositioningError != nil {
+		horizontalError = q.HPositioningError
+	} else if q.DOP != nil {
+		value := *q.DOP * typicalRangeError
+		horizontalError = &value
+	}
+
+	confidence := 0.5
+	if horizontalError != nil {
+		errorM := *horizontalError
+		if q.Differential != nil && *q.Differential {
+			errorM /= 2
+		}
+		// 0m is 1, 25m is 0.5, 100m is 0.2
+		confidence = 1 / (1 + errorM/25)
+	}
+
+	// Fewer than four satellites can't give a 3D fix
+	if q.Satellites != nil && *q.Satellites < 4 {
+		confidence /= 2
+	}
+	return confidence
+}
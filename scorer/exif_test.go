@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestExifGPSAltitude(t *testing.T) {
+	cases := []struct {
+		exif map[string]string
+		want float64
+		ok   bool
+	}{
+		{map[string]string{"GPSAltitude": "1021.4 m", "GPSAltitudeRef": "Above Sea Level"}, 1021.4, true},
+		{map[string]string{"GPSAltitude": "3 m", "GPSAltitudeRef": "Below Sea Level"}, -3, true},
+		{map[string]string{"GPSAltitude": "1021.4 m"}, 0, false},
+		{map[string]string{"GPSAltitude": "1021.4", "GPSAltitudeRef": "Above Sea Level"}, 0, false},
+		{map[string]string{"GPSAltitude": "1021.4 m", "GPSAltitudeRef": "Sideways"}, 0, false},
+		{map[string]string{}, 0, false},
+	}
+	for _, tc := range cases {
+		got, ok := exifGPSAltitude(tc.exif)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("exifGPSAltitude(%v) = %g, %v, want %g, %v", tc.exif, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+// describeQuality lists the fields the camera recorded
+func describeQuality(q gpsQuality) string {
+	field := func(name string, p interface{}) string {
+		switch v := p.(type) {
+		case *string:
+			if v != nil {
+				return fmt.Sprintf(" %s=%s", name, *v)
+			}
+		case *float64:
+			if v != nil {
+				return fmt.Sprintf(" %s=%g", name, *v)
+			}
+		case *int:
+			if v != nil {
+				return fmt.Sprintf(" %s=%d", name, *v)
+			}
+		case *bool:
+			if v != nil {
+				return fmt.Sprintf(" %s=%v", name, *v)
+			}
+		}
+		return ""
+	}
+	return "{" + field("status", q.Status) + field("error", q.HPositioningError) + field("dop", q.DOP) +
+		field("satellites", q.Satellites) + field("differential", q.Differential) + " }"
+}
+
+func TestExifGPSQuality(t *testing.T) {
+	cases := []struct {
+		name string
+		exif map[string]string
+		want string
+	}{
+		{"nothing recorded", map[string]string{"Make": "Canon"}, "{ }"},
+		{"active", map[string]string{"GPSStatus": "Measurement Active"}, "{ status=Measurement Active }"},
+		{"void", map[string]string{"GPSStatus": "Measurement Void"}, "{ status=Measurement Void }"},
+		{"unknown status", map[string]string{"GPSStatus": "V"}, "{ }"},
+		{"positioning error", map[string]string{"GPSHPositioningError": "12.5 m"}, "{ error=12.5 }"},
+		{"positioning error without unit", map[string]string{"GPSHPositioningError": "12.5"}, "{ }"},
+		{"dop", map[string]string{"GPSDOP": "2.1"}, "{ dop=2.1 }"},
+		{"malformed dop", map[string]string{"GPSDOP": "good"}, "{ }"},
+		{"satellites", map[string]string{"GPSSatellites": "07"}, "{ satellites=7 }"},
+		{"no satellites", map[string]string{"GPSSatellites": "none"}, "{ }"},
+		{"differential", map[string]string{"GPSDifferential": "Differential Corrected"}, "{ differential=true }"},
+		{"no correction", map[string]string{"GPSDifferential": "No Correction"}, "{ differential=false }"},
+		{"unknown correction", map[string]string{"GPSDifferential": "2"}, "{ }"},
+		{"everything", map[string]string{
+			"GPSStatus":            "Measurement Active",
+			"GPSHPositioningError": "4 m",
+			"GPSDOP":               "0.9",
+			"GPSSatellites":        "11",
+			"GPSDifferential":      "No Correction",
+		}, "{ status=Measurement Active error=4 dop=0.9 satellites=11 differential=false }"},
+	}
+	for _, tc := range cases {
+		if got := describeQuality(exifGPSQuality(tc.exif)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLocationConfidence(t *testing.T) {
+	status := func(s string) *string { return &s }
+	meters := func(m float64) *float64 { return &m }
+	count := func(n int) *int { return &n }
+	yes := true
+
+	cases := []struct {
+		name string
+		q    gpsQuality
+		want float64
+	}{
+		{"nothing recorded", gpsQuality{}, 0.5},
+		{"active without error", gpsQuality{Status: status("Measurement Active")}, 0.5},
+		{"void", gpsQuality{Status: status(gpsStatusVoid), HPositioningError: meters(1)}, 0},
+		{"exact", gpsQuality{HPositioningError: meters(0)}, 1},
+		{"25m", gpsQuality{HPositioningError: meters(25)}, 0.5},
+		{"100m", gpsQuality{HPositioningError: meters(100)}, 0.2},
+		{"dop", gpsQuality{DOP: meters(5)}, 0.5},
+		{"error over dop", gpsQuality{HPositioningError: meters(0), DOP: meters(20)}, 1},
+		{"differential halves the error", gpsQuality{HPositioningError: meters(50), Differential: &yes}, 0.5},
+		{"three satellites", gpsQuality{Satellites: count(3)}, 0.25},
+		{"four satellites", gpsQuality{Satellites: count(4)}, 0.5},
+		{"three satellites and 25m", gpsQuality{HPositioningError: meters(25), Satellites: count(3)}, 0.25},
+	}
+	for _, tc := range cases {
+		if got := tc.q.locationConfidence(); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: got %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
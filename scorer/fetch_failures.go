@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/classifier"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A fetch failure is permanent if retrying can't help, for example because
+// the photo was deleted. Transient failures are retried with exponential
+// backoff until the photo has failed fetchMaxAttempts times.
+const (
+	failurePermanent = "permanent"
+	failureTransient = "transient"
+)
+
+var fetchRetryBase time.Duration
+var fetchRetryMax time.Duration
+var fetchMaxAttempts int
+
+// setupFetchRetries reads SCORER_FETCH_RETRY_BASE, the wait after the first
+// failure, SCORER_FETCH_RETRY_MAX, the longest wait, and
+// SCORER_FETCH_MAX_ATTEMPTS.
+func setupFetchRetries() error {
+	var err error
+	if fetchRetryBase, err = envDuration("SCORER_FETCH_RETRY_BASE", time.Hour); err != nil {
+		return err
+	}
+	if fetchRetryMax, err = envDuration("SCORER_FETCH_RETRY_MAX", 7*24*time.Hour); err != nil {
+		return err
+	}
+	if fetchMaxAttempts, err = envInt("SCORER_FETCH_MAX_ATTEMPTS", 8); err != nil {
+		return err
+	}
+	if fetchMaxAttempts < 1 {
+		return errors.New("SCORER_FETCH_MAX_ATTEMPTS must be at least 1")
+	}
+	return nil
+}
+
+// fetchStatusError is returned when the static server responds with anything
+// other than 200.
+type fetchStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *fetchStatusError) Error() string {
+	return fmt.Sprintf("HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+func classifyFetchFailure(err error) string {
+	if classifier.IsRejected(err) {
+		return failurePermanent
+	}
+	var statusErr *fetchStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode >= 500,
+			statusErr.StatusCode == http.StatusRequestTimeout,
+			statusErr.StatusCode == http.StatusTooManyRequests:
+			return failureTransient
+		default:
+			// Including 404 and 410 for deleted photos
+			return failurePermanent
+		}
+	}
+	// Timeouts, dropped connections and truncated bodies
+	return failureTransient
+}
+
+// saveFlickrPhotoFetchFailure records the failure, scheduling a retry if it
+// is transient. loadBatch skips the photo until then.
+func saveFlickrPhotoFetchFailure(db *pgxpool.Pool, flickrId string, err error) {
+	if errors.Is(err, context.Canceled) {
+		// We're shutting down, not failing
+		return
+	}
+	kind := classifyFetchFailure(err)
+
+	ctx := context.Background()
+	_, err = db.Exec(ctx, `
+		INSERT INTO flickr_photo_fetch_failures AS f (flickr_id, kind, err, next_retry_at)
+		VALUES ($1, $2::text, $3,
+				CASE WHEN $2::text = 'transient' AND 1 < $5::int
+					THEN CURRENT_TIMESTAMP + $4::float8 * interval '1 second' END)
+		ON CONFLICT (flickr_id) DO UPDATE
+			SET kind          = excluded.kind,
+				err           = excluded.err,
+				attempts      = f.attempts + 1,
+				updated_at    = CURRENT_TIMESTAMP,
+				next_retry_at = CASE WHEN excluded.kind = 'transient' AND f.attempts + 1 < $5::int
+					THEN CURRENT_TIMESTAMP
+						+ least($4::float8 * power(2, f.attempts), $6::float8) * interval '1 second' END
+	`, flickrId, kind, err.Error(), fetchRetryBase.Seconds(), fetchMaxAttempts, fetchRetryMax.Seconds())
+	if err != nil {
+		log.Println("Error saving fetch failure:", err)
+	}
+}
+
+// clearFlickrPhotoFetchFailure forgets earlier failures once a retry succeeds.
+func clearFlickrPhotoFetchFailure(ctx context.Context, db *pgxpool.Pool, flickrId string) {
+	_, err := db.Exec(ctx, `DELETE FROM flickr_photo_fetch_failures WHERE flickr_id = $1`, flickrId)
+	if err != nil {
+		log.Println("Error clearing fetch failure:", err)
+	}
+}
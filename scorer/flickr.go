@@ -2,28 +2,56 @@ package main
 
 import (
 	"context"
+	"contourguessr-ingest/imagestore"
+	"contourguessr-ingest/ratelimit"
 	"fmt"
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
-	"sync"
 	"time"
 )
 
-var fetchFlickrPhotoMu sync.Mutex
+var flickrStaticLimiter *ratelimit.Limiter
 
-func fetchFlickrPhoto(db *pgx.Conn, flickrId string, photoURL string) ([]byte, error) {
-	startTime := time.Now()
+// previewSize is the size suffix of the image we classify
+const previewSize = "m"
+
+// imageStore caches the previews we fetch, so re-classifying doesn't need
+// them downloaded again. It is nil if IMAGE_STORE_DIR is not set.
+var imageStore *imagestore.Store
 
-	fetchFlickrPhotoMu.Lock()
-	defer fetchFlickrPhotoMu.Unlock()
+// fetchPreview returns the entry's preview from the image store, fetching it
+// if necessary. The preview is kept on the entry, so later stages in the
+// same run don't fetch it again even without an image store.
+func fetchPreview(ctx context.Context, db *pgxpool.Pool, entry *Entry) ([]byte, error) {
+	if entry.preview != nil {
+		return entry.preview, nil
+	}
+	key := imagestore.Key{FlickrID: entry.FlickrId, Secret: entry.Secret, Size: previewSize}
+	data, err := imageStore.Get(ctx, key, func(ctx context.Context) ([]byte, error) {
+		var data []byte
+		err := imageDep.do(ctx, func(ctx context.Context) error {
+			var err error
+			data, err = fetchFlickrPhoto(ctx, db, entry.FlickrId, entry.PreviewURL)
+			return err
+		})
+		return data, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry.preview = data
+	return data, nil
+}
 
-	randSleep(minFlickrImgRequestDelay, maxFlickrImgRequestDelay)
+func fetchFlickrPhoto(ctx context.Context, db *pgxpool.Pool, flickrId string, photoURL string) ([]byte, error) {
+	startTime := time.Now()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
+	if err := flickrStaticLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
 
 	imgReq, err := http.NewRequestWithContext(ctx, "GET", photoURL, nil)
 	if err != nil {
@@ -44,7 +72,7 @@ func fetchFlickrPhoto(db *pgx.Conn, flickrId string, photoURL string) ([]byte, e
 		if err != nil {
 			body = []byte(fmt.Sprintf("<error reading body: %s>", err))
 		}
-		err = fmt.Errorf("HTTP status %d: %s", imgResp.StatusCode, body)
+		err = &fetchStatusError{StatusCode: imgResp.StatusCode, Body: string(body)}
 		saveFlickrPhotoFetchFailure(db, flickrId, err)
 		return nil, err
 	}
@@ -55,16 +83,26 @@ func fetchFlickrPhoto(db *pgx.Conn, flickrId string, photoURL string) ([]byte, e
 		return nil, err
 	}
 
+	clearFlickrPhotoFetchFailure(ctx, db, flickrId)
+
 	log.Printf("Fetched flickr photo %s in %s (%s requesting)",
 		photoURL, time.Since(startTime), time.Since(reqTime))
 
 	return body, nil
 }
 
-func randSleep(min time.Duration, max time.Duration) {
-	dur := time.Duration(rand.Int63n(int64(max-min))) + min
+// randSleep returns early if ctx is done.
+func randSleep(ctx context.Context, min time.Duration, max time.Duration) {
+	dur := randDuration(min, max)
 	if dur > 5*time.Minute {
 		log.Printf("Sleeping for %s", dur)
 	}
-	time.Sleep(dur)
+	select {
+	case <-time.After(dur):
+	case <-ctx.Done():
+	}
+}
+
+func randDuration(min time.Duration, max time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(max-min))) + min
 }
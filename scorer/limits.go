@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A dependency is an external service the scorer calls. Each has its own cap
+// on concurrent calls so that one slow service can only tie up its own slots,
+// and its own timeout so a hung call can't hold a slot forever.
+type dependency struct {
+	name    string
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+var roadDep *dependency
+var classifierDep *dependency
+var imageDep *dependency
+var elevationDep *dependency
+
+func setupDependencies() error {
+	var err error
+	if roadDep, err = dependencyFromEnv("roads", 2, time.Minute); err != nil {
+		return err
+	}
+	if classifierDep, err = dependencyFromEnv("classifier", 2, 30*time.Second); err != nil {
+		return err
+	}
+	if imageDep, err = dependencyFromEnv("image", 2, 5*time.Minute); err != nil {
+		return err
+	}
+	if elevationDep, err = dependencyFromEnv("elevation", 2, 30*time.Second); err != nil {
+		return err
+	}
+	return nil
+}
+
+// dependencyFromEnv reads SCORER_<NAME>_CONCURRENCY and SCORER_<NAME>_TIMEOUT,
+// for example SCORER_ROADS_CONCURRENCY=4 and SCORER_ROADS_TIMEOUT=2m.
+func dependencyFromEnv(name string, concurrency int, timeout time.Duration) (*dependency, error) {
+	prefix := "SCORER_" + strings.ToUpper(name) + "_"
+	concurrency, err := envInt(prefix+"CONCURRENCY", concurrency)
+	if err != nil {
+		return nil, err
+	}
+	if concurrency < 1 {
+		return nil, fmt.Errorf("%sCONCURRENCY must be at least 1", prefix)
+	}
+	timeout, err = envDuration(prefix+"TIMEOUT", timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &dependency{
+		name:    name,
+		slots:   make(chan struct{}, concurrency),
+		timeout: timeout,
+	}, nil
+}
+
+// do calls fn once a slot is free, with ctx bounded by the timeout. Time spent
+// waiting for a slot doesn't count towards the timeout.
+func (d *dependency) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	select {
+	case d.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-d.slots }()
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		return fmt.Errorf("%s: %w", d.name, err)
+	}
+	return nil
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return n, nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return d, nil
+}
@@ -2,30 +2,44 @@ package main
 
 import (
 	"context"
+	"contourguessr-ingest/flickr"
+	"contourguessr-ingest/imagestore"
+	"contourguessr-ingest/notify"
+	"contourguessr-ingest/queue"
+	"contourguessr-ingest/ratelimit"
 	"fmt"
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
-const activeVsn = 1
+// activeVsn is the scoring version this build produces. Bump it when a
+// stage or the acceptance policy changes, updating the stage's Since, and run
+// `scorer rescore` to carry over results that are still valid.
+const activeVsn = 5
 
 var databaseURL string
 var redisAddr string
-var overpassEndpoint string
 var classifierEndpoint string
-var bingMapsKey string
+var allowedLicenses flickr.LicenseSet
+var exifQueue = queue.New(queue.FlickrExif)
 
-var minFlickrImgRequestDelay = 1 * time.Second
-var maxFlickrImgRequestDelay = 2 * time.Second
 var minIdleWait = 4 * time.Minute
 var maxIdleWait = 5 * time.Minute
 var minErrWait = 2 * time.Minute
 var maxErrWait = 5 * time.Minute
 
+// shutdownTimeout is how long entries in flight get to finish once we're
+// asked to stop. It must be under terminationGracePeriodSeconds (300s) so we
+// aren't killed mid save.
+var shutdownTimeout time.Duration
+
 func main() {
 	// Environment variables
 
@@ -39,125 +53,205 @@ func main() {
 		log.Fatal("DATABASE_URL not set")
 	}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rescore":
+			rescoreMain(os.Args[2:])
+			return
+		case "import-roads":
+			importRoadsMain(os.Args[2:])
+			return
+		}
+	}
+
 	redisAddr = os.Getenv("REDIS_ADDR")
 	if redisAddr == "" {
 		log.Fatal("REDIS_ADDR not set")
 	}
 
-	overpassEndpoint = os.Getenv("OVERPASS_ENDPOINT")
-	if overpassEndpoint == "" {
-		log.Fatal("OVERPASS_ENDPOINT not set")
-	}
-
 	classifierEndpoint = os.Getenv("CLASSIFIER_ENDPOINT")
 	if classifierEndpoint == "" {
 		log.Fatal("CLASSIFIER_ENDPOINT not set")
 	}
 
-	bingMapsKey = os.Getenv("BING_MAPS_KEY")
-	if bingMapsKey == "" {
-		log.Fatal("BING_MAPS_KEY not set")
+	allowedLicenses, err = flickr.AllowedLicensesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if value := os.Getenv("FLICKR_STATIC_ENDPOINT"); value != "" {
+		flickr.StaticEndpoint = value
+	}
+
+	flickrStaticLimiter, err = ratelimit.FlickrStatic(redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	workers, err := envInt("SCORER_WORKERS", 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if workers < 1 {
+		log.Fatal("SCORER_WORKERS must be at least 1")
+	}
+
+	shutdownTimeout, err = envDuration("SCORER_SHUTDOWN_TIMEOUT", 4*time.Minute)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupDependencies(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupFetchRetries(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupElevation(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupClassifier(workers); err != nil {
+		log.Fatal(err)
+	}
+
+	imageStore, err = imagestore.FromEnv()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// End setup
 
-	for {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	db, err := pgxpool.Connect(ctx, databaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := setupRoads(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// The admin and training exports share the store, but only we evict
+	go imageStore.RunEviction(ctx, time.Hour)
+
+	listener, err := notify.Listen(ctx, databaseURL, notify.PhotosIndexed, notify.ExifFetched, notify.FetchRetried)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close(context.Background())
+
+	for ctx.Err() == nil {
 		startTime := time.Now()
-		count, err := scoreOneBatch()
+		count, err := scoreOneBatch(ctx, db, workers)
 		elapsedTime := time.Since(startTime)
 
 		if err != nil {
 			log.Println(err)
-			randSleep(minErrWait, maxErrWait)
+			randSleep(ctx, minErrWait, maxErrWait)
 			continue
 		}
 
 		if count == 0 {
-			log.Println("No photos to score")
-			randSleep(minIdleWait, maxIdleWait)
+			// Polling is only a fallback in case we missed a notification
+			log.Println("No photos to score, waiting")
+			if channel := listener.Wait(ctx, randDuration(minIdleWait, maxIdleWait)); channel != "" {
+				log.Printf("Woken by %s", channel)
+			}
 		} else {
 			log.Printf("Scored %d photos in %s", count, elapsedTime)
 		}
 	}
+	log.Println("Shutting down")
 }
 
-func scoreOneBatch() (int, error) {
-	ctx := context.Background()
-
-	db, err := pgx.Connect(ctx, databaseURL)
-	if err != nil {
-		return 0, fmt.Errorf("error connecting to database: %w", err)
-	}
-	defer db.Close(ctx)
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-
-	batch, err := loadBatch(db)
+// scoreOneBatch scores a batch with a pool of workers. Once ctx is done no
+// more entries are started, and those in flight have shutdownTimeout to
+// finish and save before they are cancelled too.
+func scoreOneBatch(ctx context.Context, db *pgxpool.Pool, workers int) (int, error) {
+	batch, err := loadBatch(ctx, db)
 	if err != nil {
 		return 0, fmt.Errorf("error loading batch: %w", err)
 	}
 
-	for _, entry := range batch {
-		if err := scoreEntry(db, rdb, entry); err != nil {
-			return 0, fmt.Errorf("error scoring entry %+v: %w", entry, err)
+	entries := make(chan *Entry)
+	go func() {
+		defer close(entries)
+		for i := range batch {
+			select {
+			case entries <- &batch[i]:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}
-
-	return len(batch), nil
-}
-
-func scoreEntry(db *pgx.Conn, rdb *redis.Client, entry Entry) error {
-	ctx := context.Background()
+	}()
 
-	if entry.RoadWithin1000m == nil {
-		value, err := queryRoadWithin1000m(entry.Lng, entry.Lat)
-		if err != nil {
-			return fmt.Errorf("error querying road within 1000m of %+v: %w\n", entry, err)
-		}
-		entry.RoadWithin1000m = &value
-	}
+	var mu sync.Mutex
+	scored, accepted, failed := 0, 0, 0
+	var lastErr error
 
-	if entry.ValidityScore == nil && !*entry.RoadWithin1000m {
-		photoData, err := fetchFlickrPhoto(db, entry.FlickrId, entry.PreviewURL)
-		if err != nil {
-			return fmt.Errorf("error fetching flickr photo %+v: %w", entry, err)
+	entryCtx, cancelEntries := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelEntries()
+	stopShutdownTimer := context.AfterFunc(ctx, func() {
+		select {
+		case <-time.After(shutdownTimeout):
+			log.Printf("Entries still in flight after %s, cancelling them", shutdownTimeout)
+			cancelEntries()
+		case <-entryCtx.Done():
 		}
+	})
+	defer stopShutdownTimer()
 
-		validity, err := queryValidity(photoData)
-		if err != nil {
-			return fmt.Errorf("error querying validity of %+v: %w", entry, err)
-		}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entries {
+				err := scoreEntry(entryCtx, db, entry)
 
-		entry.ValidityScore = &validity.Score
-		entry.ValidityModel = &validity.Model
+				mu.Lock()
+				if err != nil {
+					log.Printf("Error scoring entry %s: %s", entry.FlickrId, err)
+					failed++
+					lastErr = err
+				} else {
+					scored++
+					if entry.IsAccepted != nil && *entry.IsAccepted {
+						accepted++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
 	}
+	wg.Wait()
 
-	if !*entry.RoadWithin1000m &&
-		entry.ValidityScore != nil && *entry.ValidityScore > 0.5 &&
-		entry.Exif == nil {
-		if err := rdb.LPush(ctx, "cg-flickr-indexer:want-exif", entry.FlickrId).Err(); err != nil {
-			return err
+	if accepted > 0 {
+		if err := notify.Notify(entryCtx, db, notify.PhotosAccepted); err != nil {
+			return scored, err
 		}
 	}
 
-	if entry.Exif != nil && entry.GPSAltitude == nil {
-		altitude, ok := exifGPSAltitude(*entry.Exif)
-		entry.GPSAltitudeAvailable = &ok
-		if ok {
-			entry.GPSAltitude = &altitude
-		}
+	if failed > 0 {
+		return scored, fmt.Errorf("failed to score %d of %d entries, last error: %w", failed, scored+failed, lastErr)
 	}
-	if entry.GPSAltitude != nil && entry.TerrainAltitude == nil {
-		terrainAltitude, err := getElevation(entry.Lng, entry.Lat)
-		if err != nil {
-			return fmt.Errorf("error getting elevation for %+v: %w", entry, err)
-		}
-		entry.TerrainAltitude = &terrainAltitude
+	return scored, nil
+}
+
+func scoreEntry(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	if err := runStages(ctx, db, entry); err != nil {
+		return err
 	}
 
-	if err := entry.Save(db); err != nil {
+	if err := entry.Save(ctx, db); err != nil {
 		return fmt.Errorf("error saving score: %w", err)
 	}
 
@@ -2,32 +2,34 @@ package main
 
 import (
 	"context"
+	"contourguessr-ingest/geom"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
-	"time"
 )
 
-func queryRoadWithin1000m(lng, lat float64) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+// overpassRoads finds highways with a live Overpass query
+type overpassRoads struct {
+	endpoint string
+}
 
+func (o overpassRoads) nearbyHighways(ctx context.Context, regionID int, lng, lat, radius float64) ([]nearbyHighway, error) {
 	reqBody := strings.NewReader(fmt.Sprintf(`
 		[out:json];
-		wr(around:1000,%0.6f,%0.6f)[highway];
-		out tags;
-	`, lat, lng))
+		way(around:%0.0f,%0.6f,%0.6f)[highway];
+		out tags geom;
+	`, radius, lat, lng))
 
-	req, err := http.NewRequestWithContext(ctx, "POST", overpassEndpoint+"/interpreter", reqBody)
+	req, err := http.NewRequestWithContext(ctx, "POST", o.endpoint+"/interpreter", reqBody)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -35,12 +37,16 @@ func queryRoadWithin1000m(lng, lat float64) (bool, error) {
 		if err != nil {
 			body = []byte(fmt.Sprintf("<error reading body: %s>", err))
 		}
-		return false, fmt.Errorf("status code %d: %s", resp.StatusCode, body)
+		return nil, fmt.Errorf("status code %d: %s", resp.StatusCode, body)
 	}
 
 	var ovpResp struct {
 		Elements []struct {
-			Tags map[string]string `json:"tags"`
+			Tags     map[string]string `json:"tags"`
+			Geometry []struct {
+				Lat float64 `json:"lat"`
+				Lon float64 `json:"lon"`
+			} `json:"geometry"`
 		} `json:"elements"`
 	}
 	err = json.NewDecoder(resp.Body).Decode(&ovpResp)
@@ -49,51 +55,65 @@ func queryRoadWithin1000m(lng, lat float64) (bool, error) {
 		if err != nil {
 			body = []byte(fmt.Sprintf("<error reading body: %s>", err))
 		}
-		return false, fmt.Errorf("%w: got %s", err, body)
+		return nil, fmt.Errorf("%w: got %s", err, body)
 	}
 
+	point := geom.Point{Lng: lng, Lat: lat}
+	var out []nearbyHighway
 	for _, elem := range ovpResp.Elements {
-		highway := elem.Tags["highway"]
-		surface := elem.Tags["surface"]
-
-		// If paved then it is a road
-		if tagValueContains(surface,
-			"paved",    // A feature that is predominantly paved; i.e., it is covered with paving stones, concrete or bitumen
-			"asphalt",  // Short for asphalt concrete
-			"chipseal", // Less expensive alternative to asphalt concrete. Rarely tagged
-			"concrete", // Portland cement concrete, forming a large surface
-		) {
-			return true, nil
+		line := make(geom.LineString, len(elem.Geometry))
+		for i, p := range elem.Geometry {
+			line[i] = geom.Point{Lng: p.Lon, Lat: p.Lat}
 		}
+		out = append(out, nearbyHighway{
+			Highway:  elem.Tags["highway"],
+			Surface:  elem.Tags["surface"],
+			Distance: line.DistanceTo(point),
+		})
+	}
+	return out, nil
+}
 
-		// If the highway value matches the denylist then assume it is a road. There is a long tail of weird tags that
-		// we err on the side of assuming aren't roads.
-		if tagValueContains(highway,
-			// From OSM wiki
-			"motorway",      // A restricted access major divided highway,
-			"trunk",         // The most important roads in a country's system that aren't motorways
-			"primary",       // After trunk
-			"secondary",     // After primary
-			"tertiary",      // After secondary
-			"unclassified",  // The least important through roads in a country's system. The word 'unclassified' is a historical artefact of the UK road system and does not mean that the classification is unknown
-			"residential",   // Roads which serve as access to housing, without function of connecting settlements
-			"motorway_link", // The link roads (sliproads/ramps) leading to/from a motorway from/to a motorway or lower class highway
-			"trunk_link",
-			"primary_link",
-			"secondary_link",
-			"tertiary_link",
-			"living_street", // residential streets where pedestrians have legal priority over cars
-			"service",       // For access roads to, or within an industrial estate, camp site, business park, car park, alleys, etc
-			"raceway",       // A course or track for (motor) racing
-			"busway",        // Dedicated roadway for buses
-			"rest_area",
-			// From our examples
-		) {
-			return true, nil
-		}
+// isRoad decides whether a way with the given highway and surface tags
+// counts as a road. Every road backend uses these rules.
+func isRoad(highway, surface string) bool {
+	// If paved then it is a road
+	if tagValueContains(surface,
+		"paved",    // A feature that is predominantly paved; i.e., it is covered with paving stones, concrete or bitumen
+		"asphalt",  // Short for asphalt concrete
+		"chipseal", // Less expensive alternative to asphalt concrete. Rarely tagged
+		"concrete", // Portland cement concrete, forming a large surface
+	) {
+		return true
+	}
+
+	// If the highway value matches the denylist then assume it is a road. There is a long tail of weird tags that
+	// we err on the side of assuming aren't roads.
+	if tagValueContains(highway,
+		// From OSM wiki
+		"motorway",      // A restricted access major divided highway,
+		"trunk",         // The most important roads in a country's system that aren't motorways
+		"primary",       // After trunk
+		"secondary",     // After primary
+		"tertiary",      // After secondary
+		"unclassified",  // The least important through roads in a country's system. The word 'unclassified' is a historical artefact of the UK road system and does not mean that the classification is unknown
+		"residential",   // Roads which serve as access to housing, without function of connecting settlements
+		"motorway_link", // The link roads (sliproads/ramps) leading to/from a motorway from/to a motorway or lower class highway
+		"trunk_link",
+		"primary_link",
+		"secondary_link",
+		"tertiary_link",
+		"living_street", // residential streets where pedestrians have legal priority over cars
+		"service",       // For access roads to, or within an industrial estate, camp site, business park, car park, alleys, etc
+		"raceway",       // A course or track for (motor) racing
+		"busway",        // Dedicated roadway for buses
+		"rest_area",
+		// From our examples
+	) {
+		return true
 	}
 
-	return false, nil
+	return false
 }
 
 func tagValueContains(tagValue string, needles ...string) bool {
@@ -0,0 +1,39 @@
+package main
+
+// validityThreshold is the classifier score below which we reject a photo
+const validityThreshold = 0.5
+
+// maxAltitudeAboveTerrain rejects photos whose GPS altitude is far above the
+// ground, which are likely taken from a plane
+const maxAltitudeAboveTerrain = 300
+
+// maxHorizontalError rejects photos whose camera reports the GPS fix could be
+// further than this many meters out
+const maxHorizontalError = 100
+
+// acceptPolicy decides whether a completely scored entry should become a
+// challenge. Stages skipped as unnecessary leave their outputs nil.
+func acceptPolicy(entry *Entry) bool {
+	if tooCloseToRoad(entry) {
+		return false
+	}
+	if *entry.ValidityScore < validityThreshold {
+		return false
+	}
+	if entry.GPSStatus != nil && *entry.GPSStatus == gpsStatusVoid {
+		return false
+	}
+	if entry.GPSHPositioningError != nil && *entry.GPSHPositioningError > maxHorizontalError {
+		return false
+	}
+	if *entry.GPSAltitudeAvailable && *entry.AltitudeAboveTerrain >= maxAltitudeAboveTerrain {
+		return false
+	}
+	return true
+}
+
+// tooCloseToRoad compares the road distance against the region's threshold.
+// No road within roadSearchRadius is never too close.
+func tooCloseToRoad(entry *Entry) bool {
+	return entry.RoadDistance != nil && *entry.RoadDistance < entry.MinRoadDistance
+}
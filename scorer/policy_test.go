@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestAcceptPolicyGPS(t *testing.T) {
+	cases := []struct {
+		name string
+		exif map[string]string
+		want bool
+	}{
+		{"missing tags", map[string]string{}, true},
+		{"active", map[string]string{"GPSStatus": "Measurement Active"}, true},
+		{"void fix", map[string]string{"GPSStatus": "Measurement Void", "GPSHPositioningError": "5 m"}, false},
+		{"small error", map[string]string{"GPSHPositioningError": "5 m"}, true},
+		{"100m boundary", map[string]string{"GPSHPositioningError": "100 m"}, true},
+		{"just over 100m", map[string]string{"GPSHPositioningError": "100.1 m"}, false},
+		// Only the camera's own error estimate is trusted to reject
+		{"poor dop", map[string]string{"GPSDOP": "50"}, true},
+		{"few satellites", map[string]string{"GPSSatellites": "2"}, true},
+		{"malformed error", map[string]string{"GPSHPositioningError": "500"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			validity := 0.9
+			noAltitude := false
+			q := exifGPSQuality(tc.exif)
+			entry := &Entry{
+				MinRoadDistance:      100,
+				ValidityScore:        &validity,
+				GPSAltitudeAvailable: &noAltitude,
+				GPSStatus:            q.Status,
+				GPSHPositioningError: q.HPositioningError,
+				GPSDOP:               q.DOP,
+				GPSSatellites:        q.Satellites,
+				GPSDifferential:      q.Differential,
+			}
+			if got := acceptPolicy(entry); got != tc.want {
+				t.Errorf("acceptPolicy = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAcceptPolicy(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	yes, no := true, false
+
+	cases := []struct {
+		name  string
+		entry Entry
+		want  bool
+	}{
+		{"accepted", Entry{MinRoadDistance: 100, RoadDistance: ptr(500), ValidityScore: ptr(0.9), GPSAltitudeAvailable: &no}, true},
+		{"no road nearby", Entry{MinRoadDistance: 100, ValidityScore: ptr(0.9), GPSAltitudeAvailable: &no}, true},
+		// Validity is skipped for photos too close to a road
+		{"too close to a road", Entry{MinRoadDistance: 100, RoadDistance: ptr(50)}, false},
+		{"invalid", Entry{MinRoadDistance: 100, ValidityScore: ptr(0.1)}, false},
+		{"low", Entry{MinRoadDistance: 100, ValidityScore: ptr(0.9), GPSAltitudeAvailable: &yes, AltitudeAboveTerrain: ptr(20)}, true},
+		{"from a plane", Entry{MinRoadDistance: 100, ValidityScore: ptr(0.9), GPSAltitudeAvailable: &yes, AltitudeAboveTerrain: ptr(maxAltitudeAboveTerrain)}, false},
+	}
+	for _, tc := range cases {
+		if got := acceptPolicy(&tc.entry); got != tc.want {
+			t.Errorf("%s: acceptPolicy = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -2,48 +2,89 @@ package main
 
 import (
 	"context"
-	"github.com/jackc/pgx/v4"
-	"log"
+	"contourguessr-ingest/flickr"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 type Entry struct {
 	Id *int64
 
 	FlickrId   string
+	RegionID   int
+	Secret     string
 	PreviewURL string
 	Lng        float64
 	Lat        float64
 	Exif       *map[string]string
 
+	// MinRoadDistance is the region's threshold in meters
+	MinRoadDistance float64
+
 	RoadWithin1000m *bool
+	RoadDistance    *float64
+	RoadHighway     *string
+	RoadSurface     *string
+	TrackDistance   *float64
+	PathDistance    *float64
 
 	ValidityScore *float64
 	ValidityModel *string
 
+	PreviewDHash *int64
+
 	GPSAltitude          *float64
+	GPSAltitudeDatum     *string
 	GPSAltitudeAvailable *bool
 	TerrainAltitude      *float64
+	TerrainAltitudeDatum *string
+	AltitudeAboveTerrain *float64
+
+	GPSStatus            *string
+	GPSHPositioningError *float64
+	GPSDOP               *float64
+	GPSSatellites        *int
+	GPSDifferential      *bool
+	LocationConfidence   *float64
+
+	// preview is the fetched preview image, kept for the rest of the run
+	preview []byte
+
+	// Set by runStages. IsAccepted is nil until the entry is complete.
+	IsComplete *bool
+	IsAccepted *bool
 }
 
-func loadBatch(db *pgx.Conn) ([]Entry, error) {
-	ctx := context.Background()
+func loadBatch(ctx context.Context, db *pgxpool.Pool) ([]Entry, error) {
 	rows, err := db.Query(ctx, `
-		SELECT s.id, p.flickr_id,
+		SELECT s.id, p.flickr_id, p.region_id,
 			   p.summary ->> 'server', p.summary ->> 'secret',
 			   ST_X(p.geo::geometry), ST_Y(p.geo::geometry), p.exif,
-			   s.road_within_1000m,
-			   s.validity_score, s.validity_model,
-			   s.gps_altitude, s.gps_altitude_available, s.terrain_altitude
-		FROM photo_scores as s
-				 RIGHT JOIN flickr_photos as p ON s.flickr_photo_id = p.flickr_id
-		WHERE (s.vsn is null OR s.vsn = $1)
-		  	AND (s.is_complete is null OR not s.is_complete)
+			   r.min_road_distance,
+			   s.road_within_1000m, s.road_distance, s.road_highway, s.road_surface,
+			   s.track_distance, s.path_distance,
+			   s.validity_score, s.validity_model, s.preview_dhash,
+			   s.gps_altitude, s.gps_altitude_datum, s.gps_altitude_available,
+			   s.terrain_altitude, s.terrain_altitude_datum, s.altitude_above_terrain,
+			   s.gps_status, s.gps_h_positioning_error, s.gps_dop, s.gps_satellites, s.gps_differential,
+			   s.location_confidence
+		FROM flickr_photos as p
+				 JOIN regions as r ON r.id = p.region_id
+				 LEFT JOIN photo_scores as s ON s.flickr_photo_id = p.flickr_id AND s.vsn = $1
+		WHERE (s.id IS NOT NULL AND s.is_complete IS NOT TRUE
+			-- Photos scored at other versions are only re-scored by request
+			OR s.id IS NULL AND NOT exists (SELECT 1
+											FROM photo_scores as other
+											WHERE other.flickr_photo_id = p.flickr_id))
+			-- Photos indexed before we captured licenses are scored regardless
+			AND ($2::int[] IS NULL OR p.license IS NULL OR p.license = ANY ($2))
+			-- Photos that failed to fetch are skipped until they're due a retry
 			AND not exists (SELECT 1
 							FROM flickr_photo_fetch_failures as err
-							WHERE err.flickr_id = p.flickr_id)
+							WHERE err.flickr_id = p.flickr_id
+							  AND (err.next_retry_at IS NULL OR err.next_retry_at > CURRENT_TIMESTAMP))
 		ORDER BY random()
 		LIMIT 100
-	`, activeVsn)
+	`, activeVsn, allowedLicenses.IDs())
 	if err != nil {
 		return nil, err
 	}
@@ -51,39 +92,53 @@ func loadBatch(db *pgx.Conn) ([]Entry, error) {
 	out := make([]Entry, 0)
 	for rows.Next() {
 		var server string
-		var secret string
 		var entry Entry
 		err := rows.Scan(
-			&entry.Id, &entry.FlickrId,
-			&server, &secret,
+			&entry.Id, &entry.FlickrId, &entry.RegionID,
+			&server, &entry.Secret,
 			&entry.Lng, &entry.Lat, &entry.Exif,
-			&entry.RoadWithin1000m,
-			&entry.ValidityScore, &entry.ValidityModel,
-			&entry.GPSAltitude, &entry.GPSAltitudeAvailable, &entry.TerrainAltitude,
+			&entry.MinRoadDistance,
+			&entry.RoadWithin1000m, &entry.RoadDistance, &entry.RoadHighway, &entry.RoadSurface,
+			&entry.TrackDistance, &entry.PathDistance,
+			&entry.ValidityScore, &entry.ValidityModel, &entry.PreviewDHash,
+			&entry.GPSAltitude, &entry.GPSAltitudeDatum, &entry.GPSAltitudeAvailable,
+			&entry.TerrainAltitude, &entry.TerrainAltitudeDatum, &entry.AltitudeAboveTerrain,
+			&entry.GPSStatus, &entry.GPSHPositioningError, &entry.GPSDOP, &entry.GPSSatellites, &entry.GPSDifferential,
+			&entry.LocationConfidence,
 		)
 		if err != nil {
 			return nil, err
 		}
-		entry.PreviewURL = "https://live.staticflickr.com/" + server + "/" + entry.FlickrId + "_" + secret + "_m.jpg"
+		entry.PreviewURL = flickr.SourceURL(flickr.Photo{ID: entry.FlickrId, Server: server, Secret: entry.Secret}, previewSize)
 		out = append(out, entry)
 	}
 	return out, nil
 }
 
-func (entry *Entry) Save(db *pgx.Conn) error {
-	ctx := context.Background()
+func (entry *Entry) Save(ctx context.Context, db *pgxpool.Pool) error {
 	if entry.Id == nil {
 		row := db.QueryRow(ctx, `
 			INSERT INTO photo_scores (vsn, updated_at, flickr_photo_id,
-			                          road_within_1000m,
-			                          validity_score, validity_model,
-			                          gps_altitude, gps_altitude_available, terrain_altitude)
-			VALUES ($1, CURRENT_TIMESTAMP, $2, $3, $4, $5, $6, $7, $8)
+			                          road_within_1000m, road_distance, road_highway, road_surface,
+			                          track_distance, path_distance,
+			                          validity_score, validity_model, preview_dhash,
+			                          gps_altitude, gps_altitude_datum, gps_altitude_available,
+			                          terrain_altitude, terrain_altitude_datum, altitude_above_terrain,
+			                          gps_status, gps_h_positioning_error, gps_dop, gps_satellites, gps_differential,
+			                          location_confidence,
+			                          is_complete, is_accepted)
+			VALUES ($1, CURRENT_TIMESTAMP, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			        $16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
 			RETURNING id
 		`, activeVsn, entry.FlickrId,
-			entry.RoadWithin1000m,
-			entry.ValidityScore, entry.ValidityModel,
-			entry.GPSAltitude, entry.GPSAltitudeAvailable, entry.TerrainAltitude)
+			entry.RoadWithin1000m, entry.RoadDistance, entry.RoadHighway, entry.RoadSurface,
+			entry.TrackDistance, entry.PathDistance,
+			entry.ValidityScore, entry.ValidityModel, entry.PreviewDHash,
+			entry.GPSAltitude, entry.GPSAltitudeDatum, entry.GPSAltitudeAvailable,
+			entry.TerrainAltitude, entry.TerrainAltitudeDatum, entry.AltitudeAboveTerrain,
+			entry.GPSStatus, entry.GPSHPositioningError, entry.GPSDOP, entry.GPSSatellites, entry.GPSDifferential,
+			entry.LocationConfidence,
+			entry.IsComplete, entry.IsAccepted)
 		err := row.Scan(&entry.Id)
 		if err != nil {
 			return err
@@ -93,28 +148,27 @@ func (entry *Entry) Save(db *pgx.Conn) error {
 		_, err := db.Exec(ctx, `
 			UPDATE photo_scores
 			SET updated_at = CURRENT_TIMESTAMP,
-			    road_within_1000m = $2,
-			    validity_score = $3, validity_model = $4,
-				gps_altitude = $5, gps_altitude_available = $6, terrain_altitude = $7
+			    road_within_1000m = $2, road_distance = $3, road_highway = $4, road_surface = $5,
+			    track_distance = $6, path_distance = $7,
+			    validity_score = $8, validity_model = $9, preview_dhash = $10,
+				gps_altitude = $11, gps_altitude_datum = $12, gps_altitude_available = $13,
+				terrain_altitude = $14, terrain_altitude_datum = $15, altitude_above_terrain = $16,
+				gps_status = $17, gps_h_positioning_error = $18, gps_dop = $19, gps_satellites = $20,
+				gps_differential = $21, location_confidence = $22,
+				is_complete = $23, is_accepted = $24
 			WHERE id = $1
 		`, entry.Id,
-			entry.RoadWithin1000m,
-			entry.ValidityScore, entry.ValidityModel,
-			entry.GPSAltitude, entry.GPSAltitudeAvailable, entry.TerrainAltitude)
+			entry.RoadWithin1000m, entry.RoadDistance, entry.RoadHighway, entry.RoadSurface,
+			entry.TrackDistance, entry.PathDistance,
+			entry.ValidityScore, entry.ValidityModel, entry.PreviewDHash,
+			entry.GPSAltitude, entry.GPSAltitudeDatum, entry.GPSAltitudeAvailable,
+			entry.TerrainAltitude, entry.TerrainAltitudeDatum, entry.AltitudeAboveTerrain,
+			entry.GPSStatus, entry.GPSHPositioningError, entry.GPSDOP, entry.GPSSatellites, entry.GPSDifferential,
+			entry.LocationConfidence,
+			entry.IsComplete, entry.IsAccepted)
 		if err != nil {
 			return err
 		}
 		return nil
 	}
 }
-
-func saveFlickrPhotoFetchFailure(db *pgx.Conn, flickrId string, err error) {
-	ctx := context.Background()
-	_, err = db.Exec(ctx, `
-		INSERT INTO flickr_photo_fetch_failures (flickr_id, err)
-		VALUES ($1, $2)
-	`, flickrId, err.Error())
-	if err != nil {
-		log.Println("Error saving fetch failure:", err)
-	}
-}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/notify"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	flag "github.com/spf13/pflag"
+	"log"
+)
+
+// rescoreMain implements `scorer rescore --from-vsn N --to-vsn M [--region R]`.
+//
+// It creates a score at version M for every photo scored at version N,
+// copying the results of stages that haven't changed since N. The normal
+// scoring loop then fills in the rest and re-applies the acceptance policy.
+func rescoreMain(args []string) {
+	flags := flag.NewFlagSet("rescore", flag.ExitOnError)
+	fromVsn := flags.Int("from-vsn", 0, "Version to copy still valid results from")
+	toVsn := flags.Int("to-vsn", activeVsn, "Version to create")
+	region := flags.Int("region", -1, "Only re-score photos in this region")
+	_ = flags.Parse(args)
+
+	if *fromVsn <= 0 {
+		log.Fatal("--from-vsn is required")
+	}
+	if *toVsn != activeVsn {
+		log.Fatalf("This build scores version %d, so can only re-score to it", activeVsn)
+	}
+	if *fromVsn >= *toVsn {
+		log.Fatal("--from-vsn must be before --to-vsn")
+	}
+
+	ctx := context.Background()
+	db, err := pgxpool.Connect(ctx, databaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	var regionID *int
+	if *region != -1 {
+		regionID = region
+	}
+
+	reused := reusableStages(scoringStages, *fromVsn)
+	for _, stage := range scoringStages {
+		if reused[stage.Name()] {
+			log.Printf("Reusing %s from version %d", stage.Name(), *fromVsn)
+		} else {
+			log.Printf("Recomputing %s (changed in version %d)", stage.Name(), stage.Since())
+		}
+	}
+
+	count, err := rescore(ctx, db, *fromVsn, *toVsn, regionID, reused)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Created %d scores at version %d", count, *toVsn)
+}
+
+// reusableStages returns the stages whose results at fromVsn are still valid.
+// A stage is only reusable if its inputs are too, as otherwise its outputs
+// could change. Its skip inputs don't matter: a copied result is kept even if
+// the stage would now be skipped, which the acceptance policy allows for as
+// it checks the same conditions as Skip, and a stage that was skipped before
+// has no result to copy so runs if it is now needed.
+func reusableStages(stages []Stage, fromVsn int) map[string]bool {
+	reused := make(map[string]bool)
+	for _, stage := range stages {
+		ok := stage.Since() <= fromVsn
+		for _, input := range stage.Inputs() {
+			ok = ok && reused[input]
+		}
+		reused[stage.Name()] = ok
+	}
+	return reused
+}
+
+func rescore(ctx context.Context, db *pgxpool.Pool, fromVsn, toVsn int, regionID *int, reused map[string]bool) (int, error) {
+	var columns []string
+	for _, stage := range scoringStages {
+		if !reused[stage.Name()] {
+			continue
+		}
+		for _, column := range stage.Outputs() {
+			columns = append(columns, pgx.Identifier{column}.Sanitize())
+		}
+	}
+	// Even with nothing to copy the photo needs a row at the new version, as
+	// the scoring loop only picks up photos scored at other versions by
+	// finishing an incomplete row
+	var insertColumns, selectColumns string
+	for _, column := range columns {
+		insertColumns += ", " + column
+		selectColumns += ", s." + column
+	}
+	tag, err := db.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO photo_scores (vsn, updated_at, flickr_photo_id%s)
+		SELECT $1, CURRENT_TIMESTAMP, s.flickr_photo_id%s
+		FROM photo_scores as s
+		JOIN flickr_photos as p ON p.flickr_id = s.flickr_photo_id
+		WHERE s.vsn = $2 AND ($3::int IS NULL OR p.region_id = $3)
+		ON CONFLICT (flickr_photo_id, vsn) DO NOTHING
+	`, insertColumns, selectColumns), toVsn, fromVsn, regionID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := notify.Notify(ctx, db, notify.PhotosIndexed); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStage only has the metadata reusableStages looks at
+type testStage struct {
+	name       string
+	since      int
+	inputs     []string
+	skipInputs []string
+}
+
+func (s testStage) Name() string           { return s.name }
+func (s testStage) Since() int             { return s.since }
+func (s testStage) Inputs() []string       { return s.inputs }
+func (s testStage) SkipInputs() []string   { return s.skipInputs }
+func (s testStage) Outputs() []string      { return nil }
+func (s testStage) Done(entry *Entry) bool { return false }
+func (s testStage) Skip(entry *Entry) bool { return false }
+func (s testStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	return nil
+}
+
+func reusedNames(reused map[string]bool) string {
+	var names []string
+	for name, ok := range reused {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestReusableStages(t *testing.T) {
+	cases := []struct {
+		fromVsn int
+		want    string
+	}{
+		// The road stage changed in 2, but the stages after it only read it
+		// to decide whether to run
+		{1, "exif gps_altitude terrain_altitude validity"},
+		{2, "exif gps_altitude road terrain_altitude validity"},
+		{3, "altitude_above_terrain exif gps_altitude road terrain_altitude validity"},
+		{4, "altitude_above_terrain exif gps_altitude gps_quality road terrain_altitude validity"},
+		{5, "altitude_above_terrain exif gps_altitude gps_quality preview_dhash road terrain_altitude validity"},
+	}
+	for _, tc := range cases {
+		if got := reusedNames(reusableStages(scoringStages, tc.fromVsn)); got != tc.want {
+			t.Errorf("from %d reused %q, want %q", tc.fromVsn, got, tc.want)
+		}
+	}
+}
+
+func TestReusableStagesFollowsInputs(t *testing.T) {
+	stages := mustOrderStages(
+		testStage{name: "a", since: 2},
+		testStage{name: "b", since: 1, inputs: []string{"a"}},
+		testStage{name: "c", since: 1, inputs: []string{"b"}},
+		testStage{name: "d", since: 1, skipInputs: []string{"a"}},
+		testStage{name: "e", since: 1, inputs: []string{"d"}, skipInputs: []string{"c"}},
+	)
+	if got := reusedNames(reusableStages(stages, 1)); got != "d e" {
+		t.Errorf("reused %q, want a change to a to invalidate b and c but not d and e", got)
+	}
+	if got := reusedNames(reusableStages(stages, 2)); got != "a b c d e" {
+		t.Errorf("reused %q, want all", got)
+	}
+}
+
+func TestOrderStagesWaitsForSkipInputs(t *testing.T) {
+	stages, err := orderStages(
+		testStage{name: "b", skipInputs: []string{"a"}},
+		testStage{name: "a"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages[0].Name() != "a" {
+		t.Errorf("%s ran first, want a before the stage that skips on it", stages[0].Name())
+	}
+
+	_, err = orderStages(
+		testStage{name: "a", inputs: []string{"b"}},
+		testStage{name: "b", skipInputs: []string{"a"}},
+	)
+	if err == nil {
+		t.Error("expected a cycle through a skip input")
+	}
+}
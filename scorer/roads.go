@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"os"
+	"strings"
+)
+
+// roadSearchRadius is how far (in meters) we look for highways. A region's
+// min_road_distance can't exceed it.
+const roadSearchRadius = 2000
+
+type nearbyHighway struct {
+	Highway  string
+	Surface  string
+	Distance float64
+}
+
+// A roadSource finds the highways within radius meters of a point.
+type roadSource interface {
+	nearbyHighways(ctx context.Context, regionID int, lng, lat, radius float64) ([]nearbyHighway, error)
+}
+
+var roads roadSource
+
+// setupRoads picks the backend from ROAD_BACKEND, either "overpass" (the
+// default, using OVERPASS_ENDPOINT) or "postgis" (using highways imported
+// with `scorer import-roads`).
+func setupRoads(db *pgxpool.Pool) error {
+	switch backend := os.Getenv("ROAD_BACKEND"); backend {
+	case "", "overpass":
+		endpoint := os.Getenv("OVERPASS_ENDPOINT")
+		if endpoint == "" {
+			return fmt.Errorf("OVERPASS_ENDPOINT not set")
+		}
+		roads = overpassRoads{endpoint: endpoint}
+	case "postgis":
+		roads = postgisRoads{db: db}
+	default:
+		return fmt.Errorf("unknown ROAD_BACKEND %q", backend)
+	}
+	return nil
+}
+
+// roadDistances summarizes the highways near a photo. Distances are nil if
+// there is nothing of that kind within roadSearchRadius.
+type roadDistances struct {
+	Road        *float64
+	RoadHighway *string
+	RoadSurface *string
+	Track       *float64
+	Path        *float64
+}
+
+var pathHighways = []string{"path", "footway", "bridleway"}
+
+func summarizeHighways(highways []nearbyHighway) roadDistances {
+	var out roadDistances
+	for _, h := range highways {
+		distance := h.Distance
+		if isRoad(h.Highway, h.Surface) {
+			if out.Road == nil || distance < *out.Road {
+				highway, surface := h.Highway, h.Surface
+				out.Road = &distance
+				out.RoadHighway = &highway
+				out.RoadSurface = &surface
+			}
+		} else if tagValueEquals(h.Highway, "track") {
+			if out.Track == nil || distance < *out.Track {
+				out.Track = &distance
+			}
+		} else if tagValueEquals(h.Highway, pathHighways...) {
+			if out.Path == nil || distance < *out.Path {
+				out.Path = &distance
+			}
+		}
+	}
+	return out
+}
+
+func tagValueEquals(tagValue string, needles ...string) bool {
+	for _, v := range strings.Split(tagValue, ";") {
+		for _, n := range needles {
+			if v == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// postgisRoads finds highways in the osm_highways table
+type postgisRoads struct {
+	db *pgxpool.Pool
+}
+
+func (p postgisRoads) nearbyHighways(ctx context.Context, regionID int, lng, lat, radius float64) ([]nearbyHighway, error) {
+	var imported bool
+	err := p.db.QueryRow(ctx, `
+		SELECT exists (SELECT 1 FROM osm_highway_imports WHERE region_id = $1)
+	`, regionID).Scan(&imported)
+	if err != nil {
+		return nil, err
+	}
+	if !imported {
+		return nil, fmt.Errorf("no highways imported for region %d", regionID)
+	}
+
+	rows, err := p.db.Query(ctx, `
+		SELECT coalesce(highway, ''), coalesce(surface, ''),
+			   ST_Distance(geo, ST_Point($1, $2, 4326)::geography)
+		FROM osm_highways
+		WHERE ST_DWithin(geo, ST_Point($1, $2, 4326)::geography, $3)
+	`, lng, lat, radius)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []nearbyHighway
+	for rows.Next() {
+		var h nearbyHighway
+		if err := rows.Scan(&h.Highway, &h.Surface, &h.Distance); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/osmpbf"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	flag "github.com/spf13/pflag"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Highways are imported this far outside the region so that photos near the
+// edge see the same roads Overpass would. The slack covers the approximate
+// degree conversion below.
+const roadImportMargin = roadSearchRadius + 500 // meters
+
+const roadImportBatchSize = 1000
+
+// importRoadsMain implements `scorer import-roads --region R extract.osm.pbf`.
+// It replaces the region's highways with those in the extract.
+func importRoadsMain(args []string) {
+	flags := flag.NewFlagSet("import-roads", flag.ExitOnError)
+	region := flags.Int("region", -1, "Region to import highways for")
+	_ = flags.Parse(args)
+
+	if *region == -1 {
+		log.Fatal("--region is required")
+	}
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: scorer import-roads --region R extract.osm.pbf")
+	}
+	path := flags.Arg(0)
+
+	ctx := context.Background()
+	db, err := pgxpool.Connect(ctx, databaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	var minLng, minLat, maxLng, maxLat float64
+	err = db.QueryRow(ctx, `
+		SELECT min_lng, min_lat, max_lng, max_lat FROM regions WHERE id = $1
+	`, *region).Scan(&minLng, &minLat, &maxLng, &maxLat)
+	if err != nil {
+		log.Fatalf("Failed to load region %d: %s", *region, err)
+	}
+	latMargin := roadImportMargin / 111_320.0
+	lngMargin := latMargin / math.Cos(math.Max(math.Abs(minLat), math.Abs(maxLat))*math.Pi/180)
+	bbox := [4]float64{minLng - lngMargin, minLat - latMargin, maxLng + lngMargin, maxLat + latMargin}
+
+	highways, err := readHighways(path, bbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Read %d highways within %v", len(highways), bbox)
+
+	if err := saveHighways(ctx, db, *region, path, highways); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Imported %d highways for region %d", len(highways), *region)
+}
+
+type highway struct {
+	OSMID   int64
+	Highway string
+	Surface string
+	// Coords are lng,lat pairs
+	Coords [][2]float64
+}
+
+// readHighways reads the file twice, first for the highway ways and then for
+// the locations of their nodes, to avoid holding every node in memory. A way
+// with nodes missing from the extract is returned as one highway per run of
+// nodes that are present.
+func readHighways(path string, bbox [4]float64) ([]highway, error) {
+	var ways []osmpbf.Way
+	needed := make(map[int64][2]float64)
+	err := eachBlock(path, func(block *osmpbf.Block) {
+		for _, way := range block.Ways {
+			if way.Tags["highway"] == "" {
+				continue
+			}
+			ways = append(ways, way)
+			for _, ref := range way.Refs {
+				needed[ref] = [2]float64{math.NaN(), math.NaN()}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found %d highway ways referencing %d nodes", len(ways), len(needed))
+
+	err = eachBlock(path, func(block *osmpbf.Block) {
+		for _, node := range block.Nodes {
+			if _, ok := needed[node.ID]; ok {
+				needed[node.ID] = [2]float64{node.Lon, node.Lat}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []highway
+	for _, way := range ways {
+		// Nodes clipped from the extract split the way, rather than the
+		// nodes either side being joined by a straight line
+		var part [][2]float64
+		flush := func() {
+			if len(part) >= 2 && lineIntersectsBBox(part, bbox) {
+				out = append(out, highway{
+					OSMID:   way.ID,
+					Highway: way.Tags["highway"],
+					Surface: way.Tags["surface"],
+					Coords:  part,
+				})
+			}
+			part = nil
+		}
+		for _, ref := range way.Refs {
+			coord := needed[ref]
+			if math.IsNaN(coord[0]) {
+				flush()
+				continue
+			}
+			part = append(part, coord)
+		}
+		flush()
+	}
+	return out, nil
+}
+
+// lineIntersectsBBox reports whether any segment of the line crosses bbox,
+// which catches ways passing through the region between distant nodes.
+func lineIntersectsBBox(coords [][2]float64, bbox [4]float64) bool {
+	for i := 1; i < len(coords); i++ {
+		if segmentIntersectsBBox(coords[i-1], coords[i], bbox) {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentIntersectsBBox clips the segment from a to b to bbox with the
+// Liang-Barsky algorithm and reports whether any of it is left.
+func segmentIntersectsBBox(a, b [2]float64, bbox [4]float64) bool {
+	t0, t1 := 0.0, 1.0
+	for axis := 0; axis < 2; axis++ {
+		d := b[axis] - a[axis]
+		// p and q for the low then the high edge on this axis
+		for _, pq := range [2][2]float64{
+			{-d, a[axis] - bbox[axis]},
+			{d, bbox[axis+2] - a[axis]},
+		} {
+			p, q := pq[0], pq[1]
+			if p == 0 {
+				if q < 0 {
+					// Parallel to and outside this edge
+					return false
+				}
+				continue
+			}
+			t := q / p
+			if p < 0 {
+				if t > t1 {
+					return false
+				}
+				t0 = max(t0, t)
+			} else {
+				if t < t0 {
+					return false
+				}
+				t1 = min(t1, t)
+			}
+		}
+	}
+	return t0 <= t1
+}
+
+func eachBlock(path string, fn func(block *osmpbf.Block)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := osmpbf.NewReader(f)
+	for {
+		block, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		fn(block)
+	}
+}
+
+func saveHighways(ctx context.Context, db *pgxpool.Pool, regionID int, source string, highways []highway) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM osm_highways WHERE region_id = $1`, regionID); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(highways); start += roadImportBatchSize {
+		end := min(start+roadImportBatchSize, len(highways))
+		batch := &pgx.Batch{}
+		for _, h := range highways[start:end] {
+			batch.Queue(`
+				INSERT INTO osm_highways (region_id, osm_id, highway, surface, geo)
+				VALUES ($1, $2, $3, nullif($4, ''), ST_GeogFromText($5))
+			`, regionID, h.OSMID, h.Highway, h.Surface, lineStringWKT(h.Coords))
+		}
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return fmt.Errorf("insert highways: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO osm_highway_imports (region_id, source, way_count, imported_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP)
+		ON CONFLICT (region_id) DO UPDATE SET source = $2, way_count = $3, imported_at = CURRENT_TIMESTAMP
+	`, regionID, source, len(highways))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func lineStringWKT(coords [][2]float64) string {
+	var b strings.Builder
+	b.WriteString("SRID=4326;LINESTRING(")
+	for i, c := range coords {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(strconv.FormatFloat(c[0], 'f', -1, 64))
+		b.WriteString(" ")
+		b.WriteString(strconv.FormatFloat(c[1], 'f', -1, 64))
+	}
+	b.WriteString(")")
+	return b.String()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"strings"
+)
+
+// A Stage computes some of the signals stored on an Entry. Stages run in
+// dependency order, each only once every stage it reads from is done.
+type Stage interface {
+	Name() string
+	// Since is the scoring version in which the stage last changed. Results
+	// from earlier versions are recomputed when re-scoring.
+	Since() int
+	// Inputs are the names of the stages whose outputs this stage reads
+	Inputs() []string
+	// SkipInputs are the names of the stages whose outputs only Skip reads.
+	// They decide whether the stage runs, but not what it computes, so a
+	// change to them doesn't invalidate its earlier results.
+	SkipInputs() []string
+	// Outputs are the photo_scores columns this stage writes
+	Outputs() []string
+	// Done reports whether the outputs are already set on entry
+	Done(entry *Entry) bool
+	// Skip reports whether the stage is unnecessary given its inputs, for
+	// example there is no need to classify a photo next to a road
+	Skip(entry *Entry) bool
+	Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error
+}
+
+// errStageWaiting is returned by Run when the stage has started work that
+// finishes elsewhere, such as queueing an EXIF fetch. The entry stays
+// incomplete and is picked up again later.
+var errStageWaiting = errors.New("waiting")
+
+type stageState int
+
+const (
+	stagePending stageState = iota
+	stageDone
+	stageSkipped
+)
+
+// dependencies returns every stage s has to wait for
+func dependencies(s Stage) []string {
+	return append(append([]string(nil), s.Inputs()...), s.SkipInputs()...)
+}
+
+// orderStages sorts stages so each comes after its inputs.
+func orderStages(stages ...Stage) ([]Stage, error) {
+	byName := make(map[string]Stage)
+	for _, s := range stages {
+		if _, ok := byName[s.Name()]; ok {
+			return nil, fmt.Errorf("duplicate stage %s", s.Name())
+		}
+		byName[s.Name()] = s
+	}
+
+	var out []Stage
+	visited := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var visit func(s Stage, path []string) error
+	visit = func(s Stage, path []string) error {
+		name := s.Name()
+		path = append(path, name)
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("stage cycle: %s", strings.Join(path, " -> "))
+		}
+		visiting[name] = true
+		for _, input := range dependencies(s) {
+			dep, ok := byName[input]
+			if !ok {
+				return fmt.Errorf("stage %s has unknown input %s", name, input)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		out = append(out, s)
+		return nil
+	}
+	for _, s := range stages {
+		if err := visit(s, nil); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// runStages runs every stage that can make progress on entry, then sets
+// IsComplete and IsAccepted.
+//
+// A stage is skipped if it says so or if any of its inputs was skipped, as
+// it then has nothing to work from. It stays pending if any input is
+// pending.
+func runStages(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	states := make(map[string]stageState)
+	for _, stage := range scoringStages {
+		state := stagePending
+		blocked := false
+		for _, input := range dependencies(stage) {
+			switch states[input] {
+			case stageSkipped:
+				state = stageSkipped
+			case stagePending:
+				blocked = true
+			}
+		}
+
+		if stage.Done(entry) {
+			state = stageDone
+		} else if state != stageSkipped && !blocked {
+			if stage.Skip(entry) {
+				state = stageSkipped
+			} else {
+				err := stage.Run(ctx, db, entry)
+				if errors.Is(err, errStageWaiting) {
+					state = stagePending
+				} else if err != nil {
+					return fmt.Errorf("stage %s: %w", stage.Name(), err)
+				} else {
+					state = stageDone
+				}
+			}
+		}
+		states[stage.Name()] = state
+	}
+
+	complete := true
+	for _, state := range states {
+		if state == stagePending {
+			complete = false
+		}
+	}
+	entry.IsComplete = &complete
+	if complete {
+		accepted := acceptPolicy(entry)
+		entry.IsAccepted = &accepted
+	} else {
+		entry.IsAccepted = nil
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"contourguessr-ingest/classifier"
+	"contourguessr-ingest/elevation"
+	"contourguessr-ingest/notify"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+)
+
+// scoringStages is every stage, in the order they run. To add a signal,
+// implement Stage, add its columns to Entry, loadBatch and Save, and list
+// it here.
+var scoringStages = mustOrderStages(
+	roadStage{},
+	validityStage{},
+	previewDHashStage{},
+	exifStage{},
+	gpsAltitudeStage{},
+	terrainAltitudeStage{},
+	altitudeAboveTerrainStage{},
+	gpsQualityStage{},
+)
+
+func mustOrderStages(stages ...Stage) []Stage {
+	ordered, err := orderStages(stages...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ordered
+}
+
+// roadStage measures the distance to the nearest road, track and path
+type roadStage struct{}
+
+func (roadStage) Name() string         { return "road" }
+func (roadStage) Since() int           { return 2 }
+func (roadStage) Inputs() []string     { return nil }
+func (roadStage) SkipInputs() []string { return nil }
+func (roadStage) Outputs() []string {
+	return []string{"road_within_1000m", "road_distance", "road_highway", "road_surface",
+		"track_distance", "path_distance"}
+}
+
+func (roadStage) Done(entry *Entry) bool { return entry.RoadWithin1000m != nil }
+
+func (roadStage) Skip(entry *Entry) bool { return false }
+
+func (roadStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	var highways []nearbyHighway
+	err := roadDep.do(ctx, func(ctx context.Context) error {
+		var err error
+		highways, err = roads.nearbyHighways(ctx, entry.RegionID, entry.Lng, entry.Lat, roadSearchRadius)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	summary := summarizeHighways(highways)
+	within1000m := summary.Road != nil && *summary.Road <= 1000
+	entry.RoadWithin1000m = &within1000m
+	entry.RoadDistance = summary.Road
+	entry.RoadHighway = summary.RoadHighway
+	entry.RoadSurface = summary.RoadSurface
+	entry.TrackDistance = summary.Track
+	entry.PathDistance = summary.Path
+	return nil
+}
+
+// validityStage fetches the preview and asks the classifier whether it looks
+// like a landscape we can use
+type validityStage struct{}
+
+func (validityStage) Name() string         { return "validity" }
+func (validityStage) Since() int           { return 1 }
+func (validityStage) Inputs() []string     { return nil }
+func (validityStage) SkipInputs() []string { return []string{"road"} }
+func (validityStage) Outputs() []string {
+	return []string{"validity_score", "validity_model"}
+}
+
+func (validityStage) Done(entry *Entry) bool { return entry.ValidityScore != nil }
+
+func (validityStage) Skip(entry *Entry) bool { return tooCloseToRoad(entry) }
+
+func (validityStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	photoData, err := fetchPreview(ctx, db, entry)
+	if err != nil {
+		return err
+	}
+
+	validity, err := queryValidity(ctx, db, photoData)
+	if err != nil {
+		if classifier.IsRejected(err) {
+			// The classifier rejected the image, so retrying won't help
+			saveFlickrPhotoFetchFailure(db, entry.FlickrId, fmt.Errorf("classify: %w", err))
+		}
+		return err
+	}
+
+	entry.ValidityScore = &validity.Score
+	entry.ValidityModel = &validity.Model
+	return nil
+}
+
+// previewDHashStage hashes the preview so the challenge assembler can skip
+// near duplicates. It only runs for photos that could be accepted. When
+// validity ran in the same pass the preview is already on the entry, so it
+// is only fetched again for photos classified by an earlier version.
+type previewDHashStage struct{}
+
+func (previewDHashStage) Name() string         { return "preview_dhash" }
+func (previewDHashStage) Since() int           { return 5 }
+func (previewDHashStage) Inputs() []string     { return nil }
+func (previewDHashStage) SkipInputs() []string { return []string{"validity"} }
+func (previewDHashStage) Outputs() []string    { return []string{"preview_dhash"} }
+
+func (previewDHashStage) Done(entry *Entry) bool { return entry.PreviewDHash != nil }
+
+func (previewDHashStage) Skip(entry *Entry) bool {
+	return *entry.ValidityScore < validityThreshold
+}
+
+func (previewDHashStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	photoData, err := fetchPreview(ctx, db, entry)
+	if err != nil {
+		return err
+	}
+	hash, err := previewDHash(photoData)
+	if err != nil {
+		return fmt.Errorf("hash preview: %w", err)
+	}
+	entry.PreviewDHash = &hash
+	return nil
+}
+
+// exifStage asks the indexer to fetch EXIF, which is rate limited so we only
+// do it for photos that have passed the cheaper checks. If the fetch has
+// failed too many times the photo is scored as having no EXIF.
+type exifStage struct{}
+
+func (exifStage) Name() string         { return "exif" }
+func (exifStage) Since() int           { return 1 }
+func (exifStage) Inputs() []string     { return nil }
+func (exifStage) SkipInputs() []string { return []string{"road", "validity"} }
+func (exifStage) Outputs() []string    { return nil }
+
+func (exifStage) Done(entry *Entry) bool { return entry.Exif != nil }
+
+func (exifStage) Skip(entry *Entry) bool {
+	return *entry.ValidityScore < validityThreshold
+}
+
+func (exifStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	added, err := exifQueue.Enqueue(ctx, db, entry.FlickrId)
+	if err != nil {
+		return err
+	}
+	if added > 0 {
+		if err := notify.Notify(ctx, db, notify.ExifQueued); err != nil {
+			return err
+		}
+		return errStageWaiting
+	}
+
+	dead, err := exifQueue.IsDead(ctx, db, entry.FlickrId)
+	if err != nil {
+		return err
+	}
+	if dead {
+		log.Printf("EXIF fetch for %s is dead, scoring without EXIF", entry.FlickrId)
+		noExif := map[string]string{}
+		entry.Exif = &noExif
+		return nil
+	}
+	return errStageWaiting
+}
+
+// gpsAltitudeStage reads the altitude the camera recorded
+type gpsAltitudeStage struct{}
+
+func (gpsAltitudeStage) Name() string         { return "gps_altitude" }
+func (gpsAltitudeStage) Since() int           { return 1 }
+func (gpsAltitudeStage) Inputs() []string     { return []string{"exif"} }
+func (gpsAltitudeStage) SkipInputs() []string { return nil }
+func (gpsAltitudeStage) Outputs() []string {
+	return []string{"gps_altitude", "gps_altitude_datum", "gps_altitude_available"}
+}
+
+func (gpsAltitudeStage) Done(entry *Entry) bool { return entry.GPSAltitudeAvailable != nil }
+
+func (gpsAltitudeStage) Skip(entry *Entry) bool { return false }
+
+func (gpsAltitudeStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	altitude, ok := exifGPSAltitude(*entry.Exif)
+	entry.GPSAltitudeAvailable = &ok
+	if ok {
+		// EXIF altitudes are relative to sea level
+		datum := elevation.MeanSeaLevel.String()
+		entry.GPSAltitude = &altitude
+		entry.GPSAltitudeDatum = &datum
+	}
+	return nil
+}
+
+// terrainAltitudeStage looks up the ground elevation to compare against the
+// GPS altitude. Older results are relative to the ellipsoid, but as the
+// datum is recorded they are still usable.
+type terrainAltitudeStage struct{}
+
+func (terrainAltitudeStage) Name() string         { return "terrain_altitude" }
+func (terrainAltitudeStage) Since() int           { return 1 }
+func (terrainAltitudeStage) Inputs() []string     { return nil }
+func (terrainAltitudeStage) SkipInputs() []string { return []string{"gps_altitude"} }
+func (terrainAltitudeStage) Outputs() []string {
+	return []string{"terrain_altitude", "terrain_altitude_datum"}
+}
+
+func (terrainAltitudeStage) Done(entry *Entry) bool { return entry.TerrainAltitude != nil }
+
+func (terrainAltitudeStage) Skip(entry *Entry) bool { return !*entry.GPSAltitudeAvailable }
+
+func (terrainAltitudeStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	var value float64
+	err := elevationDep.do(ctx, func(ctx context.Context) error {
+		var err error
+		value, err = getElevation(ctx, entry.Lng, entry.Lat)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	datum := terrainDatum.String()
+	entry.TerrainAltitude = &value
+	entry.TerrainAltitudeDatum = &datum
+	return nil
+}
+
+// altitudeAboveTerrainStage compares the GPS and terrain altitudes, converting
+// them to a common datum if they were recorded with different ones
+type altitudeAboveTerrainStage struct{}
+
+func (altitudeAboveTerrainStage) Name() string { return "altitude_above_terrain" }
+func (altitudeAboveTerrainStage) Since() int   { return 3 }
+func (altitudeAboveTerrainStage) Inputs() []string {
+	return []string{"gps_altitude", "terrain_altitude"}
+}
+func (altitudeAboveTerrainStage) SkipInputs() []string { return nil }
+func (altitudeAboveTerrainStage) Outputs() []string    { return []string{"altitude_above_terrain"} }
+
+func (altitudeAboveTerrainStage) Done(entry *Entry) bool { return entry.AltitudeAboveTerrain != nil }
+
+func (altitudeAboveTerrainStage) Skip(entry *Entry) bool { return false }
+
+func (altitudeAboveTerrainStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	value, err := altitudeDifference(entry.Lng, entry.Lat,
+		*entry.GPSAltitude, *entry.GPSAltitudeDatum, *entry.TerrainAltitude, *entry.TerrainAltitudeDatum)
+	if err != nil {
+		return err
+	}
+	entry.AltitudeAboveTerrain = &value
+	return nil
+}
+
+// gpsQualityStage reads what the camera recorded about its GPS fix
+type gpsQualityStage struct{}
+
+func (gpsQualityStage) Name() string         { return "gps_quality" }
+func (gpsQualityStage) Since() int           { return 4 }
+func (gpsQualityStage) Inputs() []string     { return []string{"exif"} }
+func (gpsQualityStage) SkipInputs() []string { return nil }
+func (gpsQualityStage) Outputs() []string {
+	return []string{"gps_status", "gps_h_positioning_error", "gps_dop", "gps_satellites", "gps_differential",
+		"location_confidence"}
+}
+
+func (gpsQualityStage) Done(entry *Entry) bool { return entry.LocationConfidence != nil }
+
+func (gpsQualityStage) Skip(entry *Entry) bool { return false }
+
+func (gpsQualityStage) Run(ctx context.Context, db *pgxpool.Pool, entry *Entry) error {
+	quality := exifGPSQuality(*entry.Exif)
+	confidence := quality.locationConfidence()
+	entry.GPSStatus = quality.Status
+	entry.GPSHPositioningError = quality.HPositioningError
+	entry.GPSDOP = quality.DOP
+	entry.GPSSatellites = quality.Satellites
+	entry.GPSDifferential = quality.Differential
+	entry.LocationConfidence = &confidence
+	return nil
+}
@@ -1,61 +1,167 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"contourguessr-ingest/classifier"
+	"errors"
+	"fmt"
 	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"log"
-	"net/http"
+	"sync"
 	"time"
 )
 
-type validityResult struct {
-	Score float64 `json:"validity_score"`
-	Model string  `json:"model"`
-}
+var classifierClient *classifier.Client
+var classifierBatcher *classifier.Batcher
 
-func queryValidity(photoData []byte) (*validityResult, error) {
-	var result *validityResult
-	err := backoff.Retry(func() error {
-		var err error
-		result, err = queryValidityNoRetry(photoData)
+// classifierMaxElapsed bounds how long a batch is retried for
+const classifierMaxElapsed = 5 * time.Minute
+
+// setupClassifier reads SCORER_CLASSIFIER_BATCH (the most images per
+// request) and SCORER_CLASSIFIER_BATCH_WAIT (how long to wait for a batch
+// to fill). Each worker classifies one photo at a time, so batches are
+// capped at the number of workers or they could never fill.
+func setupClassifier(workers int) error {
+	var err error
+	classifierClient, err = classifier.NewClient(classifierEndpoint)
+	if err != nil {
 		return err
-	}, backoff.NewExponentialBackOff())
+	}
+	maxBatch, err := envInt("SCORER_CLASSIFIER_BATCH", 8)
 	if err != nil {
-		log.Printf("Error querying validity: %v", err)
+		return err
 	}
-	return result, err
+	if maxBatch < 1 {
+		return fmt.Errorf("SCORER_CLASSIFIER_BATCH must be at least 1")
+	}
+	if maxBatch > workers {
+		log.Printf("Capping SCORER_CLASSIFIER_BATCH at %d, the number of workers", workers)
+		maxBatch = workers
+	}
+	maxWait, err := envDuration("SCORER_CLASSIFIER_BATCH_WAIT", time.Second)
+	if err != nil {
+		return err
+	}
+	classifierBatcher = classifier.NewBatcher(classifyBatch, classifyOne, maxBatch, maxWait)
+	return nil
 }
 
-func queryValidityNoRetry(photoData []byte) (*validityResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	reqData := struct {
-		ImageBase64 string `json:"image_base64"`
-	}{base64.StdEncoding.EncodeToString(photoData)}
-	reqBody, err := json.Marshal(reqData)
+// queryValidity classifies a photo as part of the next batch, and records
+// the model that scored it.
+func queryValidity(ctx context.Context, db *pgxpool.Pool, photoData []byte) (*classifier.Result, error) {
+	result, err := classifierBatcher.Classify(ctx, photoData)
 	if err != nil {
+		log.Printf("Error querying validity: %v", err)
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", classifierEndpoint+"/api/v0/classify", bytes.NewReader(reqBody))
-	if err != nil {
+	if err := classifierModels.record(ctx, db, result.Model); err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	return result, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// classifyBatch retries transient failures. Only the attempts themselves
+// occupy a classifier slot, not the waits between them.
+func classifyBatch(ctx context.Context, images [][]byte) ([]classifier.Result, error) {
+	var results []classifier.Result
+	err := retryClassifier(ctx, len(images), func(ctx context.Context) error {
+		var err error
+		results, err = classifierClient.ClassifyBatch(ctx, images)
+		return err
+	})
+	return results, err
+}
+
+// classifyOne retries a single image of a rejected batch the same way
+func classifyOne(ctx context.Context, image []byte) (*classifier.Result, error) {
+	var result *classifier.Result
+	err := retryClassifier(ctx, 1, func(ctx context.Context) error {
+		var err error
+		result, err = classifierClient.Classify(ctx, image)
+		return err
+	})
+	return result, err
+}
+
+func retryClassifier(ctx context.Context, images int, attempt func(ctx context.Context) error) error {
+	policy := backoff.NewExponentialBackOff()
+	policy.MaxElapsedTime = classifierMaxElapsed
+
+	return backoff.RetryNotify(func() error {
+		err := classifierDep.do(ctx, attempt)
+		// An attempt hitting the dependency timeout is worth retrying
+		timedOut := ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded)
+		if err != nil && !timedOut && !classifier.IsTransient(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(policy, ctx), func(err error, wait time.Duration) {
+		log.Printf("Classifying %d images failed, retrying in %s: %s", images, wait, err)
+	})
+}
+
+// modelRegistry records classifier models in classifier_models the first
+// time this process sees them used
+type modelRegistry struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+var classifierModels = &modelRegistry{seen: make(map[string]bool)}
+
+// record stores the model, with its metadata if the classifier lists it.
+// The model is only marked seen once that has been stored, so a failed
+// listing is retried the next time the model is used. The classifier is
+// queried without holding the lock, so workers may occasionally both list
+// a new model.
+func (m *modelRegistry) record(ctx context.Context, db *pgxpool.Pool, name string) error {
+	m.mu.Lock()
+	seen := m.seen[name]
+	m.mu.Unlock()
+	if seen {
+		return nil
+	}
+
+	// A model we haven't seen is likely new, so refresh what we know
+	models, err := classifierClient.Models(ctx)
 	if err != nil {
-		return nil, err
+		log.Printf("Error listing classifier models: %v", err)
+	}
+	var stored []string
+	for _, model := range models {
+		_, err := db.Exec(ctx, `
+			INSERT INTO classifier_models (name, metadata)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET metadata     = excluded.metadata,
+											 last_seen_at = CURRENT_TIMESTAMP
+		`, model.Name, model.Metadata)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, model.Name)
 	}
-	defer resp.Body.Close()
 
-	var result validityResult
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	listed := err == nil
+
+	// Models missing from the list are still recorded, without metadata
+	_, err = db.Exec(ctx, `
+		INSERT INTO classifier_models (name)
+		VALUES ($1)
+		ON CONFLICT (name) DO UPDATE SET last_seen_at = CURRENT_TIMESTAMP
+	`, name)
+	if err != nil {
+		return err
 	}
 
-	return &result, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, model := range stored {
+		m.seen[model] = true
+	}
+	if listed {
+		// Listing again won't turn up metadata the classifier doesn't have
+		m.seen[name] = true
+	}
+	return nil
 }